@@ -0,0 +1,694 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"ttv/client"
+)
+
+type command struct {
+	usage string
+	run   func(c *client.Client, o *cliOptions, args []string) error
+	flags func(fs *flag.FlagSet, o *cliOptions)
+}
+
+// cliOptions has flags of every command, each command registers what it uses
+type cliOptions struct {
+	endpoint string
+	token    string
+	json     bool
+	category string
+	name     string
+	paused   bool
+	tags     tagFlags
+	filter   string
+	data     bool
+	force    bool
+	follow   bool
+	lines    int
+	cont     bool
+	private  bool
+	trackers tagFlags
+	webseeds tagFlags
+	comment  string
+	piece    int64
+	datapath string
+	dryRun   bool
+}
+
+type tagFlags []string
+
+func (t *tagFlags) String() string     { return strings.Join(*t, ",") }
+func (t *tagFlags) Set(v string) error { *t = append(*t, v); return nil }
+
+var commands = map[string]*command{
+	"add": {
+		usage: "add <file|magnet|url>... [--category name] [--name name] [--paused] [--tag k=v] [--data dir]",
+		run:   cmdAdd,
+		flags: func(fs *flag.FlagSet, o *cliOptions) {
+			fs.StringVar(&o.category, "category", "", "category, server's default if empty")
+			fs.StringVar(&o.name, "name", "", "torrent name")
+			fs.BoolVar(&o.paused, "paused", false, "add paused")
+			fs.Var(&o.tags, "tag", "tag as k=v, may be repeated")
+			fs.StringVar(&o.datapath, "data", "", "dir on server with data already there, it is checked and kept there")
+		},
+	},
+	"import": {
+		usage: "import transmission|qbittorrent <dir on server> [--category name] [--paused] [--dry-run]",
+		run:   cmdImport,
+		flags: func(fs *flag.FlagSet, o *cliOptions) {
+			fs.StringVar(&o.category, "category", "", "category of torrents no label or save path maps to")
+			fs.BoolVar(&o.paused, "paused", false, "add all paused")
+			fs.BoolVar(&o.dryRun, "dry-run", false, "only show what would be imported")
+		},
+	},
+	"ls": {
+		usage: "ls [--filter downloading|seeding|paused|playing|completed|<name part>] [--category name]",
+		run:   cmdList,
+		flags: func(fs *flag.FlagSet, o *cliOptions) {
+			fs.StringVar(&o.filter, "filter", "", "state or part of name")
+			fs.StringVar(&o.category, "category", "", "only torrents in category")
+		},
+	},
+	"create": {
+		usage: "create <category> <path in downloads> [--private] [--tracker url]... [--webseed url]... [--comment text] [--piece bytes]",
+		run:   cmdCreate,
+		flags: func(fs *flag.FlagSet, o *cliOptions) {
+			fs.BoolVar(&o.private, "private", false, "private torrent, no dht and pex")
+			fs.Var(&o.trackers, "tracker", "announce url, may be repeated")
+			fs.Var(&o.webseeds, "webseed", "web seed url, may be repeated")
+			fs.StringVar(&o.comment, "comment", "", "comment")
+			fs.Int64Var(&o.piece, "piece", 0, "piece length, picked from size if 0")
+		},
+	},
+	"info":   {usage: "info <name|infohash>", run: cmdInfo},
+	"pause":  {usage: "pause <name|infohash>...", run: cmdPause},
+	"resume": {usage: "resume <name|infohash>...", run: cmdResume},
+	"rm": {
+		usage: "rm <name|infohash>... [--data] [--force]",
+		run:   cmdRemove,
+		flags: func(fs *flag.FlagSet, o *cliOptions) {
+			fs.BoolVar(&o.data, "data", false, "remove downloaded data too")
+			fs.BoolVar(&o.force, "force", false, "don't wait for seed_until")
+		},
+	},
+	"tag":  {usage: "tag <name|infohash> k=v... (k= removes tag)", run: cmdTag},
+	"prio": {usage: "prio <name|infohash> <index>... skip|normal|high|rules", run: cmdPrio},
+	"history": {
+		usage: "history [name|infohash] [-n sessions] [--continue]",
+		run:   cmdHistory,
+		flags: func(fs *flag.FlagSet, o *cliOptions) {
+			fs.IntVar(&o.lines, "n", 20, "sessions to show")
+			fs.BoolVar(&o.cont, "continue", false, "unfinished files and next episodes instead")
+		},
+	},
+	"watched":  {usage: "watched <name|infohash> <index>... yes|no", run: cmdWatched},
+	"play-url": {usage: "play-url <name|infohash> [file|index], largest file by default", run: cmdPlayUrl},
+	"logs": {
+		usage: "logs [-f] [-n lines]",
+		run:   cmdLogs,
+		flags: func(fs *flag.FlagSet, o *cliOptions) {
+			fs.BoolVar(&o.follow, "f", false, "follow")
+			fs.IntVar(&o.lines, "n", 100, "lines to show")
+		},
+	},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ttv [serve]\n       ttv <command> [--endpoint url] [--token token] [--json] ...\n\ncommands:")
+	names := make([]string, 0)
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nendpoint and token default to TC_ENDPOINT and TC_TOKEN")
+}
+
+func getEnv(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// parseArgs lets flags go after positional arguments, flag package stops at first one
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	rc := make([]string, 0)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return rc, nil
+		}
+		rc = append(rc, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// runCommand returns exit code
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		if name != "help" {
+			fmt.Fprintf(os.Stderr, "ttv: unknown command %s\n", name)
+		}
+		usage()
+		return 2
+	}
+	o := &cliOptions{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&o.endpoint, "endpoint", getEnv("TC_ENDPOINT", "http://localhost:"+getEnv("TC_HTTPPORT", "3003")), "server url")
+	fs.StringVar(&o.token, "token", os.Getenv("TC_TOKEN"), "api token")
+	fs.BoolVar(&o.json, "json", false, "print json")
+	if cmd.flags != nil {
+		cmd.flags(fs, o)
+	}
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ttv "+cmd.usage)
+		fs.PrintDefaults()
+	}
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	c := client.New(o.endpoint)
+	c.Token = o.token
+	if err := cmd.run(c, o, rest); err != nil {
+		fmt.Fprintf(os.Stderr, "ttv %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func printJson(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func printTable(header []string, rows [][]string) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, r := range rows {
+		fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+	tw.Flush()
+}
+
+func humanSize(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
+
+func tagString(tags map[string]interface{}, key string) string {
+	if v, ok := tags[key]; ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func torrentState(t client.TorrentInfo) string {
+	switch {
+	case t.OpenPlays > 0:
+		return "playing"
+	case t.Paused:
+		return "paused"
+	case t.Completed:
+		return "seeding"
+	}
+	return "downloading"
+}
+
+func needArgs(args []string, n int, what string) error {
+	if len(args) < n {
+		return fmt.Errorf("%s is required", what)
+	}
+	return nil
+}
+
+func cmdAdd(c *client.Client, o *cliOptions, args []string) error {
+	if err := needArgs(args, 1, "torrent file, magnet or url"); err != nil {
+		return err
+	}
+	req := client.AddTorrentRequest{Name: o.name, Category: o.category, Paused: o.paused, Tags: map[string]string{}, DataPath: o.datapath}
+	for _, kv := range o.tags {
+		k := strings.SplitN(kv, "=", 2)
+		if len(k) != 2 {
+			return fmt.Errorf("bad tag '%s', k=v expected", kv)
+		}
+		req.Tags[k[0]] = k[1]
+	}
+	rc := make([]client.AddTorrentResponse, 0)
+	for _, src := range args {
+		r := req
+		var added client.AddTorrentResponse
+		var err error
+		switch {
+		case strings.HasPrefix(src, "magnet:"):
+			r.Magnet = src
+			added, err = c.Add(r)
+		case strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://"):
+			r.Url = src
+			added, err = c.Add(r)
+		default:
+			added, err = c.AddFile(r, src)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+		rc = append(rc, added)
+	}
+	if o.json {
+		return printJson(rc)
+	}
+	rows := make([][]string, 0)
+	for _, r := range rc {
+		rows = append(rows, []string{r.Status, r.Name, r.InfoHash})
+	}
+	printTable([]string{"STATUS", "NAME", "INFOHASH"}, rows)
+	return nil
+}
+
+func cmdList(c *client.Client, o *cliOptions, args []string) error {
+	list, err := c.List(o.category)
+	if err != nil {
+		return err
+	}
+	rc := make([]client.TorrentInfo, 0)
+	for _, t := range list {
+		switch o.filter {
+		case "":
+		case "downloading", "seeding", "paused", "playing":
+			if torrentState(t) != o.filter {
+				continue
+			}
+		case "completed":
+			if !t.Completed {
+				continue
+			}
+		default:
+			if !strings.Contains(strings.ToLower(t.Name), strings.ToLower(o.filter)) {
+				continue
+			}
+		}
+		rc = append(rc, t)
+	}
+	sort.Slice(rc, func(i, j int) bool { return strings.ToLower(rc[i].Name) < strings.ToLower(rc[j].Name) })
+	if o.json {
+		return printJson(rc)
+	}
+	rows := make([][]string, 0)
+	for _, t := range rc {
+		rate := ""
+		if !t.Paused && !t.Completed {
+			rate = humanSize(int64(t.DownloadRate)) + "/s"
+		}
+		hash := tagString(t.Tags, "infohash")
+		if len(hash) > 8 {
+			hash = hash[:8]
+		}
+		rows = append(rows, []string{
+			t.Name, tagString(t.Tags, "category"), strconv.Itoa(t.Completion) + "%", humanSize(t.Size), rate,
+			fmt.Sprintf("%d/%d", t.Seeders, t.Leechers), torrentState(t), hash,
+		})
+	}
+	printTable([]string{"NAME", "CATEGORY", "DONE", "SIZE", "RATE", "PEERS", "STATE", "HASH"}, rows)
+	return nil
+}
+
+func cmdInfo(c *client.Client, o *cliOptions, args []string) error {
+	if err := needArgs(args, 1, "torrent"); err != nil {
+		return err
+	}
+	t, err := c.Get(args[0])
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printJson(t)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, kv := range [][]string{
+		{"name", t.Name},
+		{"infohash", tagString(t.Tags, "infohash")},
+		{"category", tagString(t.Tags, "category")},
+		{"state", torrentState(t)},
+		{"size", humanSize(t.Size)},
+		{"done", fmt.Sprintf("%d%%", t.Completion)},
+		{"rate", humanSize(int64(t.DownloadRate)) + "/s"},
+		{"peers", fmt.Sprintf("%d seeders, %d leechers", t.Seeders, t.Leechers)},
+		{"downloaded", humanSize(t.BytesDownloaded)},
+		{"uploaded", humanSize(t.BytesUploaded)},
+		{"plays", strconv.Itoa(t.OpenPlays)},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", kv[0], kv[1])
+	}
+	keys := make([]string, 0)
+	for k := range t.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(tw, "tags:\t")
+	for _, k := range keys {
+		fmt.Fprintf(tw, "  %s\t%v\n", k, t.Tags[k])
+	}
+	tw.Flush()
+	fmt.Println()
+	rows := make([][]string, 0)
+	for i, f := range t.Files {
+		ready := ""
+		if f.Ready {
+			ready = "yes"
+		}
+		rows = append(rows, []string{strconv.Itoa(i), f.Name, humanSize(f.Size), f.Priority, ready})
+	}
+	printTable([]string{"#", "FILE", "SIZE", "PRIORITY", "READY"}, rows)
+	return nil
+}
+
+func pauseResume(c *client.Client, o *cliOptions, args []string, pause bool) error {
+	if err := needArgs(args, 1, "torrent"); err != nil {
+		return err
+	}
+	rc := make([]client.TorrentInfo, 0)
+	for _, id := range args {
+		var t client.TorrentInfo
+		var err error
+		if pause {
+			t, err = c.Pause(id)
+		} else {
+			t, err = c.Resume(id)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", id, err)
+		}
+		rc = append(rc, t)
+		if !o.json {
+			fmt.Printf("%s: %s\n", t.Name, torrentState(t))
+		}
+	}
+	if o.json {
+		return printJson(rc)
+	}
+	return nil
+}
+
+func cmdPause(c *client.Client, o *cliOptions, args []string) error {
+	return pauseResume(c, o, args, true)
+}
+
+func cmdResume(c *client.Client, o *cliOptions, args []string) error {
+	return pauseResume(c, o, args, false)
+}
+
+func cmdRemove(c *client.Client, o *cliOptions, args []string) error {
+	if err := needArgs(args, 1, "torrent"); err != nil {
+		return err
+	}
+	rc := map[string]string{}
+	for _, id := range args {
+		done, err := c.Remove(id, o.data, o.force)
+		if err != nil {
+			return fmt.Errorf("%s: %v", id, err)
+		}
+		status := "removed"
+		if !done {
+			status = "pending, in play or still seeding"
+		}
+		rc[id] = status
+		if !o.json {
+			fmt.Printf("%s: %s\n", id, status)
+		}
+	}
+	if o.json {
+		return printJson(rc)
+	}
+	return nil
+}
+
+func cmdTag(c *client.Client, o *cliOptions, args []string) error {
+	if err := needArgs(args, 2, "torrent and k=v"); err != nil {
+		return err
+	}
+	set := map[string]string{}
+	for _, kv := range args[1:] {
+		k := strings.SplitN(kv, "=", 2)
+		if len(k) != 2 || k[0] == "" {
+			return fmt.Errorf("bad tag '%s', k=v expected", kv)
+		}
+		if k[1] == "" {
+			if err := c.Untag(args[0], k[0]); err != nil {
+				return fmt.Errorf("%s: %v", k[0], err)
+			}
+			continue
+		}
+		set[k[0]] = k[1]
+	}
+	var tags map[string]interface{}
+	var err error
+	if len(set) > 0 {
+		tags, err = c.Tag(args[0], set)
+	} else {
+		tags, err = c.Tags(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printJson(tags)
+	}
+	keys := make([]string, 0)
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s=%v\n", k, tags[k])
+	}
+	return nil
+}
+
+// cmdPrio sets priority of files, rules drops it so category rules decide
+func cmdPrio(c *client.Client, o *cliOptions, args []string) error {
+	if err := needArgs(args, 3, "torrent, file indexes and priority"); err != nil {
+		return err
+	}
+	prio := args[len(args)-1]
+	if prio == "rules" {
+		prio = ""
+	}
+	for _, arg := range args[1 : len(args)-1] {
+		i, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("bad file index '%s'", arg)
+		}
+		f, err := c.SetFilePriority(args[0], i, prio)
+		if err != nil {
+			return fmt.Errorf("%d: %v", i, err)
+		}
+		if o.json {
+			if err := printJson(f); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Printf("%d %s: %s\n", i, f.Name, f.Priority)
+	}
+	return nil
+}
+
+func cmdHistory(c *client.Client, o *cliOptions, args []string) error {
+	if o.cont {
+		list, err := c.ContinueWatching(o.lines)
+		if err != nil {
+			return err
+		}
+		if o.json {
+			return printJson(list)
+		}
+		rows := make([][]string, 0)
+		for _, ws := range list {
+			rows = append(rows, []string{
+				ws.Torrent, strconv.Itoa(ws.Index), ws.File, strconv.Itoa(ws.Progress) + "%",
+				(time.Duration(ws.PositionSeconds) * time.Second).String(), ws.LastPlayed.Format("2006-01-02 15:04"),
+			})
+		}
+		printTable([]string{"TORRENT", "INDEX", "FILE", "DONE", "RESUME", "LAST PLAYED"}, rows)
+		return nil
+	}
+	torrent := ""
+	if len(args) > 0 {
+		torrent = args[0]
+	}
+	list, err := c.History(torrent, o.lines)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printJson(list)
+	}
+	rows := make([][]string, 0)
+	for _, s := range list {
+		state := "closed"
+		if s.Active {
+			state = "playing"
+		}
+		rows = append(rows, []string{
+			strconv.Itoa(s.Id), s.Started.Format("2006-01-02 15:04"), (time.Duration(s.Duration) * time.Second).String(),
+			s.File, humanSize(s.BytesServed), s.Client, state,
+		})
+	}
+	printTable([]string{"ID", "STARTED", "LENGTH", "FILE", "SERVED", "CLIENT", "STATE"}, rows)
+	return nil
+}
+
+func cmdWatched(c *client.Client, o *cliOptions, args []string) error {
+	if err := needArgs(args, 3, "torrent, file indexes and yes or no"); err != nil {
+		return err
+	}
+	v := args[len(args)-1]
+	if v != "yes" && v != "no" {
+		return fmt.Errorf("watched is yes or no, not '%s'", v)
+	}
+	for _, arg := range args[1 : len(args)-1] {
+		i, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("bad file index '%s'", arg)
+		}
+		ws, err := c.SetWatched(args[0], i, v == "yes")
+		if err != nil {
+			return fmt.Errorf("%d: %v", i, err)
+		}
+		if o.json {
+			if err := printJson(ws); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Printf("%d %s: watched %v\n", i, ws.File, ws.Watched)
+	}
+	return nil
+}
+
+func cmdCreate(c *client.Client, o *cliOptions, args []string) error {
+	if err := needArgs(args, 2, "category and path"); err != nil {
+		return err
+	}
+	rc, err := c.CreateTorrent(client.CreateTorrentRequest{
+		Category:    args[0],
+		Path:        args[1],
+		Private:     o.private,
+		Trackers:    o.trackers,
+		WebSeeds:    o.webseeds,
+		Comment:     o.comment,
+		PieceLength: o.piece,
+	})
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printJson(rc)
+	}
+	fmt.Printf("%s: %s, %d pieces of %s, %s\n", rc.Name, humanSize(rc.Size), rc.Pieces, humanSize(rc.PieceLength), rc.InfoHash)
+	fmt.Println(rc.TorrentFile)
+	fmt.Println(rc.Magnet)
+	return nil
+}
+
+func cmdImport(c *client.Client, o *cliOptions, args []string) error {
+	if err := needArgs(args, 2, "client and dir"); err != nil {
+		return err
+	}
+	rc, err := c.Import(client.ImportRequest{Client: args[0], Dir: args[1], Category: o.category, Paused: o.paused, DryRun: o.dryRun})
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printJson(rc)
+	}
+	rows := make([][]string, 0)
+	for _, i := range rc.Items {
+		data := i.DataPath
+		switch {
+		case data == "":
+			data = "-"
+		case i.Status == "added":
+			data += fmt.Sprintf(" (%d%%)", i.Completed)
+		}
+		status := i.Status
+		if i.Error != "" {
+			status += ": " + i.Error
+		}
+		rows = append(rows, []string{i.Name, i.Category, data, status})
+	}
+	printTable([]string{"NAME", "CATEGORY", "DATA", "STATUS"}, rows)
+	fmt.Printf("%d added, %d skipped, %d failed\n", rc.Added, rc.Skipped, rc.Failed)
+	return nil
+}
+
+func cmdPlayUrl(c *client.Client, o *cliOptions, args []string) error {
+	if err := needArgs(args, 1, "torrent"); err != nil {
+		return err
+	}
+	t, err := c.Get(args[0])
+	if err != nil {
+		return err
+	}
+	if len(t.Files) == 0 {
+		return fmt.Errorf("%s has no files", t.Name)
+	}
+	file := ""
+	if len(args) > 1 {
+		if i, err := strconv.Atoi(args[1]); err == nil {
+			if i < 0 || i >= len(t.Files) {
+				return fmt.Errorf("%s has %d files", t.Name, len(t.Files))
+			}
+			file = t.Files[i].Name
+		} else {
+			file = args[1]
+		}
+	} else {
+		largest := t.Files[0]
+		for _, f := range t.Files {
+			if f.Size > largest.Size {
+				largest = f
+			}
+		}
+		file = largest.Name
+	}
+	u := c.PlayUrl(tagString(t.Tags, "infohash"), file)
+	if o.json {
+		return printJson(map[string]string{"Url": u, "File": file})
+	}
+	fmt.Println(u)
+	return nil
+}
+
+func cmdLogs(c *client.Client, o *cliOptions, args []string) error {
+	return c.Logs(o.lines, o.follow, func(line string) {
+		fmt.Println(line)
+	})
+}
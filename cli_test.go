@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"ttv/client"
+)
+
+var testTorrents = []client.TorrentInfo{
+	{Name: "Show S01", Size: 3 << 30, Completion: 40, DownloadRate: 2 << 20, Seeders: 5, Leechers: 2,
+		Tags: map[string]interface{}{"category": "tv", "infohash": "0123456789abcdef0123456789abcdef01234567"},
+		Files: []client.TorrentFileInfo{
+			{Name: "Show S01/e01.mkv", Size: 1 << 30, Priority: "high", Ready: true},
+			{Name: "Show S01/e02.mkv", Size: 2 << 30, Priority: "normal"},
+		}},
+	{Name: "a movie", Size: 700 << 20, Completion: 100, Completed: true,
+		Tags: map[string]interface{}{"category": "movies", "infohash": "fedcba9876543210fedcba9876543210fedcba98"}},
+}
+
+// testEndpoint is fake server answering list and get of testTorrents
+func testEndpoint(t *testing.T) string {
+	mux := http.NewServeMux()
+	mux.HandleFunc(client.API_PREFIX+"/torrents", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testTorrents)
+	})
+	mux.HandleFunc(client.API_PREFIX+"/torrents/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, client.API_PREFIX+"/torrents/")
+		for _, tr := range testTorrents {
+			if tr.Name == id {
+				json.NewEncoder(w).Encode(tr)
+				return
+			}
+		}
+		http.Error(w, "no torrent "+id, http.StatusNotFound)
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// runCli runs command against endpoint, returns its exit code and stdout
+func runCli(t *testing.T, endpoint string, args ...string) (int, string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- string(data)
+	}()
+	rc := runCommand(args[0], append([]string{"--endpoint", endpoint, "--token", "secret"}, args[1:]...))
+	os.Stdout = stdout
+	w.Close()
+	return rc, <-out
+}
+
+func TestCliList(t *testing.T) {
+	endpoint := testEndpoint(t)
+	rc, out := runCli(t, endpoint, "ls")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if rc != 0 || len(lines) != 3 {
+		t.Fatalf("ls: rc %d, output:\n%s", rc, out)
+	}
+	for i, want := range [][]string{
+		{"NAME", "CATEGORY", "DONE", "SIZE", "RATE", "PEERS", "STATE", "HASH"},
+		{"a", "movie", "movies", "100%", "700.0", "MiB", "0/0", "seeding", "fedcba98"},
+		{"Show", "S01", "tv", "40%", "3.0", "GiB", "2.0", "MiB/s", "5/2", "downloading", "01234567"},
+	} {
+		if got := strings.Fields(lines[i]); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("line %d: got %q, want %q", i, got, want)
+		}
+	}
+
+	rc, out = runCli(t, endpoint, "ls", "--filter", "seeding", "--json")
+	var list []client.TorrentInfo
+	if err := json.Unmarshal([]byte(out), &list); rc != 0 || err != nil {
+		t.Fatalf("ls --json: rc %d, %v, output:\n%s", rc, err, out)
+	}
+	if len(list) != 1 || list[0].Name != "a movie" || list[0].Size != 700<<20 {
+		t.Errorf("ls --json filtered: %+v", list)
+	}
+
+	if rc, _ := runCli(t, endpoint, "ls", "--token", "wrong"); rc != 1 {
+		t.Errorf("ls with wrong token: rc %d", rc)
+	}
+}
+
+func TestCliInfo(t *testing.T) {
+	endpoint := testEndpoint(t)
+	rc, out := runCli(t, endpoint, "info", "Show S01")
+	if rc != 0 {
+		t.Fatalf("info: rc %d, output:\n%s", rc, out)
+	}
+	// columns are aligned by the longest key, compare lines with single spaces
+	lines := map[string]bool{}
+	for _, l := range strings.Split(out, "\n") {
+		lines[strings.Join(strings.Fields(l), " ")] = true
+	}
+	for _, want := range []string{
+		"name: Show S01",
+		"infohash: 0123456789abcdef0123456789abcdef01234567",
+		"state: downloading",
+		"peers: 5 seeders, 2 leechers",
+		"category tv",
+		"# FILE SIZE PRIORITY READY",
+		"0 Show S01/e01.mkv 1.0 GiB high yes",
+		"1 Show S01/e02.mkv 2.0 GiB normal",
+	} {
+		if !lines[want] {
+			t.Errorf("info has no %q, output:\n%s", want, out)
+		}
+	}
+
+	rc, out = runCli(t, endpoint, "info", "--json", "a movie")
+	var info client.TorrentInfo
+	if err := json.Unmarshal([]byte(out), &info); rc != 0 || err != nil {
+		t.Fatalf("info --json: rc %d, %v, output:\n%s", rc, err, out)
+	}
+	if info.Name != "a movie" || !info.Completed || info.Tags["category"] != "movies" {
+		t.Errorf("info --json: %+v", info)
+	}
+
+	if rc, _ := runCli(t, endpoint, "info", "missing"); rc != 1 {
+		t.Errorf("info of missing torrent: rc %d", rc)
+	}
+}
@@ -0,0 +1,531 @@
+// Package client talks to ttv over its HTTP API
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const API_PREFIX = "/api/v2"
+
+type Client struct {
+	Endpoint string
+	// Token is api token from server's auth config, empty if server has no auth
+	Token string
+	Http  *http.Client
+}
+
+// ApiError is returned for any non 2xx answer from server
+type ApiError struct {
+	Status  int
+	Message string
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Status, e.Message)
+}
+
+func New(endpoint string) *Client {
+	return &Client{
+		Endpoint: strings.TrimRight(endpoint, "/"),
+		Http:     &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+func (c *Client) url(p string, q url.Values) string {
+	u := c.Endpoint + p
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
+
+func (c *Client) newRequest(method string, p string, q url.Values, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.url(p, q), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+// apiError takes message from json error answer, plain text answers are taken as is
+func apiError(status int, data []byte) error {
+	e := Error{}
+	if json.Unmarshal(data, &e) != nil || e.Error == "" {
+		e.Error = strings.TrimSpace(string(data))
+	}
+	return &ApiError{Status: status, Message: e.Error}
+}
+
+// do sends request and decodes json answer to out, out may be nil
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.Http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return apiError(resp.StatusCode, data)
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *Client) get(p string, q url.Values, out interface{}) error {
+	req, err := c.newRequest("GET", p, q, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, out)
+}
+
+func (c *Client) send(method string, p string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := c.newRequest(method, p, nil, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.do(req, out)
+}
+
+func torrentPath(id string) string {
+	return API_PREFIX + "/torrents/" + url.PathEscape(id)
+}
+
+// List returns all torrents, category may be empty
+func (c *Client) List(category string) (rc []TorrentInfo, err error) {
+	q := url.Values{}
+	if category != "" {
+		q.Set("category", category)
+	}
+	err = c.get(API_PREFIX+"/torrents", q, &rc)
+	return
+}
+
+// Get finds torrent by name or infohash
+func (c *Client) Get(id string) (rc TorrentInfo, err error) {
+	err = c.get(torrentPath(id), nil, &rc)
+	return
+}
+
+// Status is the same as Get, but goes through the route Kodi add-on uses
+func (c *Client) Status(name string) (rc TorrentInfo, err error) {
+	err = c.get("/torrentStatus/"+url.PathEscape(name), nil, &rc)
+	return
+}
+
+// Add adds torrent from magnet or url, magnets are resolved by server in background
+func (c *Client) Add(req AddTorrentRequest) (rc AddTorrentResponse, err error) {
+	err = c.send("POST", API_PREFIX+"/torrents", req, &rc)
+	return
+}
+
+func (c *Client) AddMagnet(category string, magnet string) (AddTorrentResponse, error) {
+	return c.Add(AddTorrentRequest{Category: category, Magnet: magnet})
+}
+
+func (c *Client) AddUrl(category string, link string) (AddTorrentResponse, error) {
+	return c.Add(AddTorrentRequest{Category: category, Url: link})
+}
+
+// AddData uploads .torrent content, req.Magnet and req.Url are ignored
+func (c *Client) AddData(req AddTorrentRequest, filename string, data []byte) (rc AddTorrentResponse, err error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("torrent", filename)
+	if err != nil {
+		return
+	}
+	if _, err = fw.Write(data); err != nil {
+		return
+	}
+	fields := map[string]string{"name": req.Name, "category": req.Category, "datapath": req.DataPath}
+	if req.Paused {
+		fields["paused"] = "yes"
+	}
+	for k, v := range fields {
+		if v != "" {
+			_ = mw.WriteField(k, v)
+		}
+	}
+	for k, v := range req.Tags {
+		_ = mw.WriteField("tag", k+"="+v)
+	}
+	if err = mw.Close(); err != nil {
+		return
+	}
+	hreq, err := c.newRequest("POST", API_PREFIX+"/torrents", nil, &body)
+	if err != nil {
+		return
+	}
+	hreq.Header.Set("Content-Type", mw.FormDataContentType())
+	err = c.do(hreq, &rc)
+	return
+}
+
+func (c *Client) AddFile(req AddTorrentRequest, pathname string) (AddTorrentResponse, error) {
+	data, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return AddTorrentResponse{}, err
+	}
+	return c.AddData(req, filepath.Base(pathname), data)
+}
+
+func (c *Client) Pause(id string) (rc TorrentInfo, err error) {
+	err = c.send("POST", torrentPath(id)+"/pause", nil, &rc)
+	return
+}
+
+func (c *Client) Resume(id string) (rc TorrentInfo, err error) {
+	err = c.send("POST", torrentPath(id)+"/resume", nil, &rc)
+	return
+}
+
+// Remove drops torrent, returns false when server postponed removal (in play or seeding)
+func (c *Client) Remove(id string, withData bool, force bool) (done bool, err error) {
+	q := url.Values{}
+	if withData {
+		q.Set("data", "yes")
+	}
+	if force {
+		q.Set("force", "yes")
+	}
+	req, err := c.newRequest("DELETE", torrentPath(id), q, nil)
+	if err != nil {
+		return
+	}
+	rc := StatusResponse{}
+	if err = c.do(req, &rc); err != nil {
+		return
+	}
+	return rc.Status != "pending", nil
+}
+
+func (c *Client) Files(id string) (rc []TorrentFileInfo, err error) {
+	err = c.get(torrentPath(id)+"/files", nil, &rc)
+	return
+}
+
+func (c *Client) Tags(id string) (rc map[string]interface{}, err error) {
+	err = c.get(torrentPath(id)+"/tags", nil, &rc)
+	return
+}
+
+// Tag sets tags on torrent, returns all tags after update
+func (c *Client) Tag(id string, tags map[string]string) (rc map[string]interface{}, err error) {
+	err = c.send("PATCH", torrentPath(id)+"/tags", tags, &rc)
+	return
+}
+
+func (c *Client) Untag(id string, key string) error {
+	return c.send("DELETE", torrentPath(id)+"/tags/"+url.PathEscape(key), nil, nil)
+}
+
+func (c *Client) Trackers(id string) (rc []TrackerInfo, err error) {
+	err = c.get(torrentPath(id)+"/trackers", nil, &rc)
+	return
+}
+
+func (c *Client) Categories() (rc []CategoryInfo, err error) {
+	err = c.get(API_PREFIX+"/categories", nil, &rc)
+	return
+}
+
+// playPath builds /play like path, server unescapes file once more, so slashes in it survive routing
+func playPath(route string, name string, file string) string {
+	return route + "/" + url.PathEscape(name) + "/" + url.PathEscape(url.QueryEscape(file))
+}
+
+// PlayPrepare asks server to fetch start and end of file before playing it
+func (c *Client) PlayPrepare(name string, file string) error {
+	return c.send("GET", playPath("/playPrepare", name, file), nil, nil)
+}
+
+func preparePath(id string, index int) string {
+	return torrentPath(id) + "/files/" + strconv.Itoa(index) + "/prepare"
+}
+
+// Prepare starts fetching file for play, with wait it returns when that is done and cancels
+// the job if it's closed before
+func (c *Client) Prepare(id string, index int, wait bool) (rc PrepareInfo, err error) {
+	q := url.Values{}
+	if wait {
+		q.Set("wait", "yes")
+	}
+	req, err := c.newRequest("POST", preparePath(id, index), q, nil)
+	if err != nil {
+		return
+	}
+	err = c.do(req, &rc)
+	return
+}
+
+// SetFilePriority sets skip, normal or high, empty priority makes category rules decide again
+func (c *Client) SetFilePriority(id string, index int, priority string) (rc TorrentFileInfo, err error) {
+	req, err := c.newRequest("PUT", torrentPath(id)+"/files/"+strconv.Itoa(index)+"/priority", url.Values{"priority": {priority}}, nil)
+	if err != nil {
+		return
+	}
+	err = c.do(req, &rc)
+	return
+}
+
+// CategoryRules is priority -> file globs, category * is for all categories
+func (c *Client) CategoryRules(category string) (rc map[string][]string, err error) {
+	err = c.get(API_PREFIX+"/categories/"+url.PathEscape(category)+"/rules", nil, &rc)
+	return
+}
+
+func (c *Client) SetCategoryRules(category string, rules map[string][]string) (rc map[string][]string, err error) {
+	err = c.send("PUT", API_PREFIX+"/categories/"+url.PathEscape(category)+"/rules", rules, &rc)
+	return
+}
+
+// History is play sessions newest first, torrent may be empty for all of them
+func (c *Client) History(torrent string, limit int) (rc []PlaySession, err error) {
+	q := url.Values{}
+	if torrent != "" {
+		q.Set("torrent", torrent)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	err = c.get(API_PREFIX+"/history", q, &rc)
+	return
+}
+
+// ContinueWatching is unfinished files and next episodes, one per torrent
+func (c *Client) ContinueWatching(limit int) (rc []WatchState, err error) {
+	q := url.Values{}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	err = c.get(API_PREFIX+"/continue", q, &rc)
+	return
+}
+
+// Arbiter is how download bandwidth is shared while something plays
+func (c *Client) Arbiter() (rc ArbiterInfo, err error) {
+	err = c.get(API_PREFIX+"/arbiter", nil, &rc)
+	return
+}
+
+// Pieces is piece map of file with buffers of its readers, offset >= 0 asks how much is there from it
+func (c *Client) Pieces(id string, index int, offset int64) (rc FilePieces, err error) {
+	q := url.Values{}
+	if offset >= 0 {
+		q.Set("offset", strconv.FormatInt(offset, 10))
+	}
+	err = c.get(torrentPath(id)+"/files/"+strconv.Itoa(index)+"/pieces", q, &rc)
+	return
+}
+
+// CreateTorrent builds torrent of data in downloads of category, server seeds it once it picks .torrent up
+func (c *Client) CreateTorrent(req CreateTorrentRequest) (rc CreateTorrentResponse, err error) {
+	err = c.send("POST", API_PREFIX+"/torrents/create", req, &rc)
+	return
+}
+
+// Import takes as long as hash check of data found, DryRun answers right away
+func (c *Client) Import(req ImportRequest) (rc ImportResponse, err error) {
+	err = c.send("POST", API_PREFIX+"/import", req, &rc)
+	return
+}
+
+func watchPath(id string, index int) string {
+	return torrentPath(id) + "/files/" + strconv.Itoa(index) + "/watch"
+}
+
+func (c *Client) WatchState(id string, index int) (rc WatchState, err error) {
+	err = c.get(watchPath(id, index), nil, &rc)
+	return
+}
+
+// SetWatched marks file watched or not, position stays as it was
+func (c *Client) SetWatched(id string, index int, watched bool) (rc WatchState, err error) {
+	v := "no"
+	if watched {
+		v = "yes"
+	}
+	req, err := c.newRequest("PUT", watchPath(id, index), url.Values{"watched": {v}}, nil)
+	if err != nil {
+		return
+	}
+	err = c.do(req, &rc)
+	return
+}
+
+// SetResume sets resume position in seconds of playback
+func (c *Client) SetResume(id string, index int, seconds float64) (rc WatchState, err error) {
+	req, err := c.newRequest("PUT", watchPath(id, index), url.Values{"seconds": {strconv.FormatFloat(seconds, 'f', -1, 64)}}, nil)
+	if err != nil {
+		return
+	}
+	err = c.do(req, &rc)
+	return
+}
+
+func (c *Client) PrepareStatus(id string, index int) (rc PrepareInfo, err error) {
+	err = c.get(preparePath(id, index), nil, &rc)
+	return
+}
+
+func (c *Client) CancelPrepare(id string, index int) error {
+	return c.send("DELETE", preparePath(id, index), nil, nil)
+}
+
+// PlayUrl is the streaming url for players, token goes to query as players can't send headers
+func (c *Client) PlayUrl(name string, file string) string {
+	q := url.Values{}
+	if c.Token != "" {
+		q.Set("token", c.Token)
+	}
+	return c.url(playPath("/play", name, file), q)
+}
+
+// PlaylistUrl is m3u8 of torrent's media files, token goes to query of it only, server signs play
+// urls in it when auth is on
+func (c *Client) PlaylistUrl(name string) string {
+	q := url.Values{}
+	if c.Token != "" {
+		q.Set("token", c.Token)
+	}
+	return c.url("/playlist/"+url.PathEscape(name)+".m3u8", q)
+}
+
+func (c *Client) Subtitles(id string, index int) (rc []SubtitleInfo, err error) {
+	err = c.get(torrentPath(id)+"/files/"+strconv.Itoa(index)+"/subtitles", nil, &rc)
+	return
+}
+
+// SubtitleUrl is url of subtitle file converted to UTF-8, to WebVTT too if vtt is set
+func (c *Client) SubtitleUrl(name string, index int, vtt bool) string {
+	q := url.Values{}
+	if c.Token != "" {
+		q.Set("token", c.Token)
+	}
+	p := "/subtitles/" + url.PathEscape(name) + "/" + strconv.Itoa(index)
+	if vtt {
+		p += ".vtt"
+	}
+	return c.url(p, q)
+}
+
+func (c *Client) Tokens() (rc []AuthToken, err error) {
+	err = c.get(API_PREFIX+"/tokens", nil, &rc)
+	return
+}
+
+// CreateToken returns new token with its secret, server never shows it again
+func (c *Client) CreateToken(name string, scope string) (rc AuthToken, err error) {
+	req, err := c.newRequest("POST", API_PREFIX+"/tokens", url.Values{"name": {name}, "scope": {scope}}, nil)
+	if err != nil {
+		return
+	}
+	err = c.do(req, &rc)
+	return
+}
+
+func (c *Client) RevokeToken(name string) error {
+	return c.send("DELETE", API_PREFIX+"/tokens/"+url.PathEscape(name), nil, nil)
+}
+
+// Shares lists share links, Url of each is what is given out
+func (c *Client) Shares() (rc []ShareLinkResponse, err error) {
+	err = c.get(API_PREFIX+"/shares", nil, &rc)
+	return
+}
+
+// CreateShare makes signed link to file of torrent for those without token
+func (c *Client) CreateShare(sr ShareRequest) (rc ShareLinkResponse, err error) {
+	q := url.Values{"torrent": {sr.Torrent}, "file": {sr.File}}
+	if sr.Ttl > 0 {
+		q.Set("ttl", sr.Ttl.String())
+	}
+	if sr.Rate > 0 {
+		q.Set("rate", strconv.Itoa(sr.Rate))
+	}
+	if sr.Streams > 0 {
+		q.Set("streams", strconv.Itoa(sr.Streams))
+	}
+	if sr.Comment != "" {
+		q.Set("comment", sr.Comment)
+	}
+	req, err := c.newRequest("POST", API_PREFIX+"/shares", q, nil)
+	if err != nil {
+		return
+	}
+	err = c.do(req, &rc)
+	return
+}
+
+// RevokeShare drops link, its running streams stop
+func (c *Client) RevokeShare(id string) error {
+	return c.send("DELETE", API_PREFIX+"/shares/"+url.PathEscape(id), nil, nil)
+}
+
+// OpenApi returns server's api description
+func (c *Client) OpenApi() (rc map[string]interface{}, err error) {
+	err = c.get("/api/openapi.json", nil, &rc)
+	return
+}
+
+// Logs calls fn for last lines of server log, with follow it waits for new lines till error
+func (c *Client) Logs(lines int, follow bool, fn func(line string)) error {
+	q := url.Values{"lines": {fmt.Sprint(lines)}}
+	if follow {
+		q.Set("follow", "yes")
+	}
+	req, err := c.newRequest("GET", API_PREFIX+"/logs", q, nil)
+	if err != nil {
+		return err
+	}
+	// following never ends, client timeout would cut it
+	hc := *c.Http
+	hc.Timeout = 0
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return apiError(resp.StatusCode, data)
+	}
+	scan := bufio.NewScanner(resp.Body)
+	scan.Buffer(make([]byte, 64<<10), 1<<20)
+	for scan.Scan() {
+		fn(scan.Text())
+	}
+	return scan.Err()
+}
@@ -0,0 +1,320 @@
+package client
+
+import "time"
+
+type TorrentFileInfo struct {
+	Name      string         `json:"Name"`
+	Size      int64          `json:"Size"`
+	Ready     bool           `json:"Ready"`
+	BytesWant int            `json:"BytesWant"`
+	BytesHave int            `json:"BytesHave"`
+	Priority  string         `json:"Priority"`
+	Subtitles []SubtitleInfo `json:"Subtitles,omitempty"`
+	Prepare   *PrepareInfo   `json:"Prepare,omitempty"`
+	Watch     *WatchState    `json:"Watch,omitempty"`
+	// Play is /play url of file, signed when auth is on. it's set in files list
+	Play string `json:"Play,omitempty"`
+}
+
+// PrepareInfo is progress of fetching what player needs before play. State is running, done,
+// failed or canceled, Eta is seconds, -1 if unknown
+type PrepareInfo struct {
+	State     string `json:"State"`
+	BytesWant int64  `json:"BytesWant"`
+	BytesHave int64  `json:"BytesHave"`
+	Rate      int64  `json:"Rate"`
+	Eta       int64  `json:"Eta"`
+	Error     string `json:"Error,omitempty"`
+}
+
+// PlaySession is one stream of a file. Offset is where the stream was when it ended or is now,
+// MaxOffset is the furthest byte it played on to from StartOffset
+type PlaySession struct {
+	Id          int       `json:"Id"`
+	InfoHash    string    `json:"InfoHash"`
+	Torrent     string    `json:"Torrent"`
+	File        string    `json:"File"`
+	Index       int       `json:"Index"`
+	Client      string    `json:"Client"`
+	UserAgent   string    `json:"UserAgent"`
+	User        string    `json:"User,omitempty"`
+	Share       string    `json:"Share,omitempty"`
+	Started     time.Time `json:"Started"`
+	Duration    float64   `json:"Duration"`
+	Active      bool      `json:"Active"`
+	BytesServed int64     `json:"BytesServed"`
+	StartOffset int64     `json:"StartOffset"`
+	Offset      int64     `json:"Offset"`
+	MaxOffset   int64     `json:"MaxOffset"`
+}
+
+// WatchState is what is remembered about a file from its streams. Position is byte offset to resume
+// from, PositionSeconds is estimated from bitrate and is 0 when it's unknown. Progress is percent of file
+// reached
+type WatchState struct {
+	InfoHash        string    `json:"InfoHash"`
+	Torrent         string    `json:"Torrent"`
+	File            string    `json:"File"`
+	Index           int       `json:"Index"`
+	Size            int64     `json:"Size"`
+	Position        int64     `json:"Position"`
+	PositionSeconds float64   `json:"PositionSeconds"`
+	MaxOffset       int64     `json:"MaxOffset"`
+	Progress        int       `json:"Progress"`
+	Watched         bool      `json:"Watched"`
+	Plays           int       `json:"Plays"`
+	LastPlayed      time.Time `json:"LastPlayed"`
+}
+
+// ArbiterInfo is how download bandwidth is shared while something plays. Rates are bytes/sec,
+// Held are torrents paused for playback, Running are ones let back to download, they share
+// BackgroundLimit, Throttled are ones over their share waiting for the next tick
+type ArbiterInfo struct {
+	Active          bool              `json:"Active"`
+	Since           time.Time         `json:"Since"`
+	RequiredRate    int64             `json:"RequiredRate"`
+	StreamRate      int64             `json:"StreamRate"`
+	BackgroundRate  int64             `json:"BackgroundRate"`
+	BackgroundLimit int64             `json:"BackgroundLimit"`
+	Streams         []ArbiterStream   `json:"Streams"`
+	Held            []string          `json:"Held"`
+	Running         []string          `json:"Running"`
+	Throttled       []string          `json:"Throttled"`
+	Decisions       []ArbiterDecision `json:"Decisions"`
+}
+
+// ArbiterStream is a playing file, Buffered is how much after playback position is downloaded
+type ArbiterStream struct {
+	Session  int    `json:"Session"`
+	Torrent  string `json:"Torrent"`
+	File     string `json:"File"`
+	Bitrate  int64  `json:"Bitrate"`
+	Required int64  `json:"Required"`
+	Buffered int64  `json:"Buffered"`
+	Healthy  bool   `json:"Healthy"`
+}
+
+// ArbiterDecision is hold, admit or restore of a torrent
+type ArbiterDecision struct {
+	Time    time.Time `json:"Time"`
+	Torrent string    `json:"Torrent"`
+	Action  string    `json:"Action"`
+	Reason  string    `json:"Reason"`
+}
+
+// FilePieces is download state of file's pieces, piece numbers are counted from FirstPiece, the
+// torrent's piece file starts in. Runs cover all of them in order
+type FilePieces struct {
+	Name        string       `json:"Name"`
+	Size        int64        `json:"Size"`
+	PieceLength int64        `json:"PieceLength"`
+	FirstPiece  int          `json:"FirstPiece"`
+	Pieces      int          `json:"Pieces"`
+	Complete    int          `json:"Complete"`
+	Runs        []PieceRun   `json:"Runs"`
+	Requested   []PieceRange `json:"Requested"`
+	Readers     []BufferInfo `json:"Readers"`
+	Seek        *BufferInfo  `json:"Seek,omitempty"`
+}
+
+// PieceRun is Count pieces in a row with the same State: complete, partial, checking or missing
+type PieceRun struct {
+	Count int    `json:"Count"`
+	State string `json:"State"`
+}
+
+// PieceRange is missing pieces in a row asked for with the same Priority: normal, high, readahead,
+// next or now
+type PieceRange struct {
+	First    int    `json:"First"`
+	Count    int    `json:"Count"`
+	Priority string `json:"Priority"`
+}
+
+// BufferInfo is what is downloaded in a row from Offset, seconds are 0 if bitrate isn't known
+type BufferInfo struct {
+	Session         int     `json:"Session,omitempty"`
+	Client          string  `json:"Client,omitempty"`
+	Offset          int64   `json:"Offset"`
+	Buffered        int64   `json:"Buffered"`
+	BufferedSeconds float64 `json:"BufferedSeconds"`
+}
+
+// SubtitleInfo is a subtitle file paired with video, Index is file index in torrent
+type SubtitleInfo struct {
+	Index    int    `json:"Index"`
+	Name     string `json:"Name"`
+	Language string `json:"Language,omitempty"`
+	Format   string `json:"Format"`
+	Forced   bool   `json:"Forced,omitempty"`
+}
+
+type TorrentInfo struct {
+	Name            string                 `json:"Name"`
+	Size            int64                  `json:"Size"`
+	FilesCount      int                    `json:"FilesCount"`
+	Files           []TorrentFileInfo      `json:"Files"`
+	Seeders         int                    `json:"Seeders"`
+	Leechers        int                    `json:"Leechers"`
+	Completed       bool                   `json:"Completed"`
+	Completion      int                    `json:"Completion"`
+	BytesDownloaded int64                  `json:"BytesDownloaded"`
+	BytesUploaded   int64                  `json:"BytesUploaded"`
+	Paused          bool                   `json:"Paused"`
+	OpenPlays       int                    `json:"OpenPlays"`
+	Tags            map[string]interface{} `json:"Tags"`
+	DownloadRate    int                    `json:"DownloadRate"`
+}
+
+type CategoryInfo struct {
+	Name     string `json:"Name"`
+	Path     string `json:"Path"`
+	Download string `json:"Download"`
+	Ready    bool   `json:"Ready"`
+	Torrents int    `json:"Torrents"`
+}
+
+type TrackerInfo struct {
+	Tier int    `json:"Tier"`
+	Url  string `json:"Url"`
+}
+
+// AddTorrentRequest with DataPath adopts data which is already there: DataPath is the dir torrent's
+// data is in, save path of other clients. it is hash checked and stays where it is
+type AddTorrentRequest struct {
+	Name     string            `json:"Name"`
+	Category string            `json:"Category"`
+	Magnet   string            `json:"Magnet"`
+	Url      string            `json:"Url"`
+	Paused   bool              `json:"Paused"`
+	Tags     map[string]string `json:"Tags"`
+	DataPath string            `json:"DataPath,omitempty"`
+}
+
+type AddTorrentResponse struct {
+	Status   string       `json:"Status"`
+	InfoHash string       `json:"InfoHash"`
+	Name     string       `json:"Name,omitempty"`
+	Torrent  *TorrentInfo `json:"Torrent,omitempty"`
+}
+
+// ShareLink is a signed link to one file for those without token. Rate is bytes/sec, Rate and
+// MaxStreams 0 are no limit. it's kept in shares file too
+type ShareLink struct {
+	Id         string    `yaml:"id" json:"Id"`
+	InfoHash   string    `yaml:"infohash" json:"InfoHash"`
+	Torrent    string    `yaml:"torrent" json:"Torrent"`
+	File       string    `yaml:"file" json:"File"`
+	Expires    time.Time `yaml:"expires" json:"Expires"`
+	Rate       int       `yaml:"rate" json:"Rate"`
+	MaxStreams int       `yaml:"max_streams" json:"MaxStreams"`
+	Created    time.Time `yaml:"created" json:"Created"`
+	CreatedBy  string    `yaml:"created_by" json:"CreatedBy"`
+	Comment    string    `yaml:"comment" json:"Comment"`
+	//
+	Uses          int       `yaml:"uses" json:"Uses"`
+	BytesServed   int64     `yaml:"bytes_served" json:"BytesServed"`
+	LastUsed      time.Time `yaml:"last_used" json:"LastUsed"`
+	LastClient    string    `yaml:"last_client" json:"LastClient"`
+	ActiveStreams int       `yaml:"-" json:"ActiveStreams"`
+}
+
+// ShareLinkResponse is link with Url to give out
+type ShareLinkResponse struct {
+	Url  string    `json:"Url"`
+	Link ShareLink `json:"Link"`
+}
+
+// ShareRequest is file of torrent to share, File is its name or index. Ttl 0 is server's default
+type ShareRequest struct {
+	Torrent string
+	File    string
+	Ttl     time.Duration
+	Rate    int
+	Streams int
+	Comment string
+}
+
+// CreateTorrentRequest builds torrent of Path, a file or directory inside downloads of Category.
+// PieceLength 0 picks one from size
+type CreateTorrentRequest struct {
+	Category    string   `json:"Category"`
+	Path        string   `json:"Path"`
+	Private     bool     `json:"Private"`
+	Trackers    []string `json:"Trackers"`
+	WebSeeds    []string `json:"WebSeeds"`
+	Comment     string   `json:"Comment"`
+	PieceLength int64    `json:"PieceLength"`
+}
+
+// CreateTorrentResponse tells where .torrent went, category watcher adds it from there
+type CreateTorrentResponse struct {
+	InfoHash    string `json:"InfoHash"`
+	Name        string `json:"Name"`
+	TorrentFile string `json:"TorrentFile"`
+	Size        int64  `json:"Size"`
+	PieceLength int64  `json:"PieceLength"`
+	Pieces      int    `json:"Pieces"`
+	Magnet      string `json:"Magnet"`
+}
+
+// ImportRequest imports torrents of another client from Dir: config dir of transmission (or its
+// resume dir) or BT_backup of qbittorrent. labels and categories which aren't ttv categories go to
+// tags, Category is for torrents which match none. DryRun only tells what would be done
+type ImportRequest struct {
+	Client   string `json:"Client"`
+	Dir      string `json:"Dir"`
+	Category string `json:"Category"`
+	Paused   bool   `json:"Paused"`
+	DryRun   bool   `json:"DryRun"`
+}
+
+// ImportItem is one torrent of import, DataPath is empty when its data wasn't found and it
+// downloads to category. Status is added, duplicate, failed or new for dry run
+type ImportItem struct {
+	Resume    string            `json:"Resume"`
+	Name      string            `json:"Name"`
+	InfoHash  string            `json:"InfoHash"`
+	Category  string            `json:"Category"`
+	DataPath  string            `json:"DataPath"`
+	Tags      map[string]string `json:"Tags"`
+	Status    string            `json:"Status"`
+	Error     string            `json:"Error,omitempty"`
+	Completed int               `json:"Completed"`
+}
+
+type ImportResponse struct {
+	Client  string       `json:"Client"`
+	Dir     string       `json:"Dir"`
+	DryRun  bool         `json:"DryRun"`
+	Added   int          `json:"Added"`
+	Skipped int          `json:"Skipped"`
+	Failed  int          `json:"Failed"`
+	Items   []ImportItem `json:"Items"`
+}
+
+type StatusResponse struct {
+	Status string `json:"Status"`
+}
+
+type EventType string
+
+type Event struct {
+	Id       uint64      `json:"Id"`
+	Type     EventType   `json:"Type"`
+	Time     time.Time   `json:"Time"`
+	Torrent  string      `json:"Torrent,omitempty"`
+	InfoHash string      `json:"InfoHash,omitempty"`
+	File     string      `json:"File,omitempty"`
+	Data     interface{} `json:"Data,omitempty"`
+}
+
+type Error struct {
+	Error string `json:"error"`
+}
+
+type AuthToken struct {
+	Name  string `json:"Name"`
+	Token string `json:"Token,omitempty"`
+	Scope string `json:"Scope"`
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
 )
 
 //go:generate stringer -type=LogLevel
@@ -25,6 +26,9 @@ const (
 	TRACE
 )
 
+// lines kept for Tail
+const TAIL_SIZE = 1000
+
 type Log struct {
 	logger *log.Logger
 	level LogLevel
@@ -33,6 +37,9 @@ type Log struct {
 	utctolocal bool
 	watcher *fsnotify.Watcher
 	traceStrs []string
+
+	tail []string
+	followers map[chan string]bool
 }
 
 func (l *Log) UtcToLocal(convert bool) {
@@ -145,7 +152,7 @@ func ( l *Log) Println(level LogLevel, v ...interface{}) string {
 		case string:
 			msg = fmt.Sprintf(v[0].(string), v[1:] ...)
 		default:
-			msg = fmt.Sprintln(v)
+			msg = fmt.Sprintf("%v\n", v)
 		}
 	} else {
 		return ""
@@ -174,10 +181,51 @@ func ( l *Log) Println(level LogLevel, v ...interface{}) string {
 	if do {
 		s = fmt.Sprintf("%s %5s %s", prefix, level, msg)
 		l.logger.Println(s)
+		l.keep(time.Now().Format("15:04:05") + " " + s)
 	}
 	return s
 }
 
+// keep is called under lock, slow followers lose lines
+func (l *Log) keep(line string) {
+	if len(l.tail) >= TAIL_SIZE {
+		l.tail = l.tail[1:]
+	}
+	l.tail = append(l.tail, line)
+	for c := range l.followers {
+		select {
+		case c <- line:
+		default:
+		}
+	}
+}
+
+// Tail returns last n logged lines
+func (l *Log) Tail(n int) []string {
+	l.Lock()
+	defer l.Unlock()
+	if n > len(l.tail) || n < 0 {
+		n = len(l.tail)
+	}
+	return append([]string{}, l.tail[len(l.tail)-n:]...)
+}
+
+// Follow gets every new line till stop is called
+func (l *Log) Follow() (lines <-chan string, stop func()) {
+	c := make(chan string, 256)
+	l.Lock()
+	if l.followers == nil {
+		l.followers = map[chan string]bool{}
+	}
+	l.followers[c] = true
+	l.Unlock()
+	return c, func() {
+		l.Lock()
+		delete(l.followers, c)
+		l.Unlock()
+	}
+}
+
 
 func (l *Log) Warn(v ...interface{}) string {
 	return l.Println(WARN, v ...)
@@ -11,6 +11,14 @@ var (
 )
 
 func main() {
+	// no arguments or serve runs server, anything else is a command for running server
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	serve()
+}
+
+func serve() {
 	log.InitLogger(os.Stderr)
 	log.Level(logger.DEBUG)
 
@@ -38,8 +46,15 @@ func main() {
 	//}
 	tc.Start()
 	srv := torc.NewHttpServer(tc)
-	srv.Start()
+	if err := srv.Start(); err != nil {
+		log.Error("failed to start http server: %v", err)
+		tc.Close()
+		os.Exit(1)
+	}
 	<-srv.Closed()
 
 	tc.Close()
+	if srv.Err() != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,563 @@
+package torc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"ttv/client"
+)
+
+const API_PREFIX = "/api/v2"
+
+// max size of uploaded .torrent files kept in memory
+const MAX_TORRENT_UPLOAD = 8 << 20
+
+type CategoryInfo = client.CategoryInfo
+type TrackerInfo = client.TrackerInfo
+type AddTorrentRequest = client.AddTorrentRequest
+type AddTorrentResponse = client.AddTorrentResponse
+type StatusResponse = client.StatusResponse
+
+func registerApiV2(r *mux.Router) {
+	api := r.PathPrefix(API_PREFIX).Subrouter()
+	api.HandleFunc("/torrents", _apiTorrentsList).Methods("GET")
+	api.HandleFunc("/torrents", _apiTorrentsAdd).Methods("POST")
+	api.HandleFunc("/torrents/create", _apiTorrentCreate).Methods("POST")
+	api.HandleFunc("/torrents/{id}", _apiTorrentGet).Methods("GET")
+	api.HandleFunc("/torrents/{id}", _apiTorrentDelete).Methods("DELETE")
+	api.HandleFunc("/torrents/{id}/pause", _apiTorrentPause).Methods("POST")
+	api.HandleFunc("/torrents/{id}/resume", _apiTorrentResume).Methods("POST")
+	api.HandleFunc("/torrents/{id}/files", _apiFilesList).Methods("GET")
+	api.HandleFunc("/torrents/{id}/files/{index:[0-9]+}", _apiFileGet).Methods("GET")
+	api.HandleFunc("/torrents/{id}/files/{index:[0-9]+}/subtitles", _apiSubtitlesList).Methods("GET")
+	api.HandleFunc("/torrents/{id}/files/{index:[0-9]+}/priority", _apiFilePriority).Methods("PUT")
+	api.HandleFunc("/torrents/{id}/files/{index:[0-9]+}/prepare", _apiPrepareGet).Methods("GET")
+	api.HandleFunc("/torrents/{id}/files/{index:[0-9]+}/prepare", _apiPrepareStart).Methods("POST")
+	api.HandleFunc("/torrents/{id}/files/{index:[0-9]+}/prepare", _apiPrepareCancel).Methods("DELETE")
+	api.HandleFunc("/torrents/{id}/files/{index:[0-9]+}/pieces", _apiFilePieces).Methods("GET")
+	api.HandleFunc("/torrents/{id}/files/{index:[0-9]+}/watch", _apiWatchGet).Methods("GET")
+	api.HandleFunc("/torrents/{id}/files/{index:[0-9]+}/watch", _apiWatchSet).Methods("PUT")
+	api.HandleFunc("/torrents/{id}/files/{index:[0-9]+}/watch", _apiWatchDelete).Methods("DELETE")
+	api.HandleFunc("/torrents/{id}/tags", _apiTagsGet).Methods("GET")
+	api.HandleFunc("/torrents/{id}/tags", _apiTagsUpdate).Methods("PATCH", "PUT")
+	api.HandleFunc("/torrents/{id}/tags/{key}", _apiTagDelete).Methods("DELETE")
+	api.HandleFunc("/torrents/{id}/trackers", _apiTrackersList).Methods("GET")
+	api.HandleFunc("/torrents/{id}/trackers", _apiTrackersAdd).Methods("POST")
+	api.HandleFunc("/categories", _apiCategoriesList).Methods("GET")
+	api.HandleFunc("/categories", _apiCategoryCreate).Methods("POST")
+	api.HandleFunc("/categories/{name}", _apiCategoryGet).Methods("GET")
+	api.HandleFunc("/categories/{name}/rules", _apiCategoryRulesGet).Methods("GET")
+	api.HandleFunc("/categories/{name}/rules", _apiCategoryRulesSet).Methods("PUT")
+	api.HandleFunc("/history", _apiHistory).Methods("GET")
+	api.HandleFunc("/continue", _apiContinueWatching).Methods("GET")
+	api.HandleFunc("/arbiter", _apiArbiter).Methods("GET")
+	api.HandleFunc("/import", _apiImport).Methods("POST")
+	api.HandleFunc("/tokens", _apiTokensList).Methods("GET")
+	api.HandleFunc("/tokens", _apiTokenCreate).Methods("POST")
+	api.HandleFunc("/tokens/{name}", _apiTokenDelete).Methods("DELETE")
+	api.HandleFunc("/logs", _apiLogs).Methods("GET")
+	api.HandleFunc("/shares", _apiSharesList).Methods("GET")
+	api.HandleFunc("/shares", _apiShareCreate).Methods("POST")
+	api.HandleFunc("/shares/{id}", _apiShareDelete).Methods("DELETE")
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpError(w, http.StatusNotFound, "no such resource %s", r.URL.Path)
+	})
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpError(w, http.StatusMethodNotAllowed, "%s is not allowed on %s", r.Method, r.URL.Path)
+	})
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "couldn't convert to json: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// apiTorrent finds torrent from {id} path variable, writes 404 if there is no such torrent
+func apiTorrent(w http.ResponseWriter, r *http.Request) *TorrentWithUserData {
+	id, _ := url.PathUnescape(mux.Vars(r)["id"])
+	tu, _ := tc.GetTorrent(id)
+	if tu == nil || !tu.InfoReady || tu.Dead {
+		httpError(w, http.StatusNotFound, "torrent '%s' not found", id)
+		return nil
+	}
+	return tu
+}
+
+func _apiTorrentsList(w http.ResponseWriter, r *http.Request) {
+	cat := r.FormValue("category")
+	rc := make([]TorrentInfo, 0)
+	for _, tu := range tc.GetTorrents() {
+		if tu == nil || !tu.InfoReady {
+			continue
+		}
+		if cat != "" && tu.Tags.getString("category", "") != cat {
+			continue
+		}
+		rc = append(rc, tu.TorrentInfo())
+	}
+	writeJson(w, http.StatusOK, rc)
+}
+
+func _apiTorrentGet(w http.ResponseWriter, r *http.Request) {
+	if tu := apiTorrent(w, r); tu != nil {
+		writeJson(w, http.StatusOK, tu.TorrentInfo())
+	}
+}
+
+func _apiTorrentDelete(w http.ResponseWriter, r *http.Request) {
+	tu := apiTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	data := r.FormValue("data")
+	dropData := data == "yes" || data == "true" || data == "1"
+	force := r.FormValue("force")
+	if tc.DropTorrent(tu, "deleted via api", dropData, force == "yes" || force == "true" || force == "1") {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// in play or still has to seed, ProcessTags will finish it later
+	writeJson(w, http.StatusAccepted, StatusResponse{Status: "pending"})
+}
+
+func _apiTorrentPause(w http.ResponseWriter, r *http.Request) {
+	tu := apiTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	// before user_paused is saved, it would pause torrent once playback is over
+	if tu.InPlay() {
+		httpError(w, http.StatusConflict, "%s is in play, can't pause now", tu.Name)
+		return
+	}
+	tu.UserPause("paused via api")
+	tu.SaveTags()
+	writeJson(w, http.StatusOK, tu.TorrentInfo())
+}
+
+func _apiTorrentResume(w http.ResponseWriter, r *http.Request) {
+	tu := apiTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	tu.UserResume("resumed via api")
+	tu.SaveTags()
+	writeJson(w, http.StatusOK, tu.TorrentInfo())
+}
+
+func _apiTorrentsAdd(w http.ResponseWriter, r *http.Request) {
+	req := AddTorrentRequest{Tags: map[string]string{}}
+	var data []byte
+
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ct {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, http.StatusBadRequest, "failed to decode json: %v", err)
+			return
+		}
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(MAX_TORRENT_UPLOAD); err != nil {
+			httpError(w, http.StatusBadRequest, "failed to parse multipart form: %v", err)
+			return
+		}
+		if f, fh, err := r.FormFile("torrent"); err == nil {
+			data, err = ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				httpError(w, http.StatusBadRequest, "failed to read %s: %v", fh.Filename, err)
+				return
+			}
+			if req.Name == "" {
+				req.Name = strings.TrimSuffix(path.Base(fh.Filename), ".torrent")
+			}
+		}
+		fallthrough
+	default:
+		if err := r.ParseForm(); err != nil {
+			httpError(w, http.StatusBadRequest, "failed to parse form: %v", err)
+			return
+		}
+		if v := r.FormValue("name"); v != "" {
+			req.Name = v
+		}
+		req.Category = r.FormValue("category")
+		req.Magnet = r.FormValue("magnet")
+		req.Url = r.FormValue("url")
+		req.Paused = r.FormValue("paused") == "yes" || r.FormValue("paused") == "true"
+		req.DataPath = r.FormValue("datapath")
+		for _, kv := range r.Form["tag"] {
+			if kvs := strings.SplitN(kv, "=", 2); len(kvs) == 2 {
+				req.Tags[kvs[0]] = kvs[1]
+			}
+		}
+	}
+
+	rc, status, err := addTorrent(req, data, "api")
+	if err != nil {
+		httpError(w, status, "%v", err)
+		return
+	}
+	w.Header().Set("Location", API_PREFIX+"/torrents/"+rc.InfoHash)
+	writeJson(w, status, rc)
+}
+
+// addTorrent adds .torrent data, magnet or url, magnets are resolved in background.
+// status is http status for the result, source goes to tags
+func addTorrent(req AddTorrentRequest, data []byte, source string) (rc AddTorrentResponse, status int, err error) {
+	if req.Category == "" {
+		req.Category = tc.KodiCategory
+	}
+	if _, ok := GetCategory(req.Category); !ok {
+		return rc, http.StatusBadRequest, newError("unknown category '%s'", req.Category)
+	}
+	if data == nil && req.Magnet == "" && req.Url == "" {
+		return rc, http.StatusBadRequest, newError("one of torrent file, magnet or url is required")
+	}
+	if data == nil && req.Url != "" {
+		var magnet string
+		if data, magnet, err = doGet(req.Url); err != nil {
+			return rc, http.StatusBadGateway, newError("failed to load %s: %v", req.Url, err)
+		}
+		if magnet != "" {
+			req.Magnet = magnet
+		}
+	}
+
+	tags := Tags{"source": source}
+	for k, v := range req.Tags {
+		tags[k] = v
+	}
+	if req.DataPath != "" {
+		if !path.IsAbs(req.DataPath) {
+			return rc, http.StatusBadRequest, newError("data path '%s' isn't absolute", req.DataPath)
+		}
+		if st, err := os.Stat(req.DataPath); err != nil || !st.IsDir() {
+			return rc, http.StatusBadRequest, newError("data path '%s' isn't a directory", req.DataPath)
+		}
+		// customPathMaker opens storage there instead of downloads of category
+		tags["download"] = path.Clean(req.DataPath)
+	}
+	if data != nil {
+		mi, err := metainfo.Load(bytes.NewReader(data))
+		if err != nil {
+			return rc, http.StatusBadRequest, newError("not a torrent file: %v", err)
+		}
+		if req.Name == "" {
+			if info, err := mi.UnmarshalInfo(); err == nil {
+				req.Name = info.Name
+			}
+		}
+		req.Name = safeFileName(req.Name)
+		tu, err := tc.AddTorrentFromData(req.Category, req.Name, data, &tags)
+		if tu != nil && err != nil {
+			return AddTorrentResponse{Status: "duplicate", InfoHash: tu.Tags.getString("infohash", ""), Name: tu.Name}, http.StatusConflict, err
+		}
+		if err != nil {
+			return rc, http.StatusBadRequest, newError("failed to add torrent: %v", err)
+		}
+		if req.DataPath != "" {
+			adoptData(tu)
+		}
+		apiStartAdded(tu, req.Paused)
+		info := tu.TorrentInfo()
+		return AddTorrentResponse{Status: "added", InfoHash: tu.Tags.getString("infohash", ""), Name: tu.Name, Torrent: &info}, http.StatusCreated, nil
+	}
+
+	m, err := metainfo.ParseMagnetURI(req.Magnet)
+	if err != nil {
+		return rc, http.StatusBadRequest, newError("bad magnet: %v", err)
+	}
+	hash := m.InfoHash.HexString()
+	if tu, _ := tc.GetTorrent(hash); tu != nil {
+		return AddTorrentResponse{Status: "duplicate", InfoHash: hash, Name: tu.Name}, http.StatusConflict, newError("%s already added", tu.Name)
+	}
+	if req.Name == "" {
+		req.Name = m.DisplayName
+	}
+	if req.Name == "" {
+		req.Name = hash
+	}
+	req.Name = safeFileName(req.Name)
+	// resolving metadata may take minutes, added event is published when it is done
+	go func() {
+		if tu, err := tc.AddTorrentFromMagnet(req.Category, req.Name, req.Magnet, &tags); err == nil {
+			if req.DataPath != "" {
+				adoptData(tu)
+			}
+			apiStartAdded(tu, req.Paused)
+		} else {
+			log.Error("failed to add %s from magnet: %v", req.Name, err)
+		}
+	}()
+	return AddTorrentResponse{Status: "resolving", InfoHash: hash, Name: req.Name}, http.StatusAccepted, nil
+}
+
+// apiStartAdded resumes torrent added through api and saves .torrent with tags next to the others
+func apiStartAdded(tu *TorrentWithUserData, paused bool) {
+	if paused {
+		tu.UserPause("added paused via api")
+	} else {
+		tu.Resume("added via api")
+	}
+	tc.lock.Lock()
+	tu.ProcessTags()
+	tc.lock.Unlock()
+}
+
+func _apiFilesList(w http.ResponseWriter, r *http.Request) {
+	tu := apiTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	rc := make([]TorrentFileInfo, 0)
+	for _, f := range tu.Files() {
+		fi := f.Info()
+		fi.Play = playUrl(r, tu, f)
+		rc = append(rc, fi)
+	}
+	writeJson(w, http.StatusOK, rc)
+}
+
+func _apiFileGet(w http.ResponseWriter, r *http.Request) {
+	tu := apiTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	index, _ := strconv.Atoi(mux.Vars(r)["index"])
+	f := tu.GetFile(index)
+	if f == nil {
+		httpError(w, http.StatusNotFound, "file %d not found in %s", index, tu.Name)
+		return
+	}
+	writeJson(w, http.StatusOK, f.Info())
+}
+
+func _apiTagsGet(w http.ResponseWriter, r *http.Request) {
+	if tu := apiTorrent(w, r); tu != nil {
+		writeJson(w, http.StatusOK, tu.Tags)
+	}
+}
+
+func _apiTagsUpdate(w http.ResponseWriter, r *http.Request) {
+	tu := apiTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	tags := Tags{}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+			httpError(w, http.StatusBadRequest, "failed to decode json: %v", err)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			httpError(w, http.StatusBadRequest, "failed to parse form: %v", err)
+			return
+		}
+		for k, v := range r.PostForm {
+			tags[k] = v[0]
+		}
+	}
+	if len(tags) == 0 {
+		httpError(w, http.StatusBadRequest, "no tags given")
+		return
+	}
+	for k, v := range tags {
+		// yaml and ProcessTags expect plain strings
+		if _, ok := v.(string); !ok {
+			data, _ := json.Marshal(v)
+			v = string(data)
+		}
+		tu.Tags.Set(k, v)
+	}
+	Emit(EvTagsChanged, tu, "", tags)
+	tc.ProcessTags()
+	writeJson(w, http.StatusOK, tu.Tags)
+}
+
+func _apiTagDelete(w http.ResponseWriter, r *http.Request) {
+	tu := apiTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	key := mux.Vars(r)["key"]
+	if _, ok := (*tu.Tags)[key]; !ok {
+		httpError(w, http.StatusNotFound, "%s has no tag '%s'", tu.Name, key)
+		return
+	}
+	tu.Tags.Remove(key)
+	Emit(EvTagsChanged, tu, "", Tags{key: nil})
+	tu.SaveTags()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func torrentTrackers(tu *TorrentWithUserData) []TrackerInfo {
+	rc := make([]TrackerInfo, 0)
+	mi := tu.torrent.Metainfo()
+	for tier, urls := range mi.UpvertedAnnounceList() {
+		for _, u := range urls {
+			rc = append(rc, TrackerInfo{Tier: tier, Url: u})
+		}
+	}
+	return rc
+}
+
+func _apiTrackersList(w http.ResponseWriter, r *http.Request) {
+	if tu := apiTorrent(w, r); tu != nil {
+		writeJson(w, http.StatusOK, torrentTrackers(tu))
+	}
+}
+
+func _apiTrackersAdd(w http.ResponseWriter, r *http.Request) {
+	tu := apiTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	if tu.Tags.getString("private", "") == "yes" {
+		httpError(w, http.StatusForbidden, "%s is private, trackers can't be added", tu.Name)
+		return
+	}
+	urls := make([]string, 0)
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&urls); err != nil {
+			httpError(w, http.StatusBadRequest, "failed to decode json: %v", err)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			httpError(w, http.StatusBadRequest, "failed to parse form: %v", err)
+			return
+		}
+		urls = r.Form["url"]
+	}
+	for _, u := range urls {
+		if p, err := url.Parse(u); err != nil || !(p.Scheme == "http" || p.Scheme == "https" || p.Scheme == "udp") {
+			httpError(w, http.StatusBadRequest, "bad tracker url '%s'", u)
+			return
+		}
+	}
+	if len(urls) == 0 {
+		httpError(w, http.StatusBadRequest, "no tracker urls given")
+		return
+	}
+	tu.torrent.AddTrackers([][]string{urls})
+	writeJson(w, http.StatusOK, torrentTrackers(tu))
+}
+
+func categoryInfo(cat *tCategory) CategoryInfo {
+	rc := CategoryInfo{
+		Name:     cat.name,
+		Path:     cat.fullpath,
+		Download: cat.download,
+		Ready:    cat.ready,
+	}
+	for _, tu := range tc.GetTorrents() {
+		if tu != nil && tu.Tags.getString("category", "") == cat.name {
+			rc.Torrents += 1
+		}
+	}
+	return rc
+}
+
+func _apiCategoriesList(w http.ResponseWriter, r *http.Request) {
+	rc := make([]CategoryInfo, 0)
+	for _, cat := range GetCategories() {
+		rc = append(rc, categoryInfo(cat))
+	}
+	sort.Slice(rc, func(i, j int) bool { return rc[i].Name < rc[j].Name })
+	writeJson(w, http.StatusOK, rc)
+}
+
+func _apiCategoryGet(w http.ResponseWriter, r *http.Request) {
+	cat, ok := GetCategory(mux.Vars(r)["name"])
+	if !ok {
+		httpError(w, http.StatusNotFound, "category '%s' not found", mux.Vars(r)["name"])
+		return
+	}
+	writeJson(w, http.StatusOK, categoryInfo(cat))
+}
+
+func _apiCategoryCreate(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		httpError(w, http.StatusBadRequest, "bad category name '%s'", name)
+		return
+	}
+	if _, ok := GetCategory(name); ok {
+		httpError(w, http.StatusConflict, "category '%s' already exists", name)
+		return
+	}
+	// watcher does the rest, new directory triggers categories rescan
+	download := path.Join(basedir, name, "downloads")
+	if err := os.MkdirAll(download, 0775); err != nil {
+		httpError(w, http.StatusInternalServerError, "failed to create %s: %v", download, err)
+		return
+	}
+	w.Header().Set("Location", API_PREFIX+"/categories/"+name)
+	writeJson(w, http.StatusCreated, CategoryInfo{
+		Name:     name,
+		Path:     path.Join(basedir, name),
+		Download: download,
+	})
+}
+
+func followLogs(r *http.Request) bool {
+	follow := r.FormValue("follow")
+	return follow == "yes" || follow == "true" || follow == "1"
+}
+
+// _apiLogs writes last lines of server log, follow=yes keeps streaming new ones
+func _apiLogs(w http.ResponseWriter, r *http.Request) {
+	n := 100
+	if v, err := strconv.Atoi(r.FormValue("lines")); err == nil {
+		n = v
+	}
+	var lines <-chan string
+	if followLogs(r) {
+		var stop func()
+		lines, stop = log.Follow()
+		defer stop()
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, l := range log.Tail(n) {
+		fmt.Fprintln(w, l)
+	}
+	if lines == nil {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case l := <-lines:
+			if _, err := fmt.Fprintln(w, l); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package torc
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestApiPauseInPlay(t *testing.T) {
+	tu := addTestTorrent(t, "Api In Play", map[string]int{"movie.mkv": 40000})
+	tu.Resume("test")
+	f := tu.GetFile(0)
+	atomic.AddInt32(&f.ReadersOpen, 1)
+	resp, err := http.Post(testServer.URL+"/api/v2/torrents/"+tu.torrent.InfoHash().HexString()+"/pause", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("pause in play: %d, want 409", resp.StatusCode)
+	}
+	atomic.AddInt32(&f.ReadersOpen, -1)
+	if tu.Paused || tu.UserPaused() {
+		t.Errorf("failed pause left paused %v, user_paused %v", tu.Paused, tu.UserPaused())
+	}
+}
@@ -0,0 +1,366 @@
+package torc
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"ttv/client"
+)
+
+type ArbiterInfo = client.ArbiterInfo
+type ArbiterStream = client.ArbiterStream
+type ArbiterDecision = client.ArbiterDecision
+
+const (
+	ARBITER_INTERVAL = 5 * time.Second
+	// stream wants its bitrate times this
+	ARBITER_HEADROOM = 1.5
+	// bitrate of files with unknown duration, 8 Mbit/s
+	ARBITER_DEFAULT_BITRATE = 1 << 20
+	// stream is starving with less seconds buffered when torrent downloads slower than it needs
+	ARBITER_MIN_BUFFER_SECONDS = 10
+	// nobody is let back for a while after stream starved
+	ARBITER_BACKOFF = 30 * time.Second
+	// states are restored when nothing played that long, players reconnect on seek
+	ARBITER_GRACE     = 15 * time.Second
+	ARBITER_DECISIONS = 64
+	ARBITER_HOLD      = "arbiter: held for playback"
+	// default of TC_ARBITER_RATE, 8 Mbit/s
+	ARBITER_RATE = 1 << 20
+)
+
+// bandwidthArbiter holds downloads which don't play while something streams, lets them back one
+// by one while streams have enough and holds the last one let back again when a stream starves.
+// held torrents are resumed when playback is over. torrent client has no rate limit per torrent,
+// ones let back which got more than their share of ArbiterRate since last tick don't download
+// until they are even
+type bandwidthArbiter struct {
+	sync.Mutex
+	info ArbiterInfo
+	// paused by arbiter, they were downloading before
+	held []*TorrentWithUserData
+	// let back to download during playback, last one first to hold again
+	running   []*TorrentWithUserData
+	throttled map[*TorrentWithUserData]time.Time
+	sampled   map[*TorrentWithUserData]int64
+	sampledAt time.Time
+	idleSince time.Time
+	backoff   time.Time
+}
+
+var arbiter = bandwidthArbiter{sampled: map[*TorrentWithUserData]int64{}, throttled: map[*TorrentWithUserData]time.Time{}}
+
+// background torrents are what PauseNotInPlay used to pause
+func background(tu *TorrentWithUserData) bool {
+	return tu != nil && !tu.Dead && !(tu.InPlay() || tu.Completed() || tu.ForceDownload)
+}
+
+func (a *bandwidthArbiter) decide(tu *TorrentWithUserData, action string, reason string) {
+	log.Info("arbiter: %s %s, %s", action, tu.Name, reason)
+	a.info.Decisions = append(a.info.Decisions, ArbiterDecision{Time: time.Now(), Torrent: tu.Name, Action: action, Reason: reason})
+	if n := len(a.info.Decisions) - ARBITER_DECISIONS; n > 0 {
+		a.info.Decisions = a.info.Decisions[n:]
+	}
+}
+
+// hold pauses torrent, Pause only drops its connections so it's kept from downloading too,
+// Resume allows it again
+func (a *bandwidthArbiter) hold(tu *TorrentWithUserData, reason string) {
+	delete(a.throttled, tu)
+	tu.Pause(ARBITER_HOLD)
+	if !tu.Paused {
+		return
+	}
+	tu.torrent.DisallowDataDownload()
+	a.held = append(a.held, tu)
+	a.decide(tu, "hold", reason)
+}
+
+// Begin gives all bandwidth to streams, tick lets others back when there is some left
+func (a *bandwidthArbiter) Begin(c *TorrentClient) {
+	a.Lock()
+	defer a.Unlock()
+	if !a.info.Active {
+		a.info.Active = true
+		a.info.Since = time.Now()
+		a.sampled = map[*TorrentWithUserData]int64{}
+	}
+	a.idleSince = time.Time{}
+	a.unthrottle(time.Now(), true)
+	for _, tu := range a.running {
+		if background(tu) && !tu.Paused {
+			a.hold(tu, "new stream started")
+		}
+	}
+	a.running = nil
+	for _, tu := range c.torrents {
+		if background(tu) && !tu.Paused {
+			a.hold(tu, "playback started")
+		}
+	}
+}
+
+// throttle keeps torrent let back from downloading until it's even with its share, up to a tick
+func (a *bandwidthArbiter) throttle(tu *TorrentWithUserData, rate int64, share int64, now time.Time) {
+	if _, ok := a.throttled[tu]; ok || share <= 0 || rate <= share {
+		return
+	}
+	wait := time.Duration(float64(ARBITER_INTERVAL) * float64(rate-share) / float64(share))
+	if wait > ARBITER_INTERVAL {
+		wait = ARBITER_INTERVAL
+	}
+	tu.torrent.DisallowDataDownload()
+	a.throttled[tu] = now.Add(wait)
+	log.Debug("arbiter: throttle %s for %s, %d B/s of %d B/s", tu.Name, wait, rate, share)
+}
+
+// unthrottle lets torrents download again when their time is over, all of them with force
+func (a *bandwidthArbiter) unthrottle(now time.Time, force bool) {
+	for tu, until := range a.throttled {
+		if force || !now.Before(until) || !background(tu) || tu.Paused {
+			// paused ones aren't allowed back, they are held or paused by someone else since
+			if !tu.Paused {
+				tu.torrent.AllowDataDownload()
+			}
+			delete(a.throttled, tu)
+		}
+	}
+}
+
+// ours are still paused by arbiter, user or someone else could have resumed or paused them since
+func ours(tu *TorrentWithUserData) bool {
+	return !tu.Dead && tu.Paused && !tu.UserPaused() && tu.Tags.getString("pause_reason", "") == ARBITER_HOLD
+}
+
+// restore resumes held torrents, those which were running before playback
+func (a *bandwidthArbiter) restore(reason string) {
+	a.unthrottle(time.Now(), true)
+	for _, tu := range a.held {
+		if ours(tu) {
+			tu.Resume("arbiter: " + reason)
+			a.decide(tu, "restore", reason)
+		}
+	}
+	a.held = nil
+	a.running = nil
+	a.info.Active = false
+	a.info.Streams = nil
+	a.info.RequiredRate, a.info.StreamRate, a.info.BackgroundRate, a.info.BackgroundLimit = 0, 0, 0, 0
+}
+
+// bufferedFrom is how much of file is downloaded in one run from off, up to max bytes
+func (f *TorrentFile) bufferedFrom(off int64, max int64) int64 {
+	t := f.Tud.torrent
+	pl := t.Info().PieceLength
+	end := f.file.Length()
+	if max > 0 && off+max < end {
+		end = off + max
+	}
+	pos := off
+	for pos < end {
+		i := (f.file.Offset() + pos) / pl
+		if !t.PieceState(int(i)).Complete {
+			break
+		}
+		pos = (i+1)*pl - f.file.Offset()
+	}
+	if pos > end {
+		pos = end
+	}
+	return pos - off
+}
+
+// activeStreams are running sessions of files which aren't downloaded yet
+func activeStreams(c *TorrentClient) []ArbiterStream {
+	history.Lock()
+	sessions := make([]PlaySession, 0)
+	for _, s := range history.Sessions {
+		if s.Active && s.InfoHash != "" {
+			sessions = append(sessions, *s)
+		}
+	}
+	history.Unlock()
+	rc := make([]ArbiterStream, 0)
+	for _, s := range sessions {
+		tu, _ := c.GetTorrent(s.InfoHash)
+		if tu == nil || !tu.InfoReady {
+			continue
+		}
+		f := tu.GetFile(s.Index)
+		if f == nil || f.file.BytesCompleted() >= f.file.Length() {
+			continue
+		}
+		br := f.Bitrate()
+		if br == 0 {
+			br = ARBITER_DEFAULT_BITRATE
+		}
+		want := br * prebufferSeconds()
+		if left := f.file.Length() - s.Offset; want > left {
+			want = left
+		}
+		buffered := f.bufferedFrom(s.Offset, want)
+		rc = append(rc, ArbiterStream{
+			Session:  s.Id,
+			Torrent:  tu.Name,
+			File:     s.File,
+			Bitrate:  br,
+			Required: int64(float64(br) * ARBITER_HEADROOM),
+			Buffered: buffered,
+			Healthy:  buffered >= want,
+		})
+	}
+	return rc
+}
+
+func preparing(c *TorrentClient) bool {
+	prepareLock.Lock()
+	defer prepareLock.Unlock()
+	for _, tu := range c.torrents {
+		if tu == nil {
+			continue
+		}
+		for _, f := range tu.Files() {
+			if f.job != nil && f.job.state == PREPARE_RUNNING {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *bandwidthArbiter) tick(c *TorrentClient) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	a.Lock()
+	defer a.Unlock()
+	if !a.info.Active {
+		return
+	}
+	now := time.Now()
+	// rates since previous tick
+	el := now.Sub(a.sampledAt).Seconds()
+	rates := map[*TorrentWithUserData]int64{}
+	sampled := map[*TorrentWithUserData]int64{}
+	for _, tu := range c.torrents {
+		if tu == nil || tu.torrent == nil {
+			continue
+		}
+		st := tu.torrent.Stats()
+		sampled[tu] = st.BytesReadUsefulData.Int64()
+		if prev, ok := a.sampled[tu]; ok && el > 0 {
+			rates[tu] = int64(float64(sampled[tu]-prev) / el)
+		}
+	}
+	a.sampled, a.sampledAt = sampled, now
+
+	streams := activeStreams(c)
+	prep := preparing(c)
+	if len(streams) == 0 && !prep && c.ActivePlays() == 0 {
+		if a.idleSince.IsZero() {
+			a.idleSince = now
+		}
+		if now.Sub(a.idleSince) >= ARBITER_GRACE {
+			a.restore("playback ended")
+		}
+		return
+	}
+	a.idleSince = time.Time{}
+
+	held := a.held[:0]
+	for _, tu := range a.held {
+		if ours(tu) {
+			held = append(held, tu)
+		}
+	}
+	a.held = held
+	running := a.running[:0]
+	for _, tu := range a.running {
+		if background(tu) && !tu.Paused {
+			running = append(running, tu)
+		}
+	}
+	a.running = running
+	// those left running, streaming now or completed are allowed right away
+	a.unthrottle(now, false)
+
+	required, streamRate, bgRate := int64(0), int64(0), int64(0)
+	buffered, starving := true, false
+	for _, s := range streams {
+		required += s.Required
+		if !s.Healthy {
+			buffered = false
+		}
+	}
+	for tu, r := range rates {
+		if tu.InPlay() {
+			streamRate += r
+		}
+	}
+	for _, tu := range a.running {
+		bgRate += rates[tu]
+	}
+	for _, s := range streams {
+		if s.Buffered < s.Bitrate*ARBITER_MIN_BUFFER_SECONDS && streamRate < required {
+			starving = true
+		}
+	}
+	a.info.Streams = streams
+	a.info.RequiredRate, a.info.StreamRate, a.info.BackgroundRate = required, streamRate, bgRate
+	a.info.BackgroundLimit = int64(c.ArbiterRate)
+	if len(a.running) > 0 {
+		share := a.info.BackgroundLimit / int64(len(a.running))
+		for _, tu := range a.running {
+			a.throttle(tu, rates[tu], share, now)
+		}
+	}
+
+	switch {
+	case starving && len(a.running) > 0:
+		tu := a.running[len(a.running)-1]
+		a.running = a.running[:len(a.running)-1]
+		a.hold(tu, fmt.Sprintf("streams get %d B/s of %d B/s", streamRate, required))
+		a.backoff = now.Add(ARBITER_BACKOFF)
+	case !starving && (buffered || streamRate >= required) && !prep && now.After(a.backoff) && len(a.held) > 0:
+		// the closest to completion goes first
+		sort.SliceStable(a.held, func(i, j int) bool { return a.held[i].BytesLeft() < a.held[j].BytesLeft() })
+		tu := a.held[0]
+		a.held = a.held[1:]
+		tu.Resume("arbiter: leftover bandwidth")
+		a.running = append(a.running, tu)
+		a.decide(tu, "admit", fmt.Sprintf("streams need %d B/s, get %d B/s", required, streamRate))
+	}
+}
+
+func (a *bandwidthArbiter) run(c *TorrentClient) {
+	for {
+		time.Sleep(ARBITER_INTERVAL)
+		a.tick(c)
+	}
+}
+
+func (a *bandwidthArbiter) Info() ArbiterInfo {
+	a.Lock()
+	defer a.Unlock()
+	rc := a.info
+	rc.Streams = append([]ArbiterStream{}, a.info.Streams...)
+	rc.Decisions = append([]ArbiterDecision{}, a.info.Decisions...)
+	rc.Held = make([]string, 0)
+	for _, tu := range a.held {
+		rc.Held = append(rc.Held, tu.Name)
+	}
+	rc.Running = make([]string, 0)
+	rc.Throttled = make([]string, 0)
+	for _, tu := range a.running {
+		rc.Running = append(rc.Running, tu.Name)
+		if _, ok := a.throttled[tu]; ok {
+			rc.Throttled = append(rc.Throttled, tu.Name)
+		}
+	}
+	return rc
+}
+
+func _apiArbiter(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, arbiter.Info())
+}
@@ -0,0 +1,55 @@
+package torc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArbiterHoldRestore(t *testing.T) {
+	tu := addTestTorrent(t, "Arbiter Hold", map[string]int{"movie.mkv": 40000})
+	a := bandwidthArbiter{sampled: map[*TorrentWithUserData]int64{}, throttled: map[*TorrentWithUserData]time.Time{}}
+	a.info.Active = true
+	tu.Resume("test")
+	a.hold(tu, "test")
+	if !tu.Paused || !ours(tu) || len(a.held) != 1 {
+		t.Fatalf("held: paused %v, ours %v, %d held", tu.Paused, ours(tu), len(a.held))
+	}
+	a.restore("test over")
+	if tu.Paused || len(a.held) != 0 || a.info.Active {
+		t.Errorf("restored: paused %v, %d held, active %v", tu.Paused, len(a.held), a.info.Active)
+	}
+}
+
+func TestArbiterThrottle(t *testing.T) {
+	tu := addTestTorrent(t, "Arbiter Throttle", map[string]int{"movie.mkv": 40000})
+	a := bandwidthArbiter{sampled: map[*TorrentWithUserData]int64{}, throttled: map[*TorrentWithUserData]time.Time{}}
+	a.running = []*TorrentWithUserData{tu}
+	now := time.Now()
+
+	a.throttle(tu, 1000, 1000, now)
+	if _, ok := a.throttled[tu]; ok {
+		t.Fatalf("throttled within its share")
+	}
+	a.throttle(tu, 1500, 1000, now)
+	until, ok := a.throttled[tu]
+	if !ok || until.Sub(now) != ARBITER_INTERVAL/2 {
+		t.Fatalf("1.5 of share: throttled %v for %s, want %s", ok, until.Sub(now), ARBITER_INTERVAL/2)
+	}
+	if info := a.Info(); len(info.Throttled) != 1 || info.Throttled[0] != tu.Name {
+		t.Errorf("info throttled %v", info.Throttled)
+	}
+	a.throttled[tu] = now.Add(time.Hour)
+	// completed torrent isn't background anymore, it's let go before its time
+	a.unthrottle(now, false)
+	if _, ok := a.throttled[tu]; ok {
+		t.Errorf("completed torrent is still throttled")
+	}
+	a.throttle(tu, 100000, 1000, now)
+	if until := a.throttled[tu]; until.Sub(now) != ARBITER_INTERVAL {
+		t.Errorf("throttled for %s, want at most %s", until.Sub(now), ARBITER_INTERVAL)
+	}
+	a.unthrottle(now, true)
+	if len(a.throttled) != 0 {
+		t.Errorf("%d throttled after forced unthrottle", len(a.throttled))
+	}
+}
@@ -0,0 +1,454 @@
+package torc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"ttv/client"
+)
+
+type AuthScope int
+
+const (
+	ScopeNone AuthScope = iota
+	ScopeRead
+	ScopeAdmin
+)
+
+func (s AuthScope) String() string {
+	switch s {
+	case ScopeRead:
+		return "read"
+	case ScopeAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+func ParseAuthScope(s string) AuthScope {
+	switch strings.ToLower(s) {
+	case "read", "readonly", "read-only":
+		return ScopeRead
+	case "admin":
+		return ScopeAdmin
+	}
+	return ScopeNone
+}
+
+type AuthToken = client.AuthToken
+
+// AuthUser is for browsers, password is plain text or bcrypt hash
+type AuthUser struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+	Scope    string `yaml:"scope"`
+}
+
+type AuthConfig struct {
+	Tokens []AuthToken `yaml:"tokens"`
+	Users  []AuthUser  `yaml:"users"`
+	Cors   []string    `yaml:"cors"`
+}
+
+// AuthIdentity is who made the request, kept in request context
+type AuthIdentity struct {
+	Name  string
+	Kind  string
+	Scope AuthScope
+}
+
+type authKey struct{}
+
+// cookie for clients which log in with user and password once, qBittorrent api does it
+const AUTH_COOKIE = "SID"
+const AUTH_SESSION_TTL = 7 * 24 * time.Hour
+
+type authSession struct {
+	id      *AuthIdentity
+	expires time.Time
+}
+
+type Auth struct {
+	file     string
+	cfg      AuthConfig
+	sessions map[string]*authSession
+
+	sync.Mutex
+}
+
+var (
+	auth = Auth{sessions: map[string]*authSession{}}
+	// routes which change things through GET, everything else needs admin only for non GET methods
+	authRoutes = map[string]AuthScope{
+		"/tag/{name}":           ScopeAdmin,
+		"/api/v2/tokens":        ScopeAdmin,
+		"/api/v2/tokens/{name}": ScopeAdmin,
+		"/api/v2/logs":          ScopeAdmin,
+		"/api/v2/shares":        ScopeAdmin,
+		"/api/v2/shares/{id}":   ScopeAdmin,
+		"/debug/status":         ScopeAdmin,
+		"/debug/pprof/":        ScopeAdmin,
+		"/debug/pprof/cmdline": ScopeAdmin,
+		"/debug/pprof/profile": ScopeAdmin,
+		"/debug/pprof/symbol":  ScopeAdmin,
+		"/debug/pprof/trace":   ScopeAdmin,
+		// dashboard page has no data, it asks for token itself
+		"/":                               ScopeNone,
+		"/healthz":                        ScopeNone,
+		"/readyz":                         ScopeNone,
+		"/qbittorrent/api/v2/auth/login":  ScopeNone,
+		"/qbittorrent/api/v2/auth/logout": ScopeNone,
+		// mutating rpc methods are checked by _TransmissionRpc
+		"/transmission/rpc": ScopeRead,
+		// signed links are checked by _Share
+		"/share/{id}/{exp}/{sig}/{name}": ScopeNone,
+		// renderers can't authenticate, dlna routes answer local network only
+		"/dlna/device.xml":        ScopeNone,
+		"/dlna/{service}.xml":     ScopeNone,
+		"/dlna/control/{service}": ScopeNone,
+		"/dlna/event/{service}":   ScopeNone,
+	}
+	reTokenParam = regexp.MustCompile(`(token=)[^&]+`)
+)
+
+// LoadAuth reads tokens, users and cors origins, there is no auth at all if file doesn't exist
+func LoadAuth(file string) {
+	auth.Lock()
+	defer auth.Unlock()
+	auth.file = file
+	auth.cfg = AuthConfig{}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Warn("no auth config %s (%v), api is open to everyone", file, err)
+		auth.cfg.Cors = []string{"*"}
+		return
+	}
+	if err := yaml.Unmarshal(data, &auth.cfg); err != nil {
+		panic(log.Error("failed to yaml.Unmarshal %s: %v", file, err))
+	}
+	for _, t := range auth.cfg.Tokens {
+		if ParseAuthScope(t.Scope) == ScopeNone || len(t.Token) < 16 {
+			panic(log.Error("token '%s' in %s has bad scope '%s' or too short", t.Name, file, t.Scope))
+		}
+	}
+	log.Info("auth: %d tokens, %d users, cors: %v", len(auth.cfg.Tokens), len(auth.cfg.Users), auth.cfg.Cors)
+}
+
+func (a *Auth) save() error {
+	data, err := yaml.Marshal(&a.cfg)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(a.file, data, 0600)
+}
+
+func (a *Auth) Enabled() bool {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.cfg.Tokens) > 0 || len(a.cfg.Users) > 0
+}
+
+func (a *Auth) findToken(token string) *AuthIdentity {
+	a.Lock()
+	defer a.Unlock()
+	for _, t := range a.cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return &AuthIdentity{Name: t.Name, Kind: "token", Scope: ParseAuthScope(t.Scope)}
+		}
+	}
+	return nil
+}
+
+func (a *Auth) findUser(name string, password string) *AuthIdentity {
+	a.Lock()
+	defer a.Unlock()
+	for _, u := range a.cfg.Users {
+		if u.Name != name {
+			continue
+		}
+		ok := false
+		if strings.HasPrefix(u.Password, "$2") {
+			ok = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil
+		} else {
+			ok = subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+		}
+		if ok {
+			return &AuthIdentity{Name: u.Name, Kind: "user", Scope: ParseAuthScope(u.Scope)}
+		}
+	}
+	return nil
+}
+
+func (a *Auth) hasUsers() bool {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.cfg.Users) > 0
+}
+
+// Identify checks Authorization header, X-Api-Key or token query parameter, players can't send headers
+func (a *Auth) Identify(r *http.Request) *AuthIdentity {
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		return a.findToken(strings.TrimSpace(strings.TrimPrefix(h, "Bearer ")))
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		return a.findUser(user, password)
+	}
+	if k := r.Header.Get("X-Api-Key"); k != "" {
+		return a.findToken(k)
+	}
+	if k := r.URL.Query().Get("token"); k != "" {
+		return a.findToken(k)
+	}
+	if c, err := r.Cookie(AUTH_COOKIE); err == nil {
+		return a.findSession(c.Value)
+	}
+	return nil
+}
+
+// Login checks user and password, token is accepted as password too
+func (a *Auth) Login(user string, password string) *AuthIdentity {
+	if !a.Enabled() {
+		return &AuthIdentity{Name: user, Kind: "user", Scope: ScopeAdmin}
+	}
+	if id := a.findUser(user, password); id != nil {
+		return id
+	}
+	return a.findToken(password)
+}
+
+// NewSession returns value for AUTH_COOKIE
+func (a *Auth) NewSession(id *AuthIdentity) string {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	for k, s := range a.sessions {
+		if s.expires.Before(now) {
+			delete(a.sessions, k)
+		}
+	}
+	sid := randomHex(16)
+	a.sessions[sid] = &authSession{id: id, expires: now.Add(AUTH_SESSION_TTL)}
+	return sid
+}
+
+func (a *Auth) findSession(sid string) *AuthIdentity {
+	a.Lock()
+	defer a.Unlock()
+	if s, ok := a.sessions[sid]; ok && s.expires.After(time.Now()) {
+		return s.id
+	}
+	return nil
+}
+
+func (a *Auth) EndSession(sid string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.sessions, sid)
+}
+
+func requiredScope(r *http.Request) AuthScope {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			if s, ok := authRoutes[tmpl]; ok {
+				return s
+			}
+			// play links of files list and playlists are signed
+			if tmpl == "/play/{name}/{file}" && r.URL.Query().Get("sig") != "" && validPlayLink(r) {
+				return ScopeNone
+			}
+			// kodi adds torrents through it
+			if tmpl == "/torrent_file_list" && r.URL.Query().Get("link") != "" {
+				return ScopeAdmin
+			}
+		}
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return ScopeRead
+	}
+	return ScopeAdmin
+}
+
+// RequestIdentity is nil when auth is disabled
+func RequestIdentity(r *http.Request) *AuthIdentity {
+	if v, ok := r.Context().Value(authKey{}).(*AuthIdentity); ok {
+		return v
+	}
+	return nil
+}
+
+// hasScope is for handlers which check scope per request body, not per route
+func hasScope(r *http.Request, need AuthScope) bool {
+	if !auth.Enabled() {
+		return true
+	}
+	id := RequestIdentity(r)
+	return id != nil && id.Scope >= need
+}
+
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Enabled() || requiredScope(r) == ScopeNone {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := auth.Identify(r)
+		if id == nil {
+			if auth.hasUsers() {
+				w.Header().Set("WWW-Authenticate", `Basic realm="ttv"`)
+			}
+			httpError(w, http.StatusUnauthorized, "authentication required for %s", r.URL.Path)
+			return
+		}
+		if need := requiredScope(r); id.Scope < need {
+			httpError(w, http.StatusForbidden, "%s '%s' has scope %s, %s %s needs %s", id.Kind, id.Name, id.Scope, r.Method, r.URL.Path, need)
+			return
+		}
+		log.Trace("%s '%s' (%s) -> %s %s", id.Kind, id.Name, id.Scope, r.Method, r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKey{}, id)))
+	})
+}
+
+func (a *Auth) allowedOrigin(origin string) string {
+	a.Lock()
+	defer a.Unlock()
+	for _, o := range a.cfg.Cors {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(strings.TrimRight(o, "/"), origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// corsMiddleware wraps whole router, preflight requests never match routes with methods set
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := ""
+		if origin != "" {
+			allowed = auth.allowedOrigin(origin)
+			w.Header().Add("Vary", "Origin")
+		}
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			if allowed != "*" {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Expose-Headers", "Location, Content-Length, Content-Range")
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed == "" {
+				httpError(w, http.StatusForbidden, "origin '%s' is not allowed", origin)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Api-Key, Range, Last-Event-ID")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maskToken hides token query parameter in logs
+func maskToken(s string) string {
+	return reTokenParam.ReplaceAllString(s, "${1}***")
+}
+
+func _apiTokensList(w http.ResponseWriter, r *http.Request) {
+	auth.Lock()
+	rc := make([]AuthToken, 0)
+	for _, t := range auth.cfg.Tokens {
+		rc = append(rc, AuthToken{Name: t.Name, Scope: t.Scope})
+	}
+	auth.Unlock()
+	writeJson(w, http.StatusOK, rc)
+}
+
+// proxied requests came through reverse proxy, RemoteAddr is the proxy then
+func proxied(r *http.Request) bool {
+	return r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("Forwarded") != "" || r.Header.Get("X-Real-Ip") != ""
+}
+
+// isLocalRequest is from this host, not through a proxy
+func isLocalRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback() && !proxied(r)
+}
+
+// _apiTokenCreate generates new token, it is returned only once. while there is no auth the first
+// one turns it on, only this host may do it or anyone on network could lock the owner out
+func _apiTokenCreate(w http.ResponseWriter, r *http.Request) {
+	if !auth.Enabled() && !isLocalRequest(r) {
+		httpError(w, http.StatusForbidden, "auth is off, the first token can be created from this host only, not from %s", r.RemoteAddr)
+		return
+	}
+	name := r.FormValue("name")
+	scope := ParseAuthScope(r.FormValue("scope"))
+	if name == "" || scope == ScopeNone {
+		httpError(w, http.StatusBadRequest, "name and scope (read or admin) are required")
+		return
+	}
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		httpError(w, http.StatusInternalServerError, "failed to generate token: %v", err)
+		return
+	}
+	t := AuthToken{Name: name, Token: hex.EncodeToString(buf), Scope: scope.String()}
+
+	auth.Lock()
+	defer auth.Unlock()
+	for _, v := range auth.cfg.Tokens {
+		if v.Name == name {
+			httpError(w, http.StatusConflict, "token '%s' already exists", name)
+			return
+		}
+	}
+	auth.cfg.Tokens = append(auth.cfg.Tokens, t)
+	if err := auth.save(); err != nil {
+		auth.cfg.Tokens = auth.cfg.Tokens[:len(auth.cfg.Tokens)-1]
+		httpError(w, http.StatusInternalServerError, "failed to save %s: %v", auth.file, err)
+		return
+	}
+	log.Info("token '%s' with scope %s created", name, t.Scope)
+	writeJson(w, http.StatusCreated, t)
+}
+
+func _apiTokenDelete(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	auth.Lock()
+	defer auth.Unlock()
+	for i, v := range auth.cfg.Tokens {
+		if v.Name == name {
+			auth.cfg.Tokens = append(auth.cfg.Tokens[:i], auth.cfg.Tokens[i+1:]...)
+			if err := auth.save(); err != nil {
+				httpError(w, http.StatusInternalServerError, "failed to save %s: %v", auth.file, err)
+				return
+			}
+			log.Info("token '%s' revoked", name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	httpError(w, http.StatusNotFound, "token '%s' not found", name)
+}
@@ -0,0 +1,33 @@
+package torc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// while auth is off the first token would turn it on, nobody but this host may do that
+func TestFirstTokenFromThisHostOnly(t *testing.T) {
+	for _, c := range []struct {
+		remote  string
+		forward string
+	}{
+		{"192.168.1.20:40000", ""},
+		{"[2001:db8::1]:40000", ""},
+		{"127.0.0.1:40000", "203.0.113.7"},
+	} {
+		r := httptest.NewRequest("POST", API_PREFIX+"/tokens?name=owner&scope=admin", nil)
+		r.RemoteAddr = c.remote
+		if c.forward != "" {
+			r.Header.Set("X-Forwarded-For", c.forward)
+		}
+		w := httptest.NewRecorder()
+		_apiTokenCreate(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s (forwarded for '%s'): %d, want 403", c.remote, c.forward, w.Code)
+		}
+	}
+	if auth.Enabled() {
+		t.Fatal("auth got turned on")
+	}
+}
@@ -130,6 +130,7 @@ func (c *Cache) Read(key string) ([]byte, error) {
 		if now <= ts {
 			log.Trace("key %s is good, returning from cache", key)
 			if data, err := ioutil.ReadFile(_fname); err == nil {
+				metrics.CacheHit(true)
 				return data, nil
 			}
 		} else {
@@ -138,5 +139,6 @@ func (c *Cache) Read(key string) ([]byte, error) {
 			delete(c.fmap, _skey)
 		}
 	}
+	metrics.CacheHit(false)
 	return nil, nil
 }
@@ -78,12 +78,26 @@ func GetCategoryOrDefault(name string, defvalue string) (category *tCategory) {
 		category, ok = categories[defvalue]
 		if !ok {
 			panic(log.Error("GetCategoryOrDefault: %s (or %s) doesn't exists", name, defvalue))
-			return
 		}
 	}
 	return
 }
 
+// FindCategoryByDir maps download dir used by other clients to category, dir named as category matches too
+func FindCategoryByDir(dir string) (*tCategory, bool) {
+	dir = path.Clean(dir)
+	for _, v := range categories {
+		if dir == v.download || dir == v.fullpath {
+			return v, true
+		}
+	}
+	if path.Base(dir) == "downloads" {
+		dir = path.Dir(dir)
+	}
+	v, ok := categories[path.Base(dir)]
+	return v, ok
+}
+
 func scanCategories(dir string) {
 	log.Debug("scanning categories in %s : '%s'", basedir, dir)
 	if path.IsAbs(dir) {
@@ -198,7 +212,8 @@ var (
 
 func processFswEvent(event fsnotify.Event) {
 	log.Trace("fs event %v", event)
-	if strings.HasPrefix(event.Name, ".") {
+	metrics.FswEvent(event.Op.String())
+	if strings.HasPrefix(path.Base(event.Name), ".") {
 		log.Trace("ignoring 'hidden' name: %s", event.Name)
 		return
 	}
@@ -260,14 +275,26 @@ func processFswEvent(event fsnotify.Event) {
 	}
 }
 
+// fswEvent rescans categories on watcher errors, events could be lost (queue overflow),
+// /readyz reports the error for FSW_ERROR_GRACE and a watcher which is gone for good
 func fswEvent() {
 	for {
 		select {
-		case event := <-fsw.Events:
+		case event, ok := <-fsw.Events:
+			if !ok {
+				fswSetError(newError(log.Error("baseDirWatcher is closed")), true)
+				return
+			}
 			processFswEvent(event)
 
-		case err := <-fsw.Errors:
-			panic(log.Error("baseDirWatcher error: %v", err))
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				fswSetError(newError(log.Error("baseDirWatcher is closed")), true)
+				return
+			}
+			fswSetError(newError(log.Error("baseDirWatcher error: %v, rescanning categories", err)), false)
+			metrics.FswEvent("ERROR")
+			scanCategories(basedir)
 		}
 	}
 }
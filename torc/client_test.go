@@ -0,0 +1,147 @@
+package torc
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"ttv/client"
+)
+
+func apiStatus(err error) int {
+	if e, ok := err.(*client.ApiError); ok {
+		return e.Status
+	}
+	return 0
+}
+
+func TestClientTorrentLifecycle(t *testing.T) {
+	c := client.New(testServer.URL)
+	cat, _ := GetCategory(TEST_CATEGORY)
+	data := makeTorrent(t, cat.download, "Client Show", map[string]int{"e01.mkv": 40000, "e02.mkv": 30000})
+	defer os.RemoveAll(path.Join(cat.download, "Client Show"))
+
+	added, err := c.AddData(client.AddTorrentRequest{Category: TEST_CATEGORY, Paused: true, Tags: map[string]string{"source_note": "test"}}, "Client Show.torrent", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Status != "added" || added.Name != "Client Show" || len(added.InfoHash) != 40 {
+		t.Fatalf("added %+v", added)
+	}
+	if _, err := c.AddData(client.AddTorrentRequest{Category: TEST_CATEGORY}, "again.torrent", data); apiStatus(err) != http.StatusConflict {
+		t.Errorf("second add: %v, want 409", err)
+	}
+
+	list, err := c.List(TEST_CATEGORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, ti := range list {
+		found = found || ti.Name == "Client Show"
+	}
+	if !found {
+		t.Errorf("Client Show isn't listed in %d torrents", len(list))
+	}
+
+	ti, err := c.Get(added.InfoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.Name != "Client Show" || ti.Size != 70000 || !ti.Paused {
+		t.Errorf("get by infohash: %s size %d paused %v", ti.Name, ti.Size, ti.Paused)
+	}
+	files, err := c.Files("Client Show")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("%d files, want 2", len(files))
+	}
+
+	if ti, err = c.Resume(added.InfoHash); err != nil || ti.Paused {
+		t.Errorf("resume: %v, paused %v", err, ti.Paused)
+	}
+	if ti, err = c.Pause(added.InfoHash); err != nil || !ti.Paused {
+		t.Errorf("pause: %v, paused %v", err, ti.Paused)
+	}
+
+	tags, err := c.Tag(added.InfoHash, map[string]string{"kind": "tv"})
+	if err != nil || tags["kind"] != "tv" || tags["source_note"] != "test" {
+		t.Errorf("tag: %v, tags %v", err, tags)
+	}
+	if err := c.Untag(added.InfoHash, "kind"); err != nil {
+		t.Errorf("untag: %v", err)
+	}
+	if tags, _ = c.Tags(added.InfoHash); tags["kind"] != nil {
+		t.Errorf("kind is still there: %v", tags["kind"])
+	}
+	if err := c.Untag(added.InfoHash, "kind"); apiStatus(err) != http.StatusNotFound {
+		t.Errorf("untag of missing tag: %v, want 404", err)
+	}
+
+	done, err := c.Remove(added.InfoHash, false, true)
+	if err != nil || !done {
+		t.Fatalf("remove: %v, done %v", err, done)
+	}
+	if _, err := c.Get(added.InfoHash); apiStatus(err) != http.StatusNotFound {
+		t.Errorf("get after remove: %v, want 404", err)
+	}
+	if _, err := os.Stat(path.Join(cat.download, "Client Show", "e01.mkv")); err != nil {
+		t.Errorf("data is gone without data=yes: %v", err)
+	}
+}
+
+func TestClientCategories(t *testing.T) {
+	c := client.New(testServer.URL)
+	cats, err := c.Categories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ci := range cats {
+		if ci.Name == TEST_CATEGORY {
+			if !ci.Ready || ci.Download == "" {
+				t.Errorf("category %+v", ci)
+			}
+			return
+		}
+	}
+	t.Errorf("no %s in %v", TEST_CATEGORY, cats)
+}
+
+func TestClientErrors(t *testing.T) {
+	c := client.New(testServer.URL)
+	if _, err := c.Get("no such torrent"); apiStatus(err) != http.StatusNotFound {
+		t.Errorf("get: %v, want 404", err)
+	}
+	if _, err := c.Add(client.AddTorrentRequest{Category: "no such category", Magnet: "magnet:?xt=urn:btih:0000000000000000000000000000000000000000"}); apiStatus(err) != http.StatusBadRequest {
+		t.Errorf("add to unknown category: %v, want 400", err)
+	}
+	if _, err := c.Add(client.AddTorrentRequest{Category: TEST_CATEGORY}); apiStatus(err) != http.StatusBadRequest {
+		t.Errorf("add of nothing: %v, want 400", err)
+	}
+	if _, err := c.Add(client.AddTorrentRequest{Category: TEST_CATEGORY, Magnet: "magnet:?xt=foo"}); apiStatus(err) != http.StatusBadRequest {
+		t.Errorf("bad magnet: %v, want 400", err)
+	}
+}
+
+func TestClientFilesPlayLink(t *testing.T) {
+	tu := addTestTorrent(t, "Client Play", map[string]int{"movie.mkv": 40000})
+	c := client.New(testServer.URL)
+	files, err := c.Files(tu.torrent.InfoHash().HexString())
+	if err != nil || len(files) != 1 {
+		t.Fatalf("files: %v, %d files", err, len(files))
+	}
+	if strings.Contains(files[0].Play, "token=") {
+		t.Errorf("token in play link %s", files[0].Play)
+	}
+	resp, err := http.Head(files[0].Play)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 40000 {
+		t.Errorf("HEAD %s: %d, length %d", files[0].Play, resp.StatusCode, resp.ContentLength)
+	}
+}
@@ -0,0 +1,169 @@
+package torc
+
+import (
+	"encoding/json"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"ttv/client"
+)
+
+type CreateTorrentRequest = client.CreateTorrentRequest
+type CreateTorrentResponse = client.CreateTorrentResponse
+
+const (
+	// piece length is picked for about this many pieces, within min and max
+	CREATE_TARGET_PIECES = 1500
+	CREATE_MIN_PIECE     = 256 << 10
+	CREATE_MAX_PIECE     = 16 << 20
+)
+
+// choosePieceLength is power of 2 giving close to CREATE_TARGET_PIECES pieces
+func choosePieceLength(size int64) int64 {
+	pl := int64(CREATE_MIN_PIECE)
+	for pl < CREATE_MAX_PIECE && size/pl > CREATE_TARGET_PIECES {
+		pl *= 2
+	}
+	return pl
+}
+
+func dirSize(root string) (size int64, err error) {
+	err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			size += fi.Size()
+		}
+		return err
+	})
+	return
+}
+
+// CreateTorrent hashes data of req.Path and writes .torrent to category dir. data stays where it is,
+// torrent is named by last element of Path, deeper Path gets download tag pointing to its parent
+func CreateTorrent(req CreateTorrentRequest) (rc CreateTorrentResponse, status int, err error) {
+	cat, ok := GetCategory(req.Category)
+	if !ok {
+		return rc, http.StatusBadRequest, newError("unknown category '%s'", req.Category)
+	}
+	rel := path.Clean(strings.Trim(req.Path, "/"))
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return rc, http.StatusBadRequest, newError("path '%s' has to be a file or directory inside downloads of %s", req.Path, cat.name)
+	}
+	root := path.Join(cat.download, rel)
+	if _, err := os.Stat(root); err != nil {
+		return rc, http.StatusNotFound, newError("%s not found in downloads of %s", rel, cat.name)
+	}
+	name := path.Base(rel)
+	if req.PieceLength != 0 && (req.PieceLength < 16<<10 || req.PieceLength&(req.PieceLength-1) != 0) {
+		return rc, http.StatusBadRequest, newError("piece length %d isn't a power of 2 of at least 16 KiB", req.PieceLength)
+	}
+	for _, u := range append(append([]string{}, req.Trackers...), req.WebSeeds...) {
+		if pu, err := url.Parse(u); err != nil || pu.Scheme == "" || pu.Host == "" {
+			return rc, http.StatusBadRequest, newError("bad url '%s'", u)
+		}
+	}
+	tfile := path.Join(cat.fullpath, name+".torrent")
+	if _, err := os.Stat(tfile); err == nil {
+		return rc, http.StatusConflict, newError("%s already exists", tfile)
+	}
+
+	size, err := dirSize(root)
+	if err != nil {
+		return rc, http.StatusInternalServerError, newError("failed to walk %s: %v", root, err)
+	}
+	info := metainfo.Info{PieceLength: req.PieceLength}
+	if info.PieceLength == 0 {
+		info.PieceLength = choosePieceLength(size)
+	}
+	if req.Private {
+		private := true
+		info.Private = &private
+	}
+	start := time.Now()
+	if err = info.BuildFromFilePath(root); err != nil {
+		return rc, http.StatusInternalServerError, newError("failed to hash %s: %v", root, err)
+	}
+	log.Info("%s hashed in %v, %d pieces of %d", name, time.Since(start), info.NumPieces(), info.PieceLength)
+	mi := metainfo.MetaInfo{
+		Comment:      req.Comment,
+		CreatedBy:    "ttv",
+		CreationDate: time.Now().Unix(),
+		UrlList:      req.WebSeeds,
+	}
+	if len(req.Trackers) > 0 {
+		mi.Announce = req.Trackers[0]
+		for _, t := range req.Trackers {
+			mi.AnnounceList = append(mi.AnnounceList, []string{t})
+		}
+	}
+	if mi.InfoBytes, err = bencode.Marshal(info); err != nil {
+		return rc, http.StatusInternalServerError, newError("failed to bencode info: %v", err)
+	}
+	hash := mi.HashInfoBytes()
+	if tu, _ := tc.GetTorrent(hash.HexString()); tu != nil {
+		return rc, http.StatusConflict, newError("%s is already there as %s", name, tu.Name)
+	}
+
+	// watcher reads download tag before it adds .torrent
+	tags := ""
+	if dir := path.Dir(rel); dir != "." {
+		tags = path.Join(cat.fullpath, name+".torrent.tags.yaml")
+		data, _ := yaml.Marshal(Tags{"download": path.Join(cat.download, dir)})
+		if err := ioutil.WriteFile(tags, data, 0664); err != nil {
+			return rc, http.StatusInternalServerError, newError("failed to write %s: %v", tags, err)
+		}
+	}
+	// dot file is ignored by category watcher, it sees complete .torrent after rename
+	tmp := path.Join(cat.fullpath, "."+name+".torrent")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return rc, http.StatusInternalServerError, newError("failed to create %s: %v", tmp, err)
+	}
+	err = mi.Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, tfile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		if tags != "" {
+			os.Remove(tags)
+		}
+		return rc, http.StatusInternalServerError, newError("failed to write %s: %v", tfile, err)
+	}
+	log.Info("%s created for %s in %s, infohash %s", tfile, name, cat.name, hash.HexString())
+	return CreateTorrentResponse{
+		InfoHash:    hash.HexString(),
+		Name:        name,
+		TorrentFile: tfile,
+		Size:        size,
+		PieceLength: info.PieceLength,
+		Pieces:      info.NumPieces(),
+		Magnet:      mi.Magnet(name, hash).String(),
+	}, http.StatusCreated, nil
+}
+
+// _apiTorrentCreate answers when data is hashed, that takes a while for big files
+func _apiTorrentCreate(w http.ResponseWriter, r *http.Request) {
+	req := CreateTorrentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "failed to decode json: %v", err)
+		return
+	}
+	rc, status, err := CreateTorrent(req)
+	if err != nil {
+		httpError(w, status, "%v", err)
+		return
+	}
+	w.Header().Set("Location", API_PREFIX+"/torrents/"+rc.InfoHash)
+	writeJson(w, status, rc)
+}
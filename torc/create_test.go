@@ -0,0 +1,48 @@
+package torc
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCreateTorrentOfNestedPath(t *testing.T) {
+	cat, _ := GetCategory(TEST_CATEGORY)
+	makeTorrent(t, path.Join(cat.download, "Shows"), "Nested Show", map[string]int{"e01.mkv": 30000, "e02.mkv": 20000})
+	defer os.RemoveAll(path.Join(cat.download, "Shows"))
+
+	rc, status, err := CreateTorrent(CreateTorrentRequest{Category: TEST_CATEGORY, Path: "/Shows/Nested Show/"})
+	if err != nil || status != http.StatusCreated {
+		t.Fatalf("create: %d %v", status, err)
+	}
+	defer os.Remove(rc.TorrentFile)
+	defer os.Remove(rc.TorrentFile + ".tags.yaml")
+	if rc.Name != "Nested Show" || rc.TorrentFile != path.Join(cat.fullpath, "Nested Show.torrent") || rc.Size != 50000 {
+		t.Errorf("created %+v", rc)
+	}
+	tags := ReadTagsFromFile(rc.TorrentFile + ".tags.yaml")
+	if tags == nil || tags.getString("download", "") != path.Join(cat.download, "Shows") {
+		t.Fatalf("tags %v", tags)
+	}
+	if _, err := os.Stat(path.Join(cat.fullpath, ".Nested Show.torrent")); !os.IsNotExist(err) {
+		t.Errorf("temp file is left: %v", err)
+	}
+
+	tu, err := tc.AddTorrentFromFile(cat, "Nested Show.torrent", rc.TorrentFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.RemoveTorrent(tu.Name)
+	if tu.torrent.BytesCompleted() != 50000 {
+		t.Errorf("%d bytes are complete, data isn't found in place", tu.torrent.BytesCompleted())
+	}
+}
+
+func TestCreateTorrentOutsideDownloads(t *testing.T) {
+	for _, p := range []string{"", "/", "..", "../torrents", "a/../../b"} {
+		if _, status, err := CreateTorrent(CreateTorrentRequest{Category: TEST_CATEGORY, Path: p}); status != http.StatusBadRequest {
+			t.Errorf("path '%s': %d %v, want 400", p, status, err)
+		}
+	}
+}
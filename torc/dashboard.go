@@ -0,0 +1,265 @@
+package torc
+
+import (
+	"net/http"
+)
+
+// dashboard uses public api only: /api/v2, /api/events and /play, token is kept in browser's localStorage and
+// goes into /api/events url only, play links in files list are signed by server
+const DASHBOARD_HTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ttv</title>
+<style>
+body { font: 14px sans-serif; margin: 0; background: #1b1d21; color: #d8d8d8; }
+header { display: flex; align-items: center; gap: 12px; padding: 8px 16px; background: #25282d; }
+header h1 { font-size: 18px; margin: 0 12px 0 0; }
+#live { width: 10px; height: 10px; border-radius: 5px; background: #a33; display: inline-block; }
+#live.on { background: #3a3; }
+main { padding: 8px 16px; }
+form { display: flex; flex-wrap: wrap; gap: 8px; align-items: center; margin: 8px 0 16px; }
+input, select, button { background: #2d3137; color: #d8d8d8; border: 1px solid #444; border-radius: 3px; padding: 4px 8px; }
+button { cursor: pointer; }
+button:hover { background: #3a3f46; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 6px; border-bottom: 1px solid #2e3136; vertical-align: top; }
+th { color: #999; font-weight: normal; }
+td.num { text-align: right; white-space: nowrap; }
+.name { cursor: pointer; }
+.bar { width: 120px; height: 8px; background: #333; border-radius: 4px; overflow: hidden; display: inline-block; }
+.bar div { height: 100%; background: #4a8; }
+.tag { display: inline-block; background: #333a44; border-radius: 3px; padding: 0 4px; margin: 1px; font-size: 12px; }
+.files td { background: #202327; font-size: 13px; }
+.files a { color: #7ab; }
+#error { color: #e77; }
+.paused { color: #999; }
+</style>
+</head>
+<body>
+<header>
+<h1>ttv</h1><span id="live" title="live updates"></span>
+<span id="summary"></span>
+<span style="flex: 1"></span>
+<input id="token" type="password" placeholder="api token" size="20">
+<button id="saveToken">save</button>
+</header>
+<main>
+<form id="add">
+<input type="file" name="torrent" accept=".torrent">
+<input type="text" name="magnet" placeholder="magnet or url" size="50">
+<select name="category" id="category"></select>
+<label><input type="checkbox" name="paused" value="yes"> paused</label>
+<button type="submit">add</button>
+<span id="error"></span>
+</form>
+<table>
+<thead><tr><th>name</th><th>category</th><th>progress</th><th class="num">size</th><th class="num">rate</th>
+<th class="num">peers</th><th>state</th><th>tags</th><th></th></tr></thead>
+<tbody id="torrents"></tbody>
+</table>
+</main>
+<script>
+"use strict";
+var token = localStorage.getItem("ttv_token") || "";
+var opened = {};
+var hidden = ["name", "category", "download", "fullpath", "tags_fullpath", "added", "infohash", "magnet",
+	"datapath", "torrent_saved", "tags_updated", "maxConnections", "max_rate", "max_seeders", "pause_reason",
+	"resume_reason", "paused", "user_paused", "total_time", "last_rate", "completed", "source"];
+
+function $(id) { return document.getElementById(id); }
+
+function el(tag, attrs, children) {
+	var e = document.createElement(tag);
+	for (var k in attrs || {}) {
+		if (k.substr(0, 2) == "on") e.addEventListener(k.substr(2), attrs[k]); else e.setAttribute(k, attrs[k]);
+	}
+	(children || []).forEach(function (c) {
+		e.appendChild(typeof c == "string" || typeof c == "number" ? document.createTextNode(c) : c);
+	});
+	return e;
+}
+
+function size(n) {
+	var u = ["B", "KiB", "MiB", "GiB", "TiB"], i = 0;
+	while (n >= 1024 && i < u.length - 1) { n /= 1024; i++; }
+	return (i ? n.toFixed(1) : n) + " " + u[i];
+}
+
+// EventSource can't send headers, nothing else takes token in url
+function withToken(path) {
+	return token ? path + (path.indexOf("?") < 0 ? "?" : "&") + "token=" + encodeURIComponent(token) : path;
+}
+
+function api(method, path, body) {
+	var opts = { method: method, headers: {}, credentials: "same-origin" };
+	if (token) opts.headers["Authorization"] = "Bearer " + token;
+	if (body instanceof FormData) {
+		opts.body = body;
+	} else if (body !== undefined) {
+		opts.headers["Content-Type"] = "application/json";
+		opts.body = JSON.stringify(body);
+	}
+	return fetch(path, opts).then(function (resp) {
+		if (resp.status == 204) return null;
+		return resp.json().catch(function () { return null; }).then(function (data) {
+			if (!resp.ok) throw new Error((data && data.error) || resp.status + " " + resp.statusText);
+			return data;
+		});
+	});
+}
+
+function fail(err) { $("error").textContent = err.message; }
+
+function torrentPath(t) { return "/api/v2/torrents/" + encodeURIComponent(t.Tags.infohash); }
+
+function action(t, what) {
+	var p;
+	if (what == "drop") {
+		if (!confirm("drop " + t.Name + "?")) return;
+		var data = confirm("remove downloaded data too?") ? "?data=yes" : "";
+		p = api("DELETE", torrentPath(t) + data);
+	} else if (what == "tag") {
+		var kv = prompt("tag as key=value", "");
+		if (!kv || kv.indexOf("=") < 1) return;
+		var tags = {};
+		tags[kv.substr(0, kv.indexOf("="))] = kv.substr(kv.indexOf("=") + 1);
+		p = api("PATCH", torrentPath(t) + "/tags", tags);
+	} else {
+		p = api("POST", torrentPath(t) + "/" + what);
+	}
+	p.then(load, fail);
+}
+
+function untag(t, key) {
+	api("DELETE", torrentPath(t) + "/tags/" + encodeURIComponent(key)).then(load, fail);
+}
+
+function filesRow(t) {
+	var td = el("td", { colspan: 9 }, ["loading..."]);
+	api("GET", torrentPath(t) + "/files").then(function (files) {
+		td.textContent = "";
+		var list = el("table", {}, []);
+		files.forEach(function (f) {
+			// server signs play links, token stays out of urls opened in new tabs
+			list.appendChild(el("tr", {}, [
+				el("td", {}, [el("a", { href: f.Play, target: "_blank" }, [f.Name])]),
+				el("td", { "class": "num" }, [size(f.Size)]),
+				el("td", {}, [f.Ready ? "ready" : ""])
+			]));
+		});
+		td.appendChild(list);
+	}, function (err) { td.textContent = err.message; });
+	return el("tr", { "class": "files" }, [td]);
+}
+
+function row(t) {
+	var tags = [];
+	Object.keys(t.Tags || {}).sort().forEach(function (k) {
+		if (hidden.indexOf(k) >= 0) return;
+		tags.push(el("span", { "class": "tag", title: "click to remove", onclick: function () { if (confirm("remove tag " + k + "?")) untag(t, k); } },
+			[t.Tags[k] == "yes" ? k : k + "=" + t.Tags[k]]));
+	});
+	var state = t.Paused ? "paused" : (t.Completed ? "seeding" : "downloading");
+	if (t.OpenPlays > 0) state = "playing (" + t.OpenPlays + ")";
+	var hash = t.Tags.infohash;
+	return el("tr", { "class": t.Paused ? "paused" : "" }, [
+		el("td", { "class": "name", onclick: function () { opened[hash] = !opened[hash]; load(); } }, [t.Name]),
+		el("td", {}, [t.Tags.category || ""]),
+		el("td", {}, [el("span", { "class": "bar" }, [el("div", { style: "width: " + t.Completion + "%" })]), " " + t.Completion + "%"]),
+		el("td", { "class": "num" }, [size(t.Size)]),
+		el("td", { "class": "num" }, [t.Paused ? "" : size(t.DownloadRate) + "/s"]),
+		el("td", { "class": "num" }, [t.Seeders + " / " + t.Leechers]),
+		el("td", {}, [state]),
+		el("td", {}, tags),
+		el("td", {}, [
+			el("button", { onclick: function () { action(t, t.Paused ? "resume" : "pause"); } }, [t.Paused ? "resume" : "pause"]),
+			" ", el("button", { onclick: function () { action(t, "tag"); } }, ["tag"]),
+			" ", el("button", { onclick: function () { action(t, "drop"); } }, ["drop"])
+		])
+	]);
+}
+
+function load() {
+	return api("GET", "/api/v2/torrents").then(function (list) {
+		$("error").textContent = "";
+		list.sort(function (a, b) { return a.Name.localeCompare(b.Name); });
+		var body = $("torrents"), rate = 0;
+		body.textContent = "";
+		list.forEach(function (t) {
+			rate += t.Paused ? 0 : t.DownloadRate;
+			body.appendChild(row(t));
+			if (opened[t.Tags.infohash]) body.appendChild(filesRow(t));
+		});
+		$("summary").textContent = list.length + " torrents, " + size(rate) + "/s";
+	}, fail);
+}
+
+function loadCategories() {
+	api("GET", "/api/v2/categories").then(function (list) {
+		var sel = $("category");
+		sel.textContent = "";
+		list.forEach(function (c) { sel.appendChild(el("option", { value: c.Name }, [c.Name])); });
+	}, fail);
+}
+
+var pending = null;
+function later() {
+	if (!pending) pending = setTimeout(function () { pending = null; load(); }, 700);
+}
+
+var events = null;
+function listen() {
+	if (events) events.close();
+	events = new EventSource(withToken("/api/events"));
+	events.onopen = function () { $("live").className = "on"; };
+	events.onerror = function () { $("live").className = ""; };
+	["added", "metadata_resolved", "state_changed", "piece_progress", "completed", "dropped",
+		"tags_changed", "stream_opened", "stream_closed"].forEach(function (type) {
+		events.addEventListener(type, later);
+	});
+}
+
+$("add").addEventListener("submit", function (e) {
+	e.preventDefault();
+	var f = e.target, fd = new FormData();
+	var link = f.magnet.value.trim();
+	if (f.torrent.files.length) {
+		fd.append("torrent", f.torrent.files[0]);
+	} else if (link.indexOf("magnet:") == 0) {
+		fd.append("magnet", link);
+	} else if (link) {
+		fd.append("url", link);
+	} else {
+		return fail(new Error("choose .torrent file or paste magnet"));
+	}
+	fd.append("category", f.category.value);
+	if (f.paused.checked) fd.append("paused", "yes");
+	api("POST", "/api/v2/torrents", fd).then(function () { f.reset(); load(); }, fail);
+});
+
+$("token").value = token;
+$("saveToken").addEventListener("click", function () {
+	token = $("token").value.trim();
+	localStorage.setItem("ttv_token", token);
+	loadCategories();
+	load();
+	listen();
+});
+
+loadCategories();
+load();
+listen();
+setInterval(load, 15000);
+</script>
+</body>
+</html>
+`
+
+func _Home(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(DASHBOARD_HTML))
+}
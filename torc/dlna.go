@@ -0,0 +1,571 @@
+package torc
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	UPNP_MEDIA_SERVER       = "urn:schemas-upnp-org:device:MediaServer:1"
+	UPNP_CONTENT_DIRECTORY  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	UPNP_CONNECTION_MANAGER = "urn:schemas-upnp-org:service:ConnectionManager:1"
+	// range seeks, streaming transfer mode, dlna 1.5
+	DLNA_CONTENT_FEATURES = "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+	DLNA_MAX_SOAP_BODY    = 64 << 10
+)
+
+type dlnaConfig struct {
+	Name  string
+	Uuid  string
+	Token string // players can't authenticate, play urls carry this one
+	ssdp  *Ssdp
+	// bumped on torrents added and dropped, players refresh their views on change
+	updateId uint32
+}
+
+var dlna dlnaConfig
+
+// dlnaUuid is the same for host and port between restarts, TVs remember servers by it
+func dlnaUuid(port int64) string {
+	host, _ := os.Hostname()
+	h := sha1.Sum([]byte("ttv:" + host + ":" + strconv.FormatInt(port, 10)))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+func initDlna(port int64) {
+	host, _ := os.Hostname()
+	dlna.Name = GetEnv("TC_DLNA_NAME", "ttv on "+host)
+	dlna.Uuid = dlnaUuid(port)
+	dlna.Token = GetEnv("TC_DLNA_TOKEN", "")
+	dlna.updateId = 1
+	switch {
+	case auth.Enabled() && dlna.Token == "":
+		log.Warn("dlna: auth is on and TC_DLNA_TOKEN is not set, players will get 401 on /play")
+	case !auth.Enabled() && dlna.Token != "":
+		log.Warn("dlna: auth is off, TC_DLNA_TOKEN is not used")
+		dlna.Token = ""
+	case dlna.Token != "":
+		// it goes into urls anyone on local network can get
+		if id := auth.findToken(dlna.Token); id == nil || id.Scope != ScopeRead {
+			panic(log.Error("dlna: TC_DLNA_TOKEN is not a read token of %s", auth.file))
+		}
+	}
+	rr.HandleFunc("/dlna/device.xml", dlnaLanOnly(_DlnaDevice)).Methods("GET")
+	rr.HandleFunc("/dlna/{service}.xml", dlnaLanOnly(_DlnaScpd)).Methods("GET")
+	rr.HandleFunc("/dlna/control/{service}", dlnaLanOnly(_DlnaControl)).Methods("POST")
+	rr.HandleFunc("/dlna/event/{service}", dlnaLanOnly(_DlnaEvent)).Methods("SUBSCRIBE", "UNSUBSCRIBE")
+	go func() {
+		sub := GetEventBus().Subscribe(NewEventFilter("", "added,metadata_resolved,dropped"), 0)
+		for range sub.C {
+			atomic.AddUint32(&dlna.updateId, 1)
+		}
+	}()
+}
+
+// startSsdp failure is not fatal, device can still be added by url
+func startSsdp(group string, port int64, tls bool) {
+	s, err := NewSsdp(group, dlna.Uuid, port, "/dlna/device.xml", UPNP_MEDIA_SERVER, UPNP_CONTENT_DIRECTORY, UPNP_CONNECTION_MANAGER)
+	if err == nil {
+		s.Tls = tls
+		err = s.Start()
+	}
+	if err != nil {
+		log.Warn("dlna: ssdp is off: %v", err)
+		return
+	}
+	dlna.ssdp = s
+}
+
+func stopSsdp() {
+	if dlna.ssdp != nil {
+		dlna.ssdp.Close()
+		dlna.ssdp = nil
+	}
+}
+
+var lanNets = func() (rc []*net.IPNet) {
+	for _, cidr := range []string{"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+		"::1/128", "fc00::/7", "fe80::/10"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		rc = append(rc, n)
+	}
+	return
+}()
+
+func isLanAddr(remote string) bool {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range lanNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dlnaLanOnly guards routes which have no auth, media renderers don't do any. RemoteAddr of proxied
+// request is the proxy, so these are refused
+func dlnaLanOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if proxied(r) {
+			httpError(w, http.StatusForbidden, "dlna is for local network only, not through proxy")
+			return
+		}
+		if !isLanAddr(r.RemoteAddr) {
+			httpError(w, http.StatusForbidden, "dlna is for local network only, not for %s", r.RemoteAddr)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeXml(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("Server", ssdpServer)
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(body)))
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header+body)
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func _DlnaDevice(w http.ResponseWriter, r *http.Request) {
+	service := func(t string, name string) string {
+		return "<service><serviceType>" + t + "</serviceType><serviceId>urn:upnp-org:serviceId:" + name + "</serviceId>" +
+			"<SCPDURL>/dlna/" + name + ".xml</SCPDURL><controlURL>/dlna/control/" + name + "</controlURL>" +
+			"<eventSubURL>/dlna/event/" + name + "</eventSubURL></service>"
+	}
+	writeXml(w, http.StatusOK, `<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">`+
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>`+
+		`<deviceType>`+UPNP_MEDIA_SERVER+`</deviceType>`+
+		`<friendlyName>`+xmlEscape(dlna.Name)+`</friendlyName>`+
+		`<manufacturer>ttv</manufacturer><modelName>ttv</modelName><modelNumber>`+API_VERSION+`</modelNumber>`+
+		`<dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>`+
+		`<UDN>uuid:`+dlna.Uuid+`</UDN><serviceList>`+
+		service(UPNP_CONTENT_DIRECTORY, "ContentDirectory")+
+		service(UPNP_CONNECTION_MANAGER, "ConnectionManager")+
+		`</serviceList></device></root>`)
+}
+
+// scpdActions is action name -> arguments as name:direction:state variable
+var scpdActions = map[string]map[string][]string{
+	"ContentDirectory": {
+		"Browse": {"ObjectID:in:A_ARG_TYPE_ObjectID", "BrowseFlag:in:A_ARG_TYPE_BrowseFlag", "Filter:in:A_ARG_TYPE_Filter",
+			"StartingIndex:in:A_ARG_TYPE_Index", "RequestedCount:in:A_ARG_TYPE_Count", "SortCriteria:in:A_ARG_TYPE_SortCriteria",
+			"Result:out:A_ARG_TYPE_Result", "NumberReturned:out:A_ARG_TYPE_Count", "TotalMatches:out:A_ARG_TYPE_Count",
+			"UpdateID:out:A_ARG_TYPE_UpdateID"},
+		"GetSearchCapabilities": {"SearchCaps:out:SearchCapabilities"},
+		"GetSortCapabilities":   {"SortCaps:out:SortCapabilities"},
+		"GetSystemUpdateID":     {"Id:out:SystemUpdateID"},
+	},
+	"ConnectionManager": {
+		"GetProtocolInfo":          {"Source:out:SourceProtocolInfo", "Sink:out:SinkProtocolInfo"},
+		"GetCurrentConnectionIDs":  {"ConnectionIDs:out:CurrentConnectionIDs"},
+		"GetCurrentConnectionInfo": {"ConnectionID:in:A_ARG_TYPE_ConnectionID", "RcsID:out:A_ARG_TYPE_RcsID", "AVTransportID:out:A_ARG_TYPE_AVTransportID", "ProtocolInfo:out:A_ARG_TYPE_ProtocolInfo", "PeerConnectionManager:out:A_ARG_TYPE_ConnectionManager", "PeerConnectionID:out:A_ARG_TYPE_ConnectionID", "Direction:out:A_ARG_TYPE_Direction", "Status:out:A_ARG_TYPE_ConnectionStatus"},
+	},
+}
+
+var scpdVariables = map[string][][2]string{
+	"ContentDirectory": {{"A_ARG_TYPE_ObjectID", "string"}, {"A_ARG_TYPE_BrowseFlag", "string"}, {"A_ARG_TYPE_Filter", "string"},
+		{"A_ARG_TYPE_Index", "ui4"}, {"A_ARG_TYPE_Count", "ui4"}, {"A_ARG_TYPE_SortCriteria", "string"}, {"A_ARG_TYPE_Result", "string"},
+		{"A_ARG_TYPE_UpdateID", "ui4"}, {"SearchCapabilities", "string"}, {"SortCapabilities", "string"}, {"SystemUpdateID", "ui4"}},
+	"ConnectionManager": {{"SourceProtocolInfo", "string"}, {"SinkProtocolInfo", "string"}, {"CurrentConnectionIDs", "string"},
+		{"A_ARG_TYPE_ConnectionID", "i4"}, {"A_ARG_TYPE_RcsID", "i4"}, {"A_ARG_TYPE_AVTransportID", "i4"}, {"A_ARG_TYPE_ProtocolInfo", "string"},
+		{"A_ARG_TYPE_ConnectionManager", "string"}, {"A_ARG_TYPE_Direction", "string"}, {"A_ARG_TYPE_ConnectionStatus", "string"}},
+}
+
+func _DlnaScpd(w http.ResponseWriter, r *http.Request) {
+	service := mux.Vars(r)["service"]
+	actions, ok := scpdActions[service]
+	if !ok {
+		httpError(w, http.StatusNotFound, "no dlna service %s", service)
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(`<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>0</minor></specVersion><actionList>`)
+	names := make([]string, 0)
+	for name := range actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sb.WriteString("<action><name>" + name + "</name><argumentList>")
+		for _, arg := range actions[name] {
+			a := strings.Split(arg, ":")
+			sb.WriteString("<argument><name>" + a[0] + "</name><direction>" + a[1] + "</direction><relatedStateVariable>" + a[2] + "</relatedStateVariable></argument>")
+		}
+		sb.WriteString("</argumentList></action>")
+	}
+	sb.WriteString("</actionList><serviceStateTable>")
+	for _, v := range scpdVariables[service] {
+		events := "no"
+		if v[0] == "SystemUpdateID" || v[0] == "SourceProtocolInfo" || v[0] == "SinkProtocolInfo" || v[0] == "CurrentConnectionIDs" {
+			events = "yes"
+		}
+		sb.WriteString(`<stateVariable sendEvents="` + events + `"><name>` + v[0] + "</name><dataType>" + v[1] + "</dataType></stateVariable>")
+	}
+	sb.WriteString("</serviceStateTable></scpd>")
+	writeXml(w, http.StatusOK, sb.String())
+}
+
+// _DlnaEvent accepts subscriptions so strict control points go on, nothing is ever sent
+func _DlnaEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "SUBSCRIBE" {
+		sid := r.Header.Get("SID")
+		if sid == "" {
+			sid = "uuid:" + dlnaUuid(time.Now().UnixNano())
+		}
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", "Second-1800")
+	}
+	w.Header().Set("Server", ssdpServer)
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseSoap returns action and its arguments from envelope body
+func parseSoap(data []byte) (action string, args map[string]string, err error) {
+	args = map[string]string{}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	inBody := false
+	var arg string
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		switch e := t.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case e.Name.Local == "Body":
+				inBody = true
+			case inBody && action == "":
+				action = e.Name.Local
+			case inBody:
+				arg = e.Name.Local
+			}
+		case xml.CharData:
+			if arg != "" {
+				args[arg] += string(e)
+			}
+		case xml.EndElement:
+			depth--
+			arg = ""
+		}
+	}
+	if action == "" {
+		return "", nil, newError("no action in soap body")
+	}
+	return action, args, nil
+}
+
+func soapResponse(w http.ResponseWriter, serviceType string, action string, args ...string) {
+	var sb strings.Builder
+	sb.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	sb.WriteString(`<u:` + action + `Response xmlns:u="` + serviceType + `">`)
+	for i := 0; i+1 < len(args); i += 2 {
+		sb.WriteString("<" + args[i] + ">" + xmlEscape(args[i+1]) + "</" + args[i] + ">")
+	}
+	sb.WriteString(`</u:` + action + `Response></s:Body></s:Envelope>`)
+	writeXml(w, http.StatusOK, sb.String())
+}
+
+// soapFault codes: 401 invalid action, 402 invalid args, 701 no such object
+func soapFault(w http.ResponseWriter, code int, desc string) {
+	log.Warn("dlna: soap fault %d: %s", code, desc)
+	writeXml(w, http.StatusInternalServerError, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`+
+		`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>`+strconv.Itoa(code)+`</errorCode>`+
+		`<errorDescription>`+xmlEscape(desc)+`</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+}
+
+func _DlnaControl(w http.ResponseWriter, r *http.Request) {
+	service := mux.Vars(r)["service"]
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, DLNA_MAX_SOAP_BODY))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "failed to read soap request: %v", err)
+		return
+	}
+	action, args, err := parseSoap(data)
+	if err != nil {
+		soapFault(w, 402, err.Error())
+		return
+	}
+	log.Debug("dlna: %s#%s %v from %s", service, action, args, r.RemoteAddr)
+	switch service + "#" + action {
+	case "ContentDirectory#Browse":
+		dlnaBrowse(w, r, args)
+	case "ContentDirectory#GetSearchCapabilities":
+		soapResponse(w, UPNP_CONTENT_DIRECTORY, action, "SearchCaps", "")
+	case "ContentDirectory#GetSortCapabilities":
+		soapResponse(w, UPNP_CONTENT_DIRECTORY, action, "SortCaps", "")
+	case "ContentDirectory#GetSystemUpdateID":
+		soapResponse(w, UPNP_CONTENT_DIRECTORY, action, "Id", strconv.FormatUint(uint64(atomic.LoadUint32(&dlna.updateId)), 10))
+	case "ConnectionManager#GetProtocolInfo":
+		soapResponse(w, UPNP_CONNECTION_MANAGER, action, "Source", dlnaSourceProtocols(), "Sink", "")
+	case "ConnectionManager#GetCurrentConnectionIDs":
+		soapResponse(w, UPNP_CONNECTION_MANAGER, action, "ConnectionIDs", "0")
+	case "ConnectionManager#GetCurrentConnectionInfo":
+		if args["ConnectionID"] != "0" {
+			soapFault(w, 706, "invalid connection reference")
+			return
+		}
+		soapResponse(w, UPNP_CONNECTION_MANAGER, action, "RcsID", "-1", "AVTransportID", "-1", "ProtocolInfo", "",
+			"PeerConnectionManager", "", "PeerConnectionID", "-1", "Direction", "Output", "Status", "OK")
+	default:
+		soapFault(w, 401, "invalid action "+service+"#"+action)
+	}
+}
+
+func dlnaSourceProtocols() string {
+	types := map[string]bool{}
+	for _, t := range mediaTypes {
+		if strings.HasPrefix(t, "video/") || strings.HasPrefix(t, "audio/") || strings.HasPrefix(t, "image/") {
+			types[t] = true
+		}
+	}
+	rc := make([]string, 0)
+	for t := range types {
+		rc = append(rc, "http-get:*:"+t+":*")
+	}
+	sort.Strings(rc)
+	return strings.Join(rc, ",")
+}
+
+// dlnaObject is root, category, torrent container or a file item; ids are 0, c:{category}, t:{infohash}, f:{infohash}:{index}
+type dlnaObject struct {
+	id       string
+	parent   string
+	title    string
+	children int
+	tu       *TorrentWithUserData
+	file     *TorrentFile
+}
+
+func dlnaCategoryTorrents(name string) []*TorrentWithUserData {
+	rc := make([]*TorrentWithUserData, 0)
+	for _, tu := range tc.GetTorrents() {
+		if tu != nil && !tu.Dead && tu.InfoReady && tu.Tags.getString("category", "") == name {
+			rc = append(rc, tu)
+		}
+	}
+	sort.Slice(rc, func(i, j int) bool { return naturalLess(rc[i].Name, rc[j].Name) })
+	return rc
+}
+
+func dlnaCategory(name string) dlnaObject {
+	return dlnaObject{id: "c:" + name, parent: "0", title: name, children: len(dlnaCategoryTorrents(name))}
+}
+
+func dlnaTorrent(tu *TorrentWithUserData) dlnaObject {
+	return dlnaObject{id: "t:" + tu.Tags.getString("infohash", ""), parent: "c:" + tu.Tags.getString("category", ""),
+		title: tu.Name, children: len(playlistItems(tu, false)), tu: tu}
+}
+
+func dlnaItem(tu *TorrentWithUserData, f *TorrentFile) dlnaObject {
+	return dlnaObject{id: "f:" + tu.Tags.getString("infohash", "") + ":" + strconv.Itoa(f.Index),
+		parent: "t:" + tu.Tags.getString("infohash", ""), title: fileTitle(f.file.DisplayPath()), tu: tu, file: f}
+}
+
+func dlnaTorrentById(hash string) *TorrentWithUserData {
+	tu, _ := tc.GetTorrent(hash)
+	if tu == nil || !tu.InfoReady || tu.Dead {
+		return nil
+	}
+	return tu
+}
+
+// dlnaLookup returns object itself and its children
+func dlnaLookup(id string) (obj dlnaObject, children []dlnaObject, ok bool) {
+	children = make([]dlnaObject, 0)
+	parts := strings.SplitN(id, ":", 3)
+	switch parts[0] {
+	case "0":
+		names := make([]string, 0)
+		for name := range GetCategories() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			children = append(children, dlnaCategory(name))
+		}
+		return dlnaObject{id: "0", parent: "-1", title: dlna.Name, children: len(children)}, children, true
+	case "c":
+		if len(parts) < 2 {
+			return
+		}
+		name := strings.TrimPrefix(id, "c:")
+		if _, found := GetCategory(name); !found {
+			return
+		}
+		for _, tu := range dlnaCategoryTorrents(name) {
+			children = append(children, dlnaTorrent(tu))
+		}
+		return dlnaCategory(name), children, true
+	case "t":
+		if len(parts) < 2 {
+			return
+		}
+		tu := dlnaTorrentById(parts[1])
+		if tu == nil {
+			return
+		}
+		for _, it := range playlistItems(tu, false) {
+			children = append(children, dlnaItem(tu, it.file))
+		}
+		return dlnaTorrent(tu), children, true
+	case "f":
+		if len(parts) < 3 {
+			return
+		}
+		tu := dlnaTorrentById(parts[1])
+		if tu == nil {
+			return
+		}
+		index, err := strconv.Atoi(parts[2])
+		if err != nil || tu.GetFile(index) == nil {
+			return
+		}
+		return dlnaItem(tu, tu.GetFile(index)), children, true
+	}
+	return
+}
+
+// dlnaUrl is like playUrl, but with token for players
+func dlnaUrl(r *http.Request, route string, tu *TorrentWithUserData, file string) string {
+	u := baseUrl(r) + route + "/" + url.PathEscape(tu.Tags.getString("infohash", tu.Name)) + "/" + file
+	if dlna.Token != "" {
+		u += "?token=" + url.QueryEscape(dlna.Token)
+	}
+	return u
+}
+
+func dlnaSubtitleUrl(r *http.Request, f *TorrentFile) string {
+	for _, s := range f.subtitles {
+		if subtitleFormat(s.file.DisplayPath()) == "srt" {
+			return dlnaUrl(r, "/subtitles", f.Tud, strconv.Itoa(s.Index))
+		}
+	}
+	return ""
+}
+
+func dlnaDuration(seconds float64) string {
+	s := int(seconds)
+	return fmt.Sprintf("%d:%02d:%02d.000", s/3600, s/60%60, s%60)
+}
+
+func didl(r *http.Request, objects []dlnaObject) string {
+	var sb strings.Builder
+	sb.WriteString(`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" ` +
+		`xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/" xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/" xmlns:sec="http://www.sec.co.kr/">`)
+	for _, o := range objects {
+		if o.file == nil {
+			fmt.Fprintf(&sb, `<container id="%s" parentID="%s" childCount="%d" restricted="1" searchable="0"><dc:title>%s</dc:title>`+
+				`<upnp:class>object.container.storageFolder</upnp:class></container>`, xmlEscape(o.id), xmlEscape(o.parent), o.children, xmlEscape(o.title))
+			continue
+		}
+		ct := o.file.ContentType()
+		class := "object.item"
+		switch {
+		case strings.HasPrefix(ct, "video/"):
+			class = "object.item.videoItem"
+		case strings.HasPrefix(ct, "audio/"):
+			class = "object.item.audioItem.musicTrack"
+		case strings.HasPrefix(ct, "image/"):
+			class = "object.item.imageItem.photo"
+		}
+		duration := ""
+		if d := o.file.Duration(); d > 0 {
+			duration = ` duration="` + dlnaDuration(d) + `"`
+		}
+		fmt.Fprintf(&sb, `<item id="%s" parentID="%s" restricted="1"><dc:title>%s</dc:title><upnp:class>%s</upnp:class>`,
+			xmlEscape(o.id), xmlEscape(o.parent), xmlEscape(o.title), class)
+		fmt.Fprintf(&sb, `<res size="%d"%s protocolInfo="http-get:*:%s:%s">%s</res>`, o.file.file.Length(), duration,
+			xmlEscape(ct), DLNA_CONTENT_FEATURES, xmlEscape(dlnaUrl(r, "/play", o.tu, url.PathEscape(url.QueryEscape(o.file.file.DisplayPath())))))
+		if sub := dlnaSubtitleUrl(r, o.file); sub != "" {
+			fmt.Fprintf(&sb, `<res protocolInfo="http-get:*:text/srt:*">%s</res><sec:CaptionInfoEx sec:type="srt">%s</sec:CaptionInfoEx>`, xmlEscape(sub), xmlEscape(sub))
+		}
+		sb.WriteString("</item>")
+	}
+	sb.WriteString("</DIDL-Lite>")
+	return sb.String()
+}
+
+func dlnaBrowse(w http.ResponseWriter, r *http.Request, args map[string]string) {
+	obj, children, ok := dlnaLookup(args["ObjectID"])
+	if !ok {
+		soapFault(w, 701, "no such object "+args["ObjectID"])
+		return
+	}
+	var result []dlnaObject
+	total := 1
+	switch args["BrowseFlag"] {
+	case "BrowseMetadata":
+		result = []dlnaObject{obj}
+	case "BrowseDirectChildren":
+		total = len(children)
+		start, _ := strconv.Atoi(args["StartingIndex"])
+		count, _ := strconv.Atoi(args["RequestedCount"])
+		if start < 0 || start > len(children) {
+			start = len(children)
+		}
+		end := len(children)
+		if count > 0 && start+count < end {
+			end = start + count
+		}
+		result = children[start:end]
+	default:
+		soapFault(w, 402, "bad BrowseFlag "+args["BrowseFlag"])
+		return
+	}
+	soapResponse(w, UPNP_CONTENT_DIRECTORY, "Browse", "Result", didl(r, result), "NumberReturned", strconv.Itoa(len(result)),
+		"TotalMatches", strconv.Itoa(total), "UpdateID", strconv.FormatUint(uint64(atomic.LoadUint32(&dlna.updateId)), 10))
+}
+
+// dlnaHeaders answers players which ask for dlna content features and caption url. names are set
+// as is, some TVs don't match them case-insensitively
+func dlnaHeaders(w http.ResponseWriter, r *http.Request, file *TorrentFile) {
+	h := w.Header()
+	if r.Header.Get("getcontentFeatures.dlna.org") == "1" {
+		h["contentFeatures.dlna.org"] = []string{DLNA_CONTENT_FEATURES}
+		h["transferMode.dlna.org"] = []string{"Streaming"}
+	}
+	if tm := r.Header.Get("transferMode.dlna.org"); tm != "" {
+		h["transferMode.dlna.org"] = []string{tm}
+	}
+	if r.Header.Get("getCaptionInfo.sec") == "1" {
+		if sub := dlnaSubtitleUrl(r, file); sub != "" {
+			h["CaptionInfo.sec"] = []string{sub}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package torc
+
+import (
+	"bufio"
+	"bytes"
+	"html"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSsdpSearch(t *testing.T) {
+	s, err := NewSsdp("127.0.0.1:0", "test-uuid", 3003, "/dlna/device.xml", UPNP_MEDIA_SERVER, UPNP_CONTENT_DIRECTORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Tls = true
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: " + SSDP_ADDR + "\r\nMAN: \"ssdp:discover\"\r\nMX: 0\r\nST: " + UPNP_MEDIA_SERVER + "\r\n\r\n"
+	if _, err := c.WriteToUDP([]byte(search), s.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := c.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("St") != UPNP_MEDIA_SERVER || resp.Header.Get("Usn") != "uuid:test-uuid::"+UPNP_MEDIA_SERVER {
+		t.Errorf("answer %v", resp.Header)
+	}
+	if loc := resp.Header.Get("Location"); loc != "https://127.0.0.1:3003/dlna/device.xml" {
+		t.Errorf("location %s", loc)
+	}
+}
+
+func browse(t *testing.T, id string, flag string, header http.Header) (int, string) {
+	t.Helper()
+	body := `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+		`<u:Browse xmlns:u="` + UPNP_CONTENT_DIRECTORY + `"><ObjectID>` + xmlEscape(id) + `</ObjectID><BrowseFlag>` + flag +
+		`</BrowseFlag><Filter>*</Filter><StartingIndex>0</StartingIndex><RequestedCount>0</RequestedCount><SortCriteria></SortCriteria></u:Browse></s:Body></s:Envelope>`
+	req, _ := http.NewRequest("POST", testServer.URL+"/dlna/control/ContentDirectory", strings.NewReader(body))
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+UPNP_CONTENT_DIRECTORY+`#Browse"`)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, html.UnescapeString(string(data))
+}
+
+func TestDlnaBrowse(t *testing.T) {
+	tu := addTestTorrent(t, "Dlna Show", map[string]int{"Dlna.Show.S01E01.mkv": 30000, "sample.mkv": 1000})
+	hash := tu.torrent.InfoHash().HexString()
+
+	status, body := browse(t, "0", "BrowseDirectChildren", nil)
+	if status != http.StatusOK || !strings.Contains(body, `id="c:`+TEST_CATEGORY+`"`) {
+		t.Fatalf("root: %d %s", status, body)
+	}
+	status, body = browse(t, "c:"+TEST_CATEGORY, "BrowseDirectChildren", nil)
+	if status != http.StatusOK || !strings.Contains(body, `id="t:`+hash+`"`) {
+		t.Errorf("category: %d %s", status, body)
+	}
+	status, body = browse(t, "t:"+hash, "BrowseDirectChildren", nil)
+	if status != http.StatusOK || !strings.Contains(body, "object.item.videoItem") || !strings.Contains(body, "/play/"+hash+"/") {
+		t.Errorf("torrent: %d %s", status, body)
+	}
+	if strings.Contains(body, "sample") {
+		t.Errorf("sample is listed: %s", body)
+	}
+	if status, body = browse(t, "t:nothing", "BrowseMetadata", nil); status != http.StatusInternalServerError || !strings.Contains(body, "<errorCode>701</errorCode>") {
+		t.Errorf("unknown object: %d %s", status, body)
+	}
+	if status, _ = browse(t, "0", "BrowseDirectChildren", http.Header{"X-Forwarded-For": {"203.0.113.7"}}); status != http.StatusForbidden {
+		t.Errorf("proxied: %d, want 403", status)
+	}
+}
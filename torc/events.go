@@ -0,0 +1,329 @@
+package torc
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"ttv/client"
+)
+
+type EventType = client.EventType
+
+const (
+	EvAdded            EventType = "added"
+	EvMetadataResolved EventType = "metadata_resolved"
+	EvStateChanged     EventType = "state_changed"
+	EvPieceProgress    EventType = "piece_progress"
+	EvCompleted        EventType = "completed"
+	EvDropped          EventType = "dropped"
+	EvTagsChanged      EventType = "tags_changed"
+	EvStreamOpened     EventType = "stream_opened"
+	EvStreamClosed     EventType = "stream_closed"
+)
+
+var EventTypes = []EventType{
+	EvAdded,
+	EvMetadataResolved,
+	EvStateChanged,
+	EvPieceProgress,
+	EvCompleted,
+	EvDropped,
+	EvTagsChanged,
+	EvStreamOpened,
+	EvStreamClosed,
+}
+
+// how many events are kept for clients reconnecting with Last-Event-ID
+const EVENTS_BACKLOG = 256
+
+// how many events may wait for a slow subscriber before they get dropped
+const EVENTS_QUEUE = 64
+
+type BusEvent = client.Event
+
+type EventFilter struct {
+	Torrents []string
+	Types    []EventType
+}
+
+// NewEventFilter builds filter from comma separated lists, empty list matches everything
+func NewEventFilter(torrents string, types string) (f EventFilter) {
+	for _, v := range strings.Split(torrents, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			f.Torrents = append(f.Torrents, v)
+		}
+	}
+	for _, v := range strings.Split(types, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			f.Types = append(f.Types, EventType(v))
+		}
+	}
+	return
+}
+
+func (f EventFilter) Match(ev *BusEvent) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == ev.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Torrents) > 0 {
+		for _, t := range f.Torrents {
+			if t == ev.Torrent || strings.EqualFold(t, ev.InfoHash) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+type Subscription struct {
+	C       chan BusEvent
+	filter  EventFilter
+	bus     *EventBus
+	dropped int
+}
+
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+type EventBus struct {
+	lastId  uint64
+	subs    map[*Subscription]bool
+	backlog []BusEvent
+
+	sync.Mutex
+}
+
+var bus = NewEventBus()
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs:    make(map[*Subscription]bool),
+		backlog: make([]BusEvent, 0, EVENTS_BACKLOG),
+	}
+}
+
+func GetEventBus() *EventBus {
+	return bus
+}
+
+// Subscribe registers new listener, events newer than lastId are replayed from backlog first
+func (b *EventBus) Subscribe(filter EventFilter, lastId uint64) *Subscription {
+	b.Lock()
+	defer b.Unlock()
+
+	s := &Subscription{
+		C:      make(chan BusEvent, EVENTS_QUEUE+EVENTS_BACKLOG),
+		filter: filter,
+		bus:    b,
+	}
+	if lastId > 0 {
+		for _, ev := range b.backlog {
+			if ev.Id > lastId && filter.Match(&ev) {
+				s.C <- ev
+			}
+		}
+	}
+	b.subs[s] = true
+	log.Debug("new subscriber, now: %d", len(b.subs))
+	return s
+}
+
+func (b *EventBus) unsubscribe(s *Subscription) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.C)
+		log.Debug("subscriber left, dropped events: %d, now: %d", s.dropped, len(b.subs))
+	}
+}
+
+func (b *EventBus) Publish(ev BusEvent) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.lastId += 1
+	ev.Id = b.lastId
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if len(b.backlog) >= EVENTS_BACKLOG {
+		b.backlog = append(b.backlog[:0], b.backlog[1:]...)
+	}
+	b.backlog = append(b.backlog, ev)
+
+	for s := range b.subs {
+		if !s.filter.Match(&ev) {
+			continue
+		}
+		select {
+		case s.C <- ev:
+		default:
+			// never block publisher on slow clients
+			s.dropped += 1
+		}
+	}
+}
+
+// Emit publishes event about torrent, tu may be nil for client wide events
+func Emit(t EventType, tu *TorrentWithUserData, file string, data interface{}) {
+	ev := BusEvent{
+		Type: t,
+		File: file,
+		Data: data,
+	}
+	if tu != nil {
+		ev.Torrent = tu.Name
+		ev.InfoHash = tu.Tags.getString("infohash", "")
+	}
+	log.Trace("emit %s for %s %s", t, ev.Torrent, file)
+	bus.Publish(ev)
+}
+
+func _ApiEvents(w http.ResponseWriter, r *http.Request) {
+	filter := NewEventFilter(r.FormValue("torrent"), r.FormValue("type"))
+	for _, t := range filter.Types {
+		if !isKnownEventType(t) {
+			log.Error(httpError(w, http.StatusBadRequest, "unknown event type '%s'", t))
+			return
+		}
+	}
+	lastId, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	if v := r.FormValue("last_id"); v != "" {
+		lastId, _ = strconv.ParseUint(v, 10, 64)
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		// CORS doesn't apply to upgrades, browsers send cookies and basic auth from any page
+		websocket.Server{Handshake: checkWsOrigin, Handler: func(ws *websocket.Conn) {
+			eventsWebSocket(ws, filter, lastId)
+		}}.ServeHTTP(w, r)
+		return
+	}
+	eventsSSE(w, r, filter, lastId)
+}
+
+// checkWsOrigin lets in same origin pages, origins from cors list and clients which aren't browsers
+func checkWsOrigin(cfg *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return newError("bad origin '%s'", origin)
+	}
+	if u.Host != r.Host && auth.allowedOrigin(origin) == "" {
+		return newError(log.Warn("websocket origin '%s' is not allowed", origin))
+	}
+	cfg.Origin = u
+	return nil
+}
+
+func isKnownEventType(t EventType) bool {
+	for _, v := range EventTypes {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+func eventsSSE(w http.ResponseWriter, r *http.Request, filter EventFilter, lastId uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error(httpError(w, http.StatusInternalServerError, "streaming is not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := bus.Subscribe(filter, lastId)
+	defer sub.Close()
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+
+	log.Info("SSE client %s connected, filter: %v", r.RemoteAddr, filter)
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Info("SSE client %s gone", r.RemoteAddr)
+			return
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Error("failed to json.Marshal event %d: %v", ev.Id, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Id, ev.Type, data); err != nil {
+				log.Debug("SSE write to %s failed: %v", r.RemoteAddr, err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func eventsWebSocket(ws *websocket.Conn, filter EventFilter, lastId uint64) {
+	sub := bus.Subscribe(filter, lastId)
+	defer sub.Close()
+	defer ws.Close()
+
+	// clients are not expected to talk, reading only detects disconnect
+	gone := make(chan bool)
+	go func() {
+		var msg string
+		for {
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	log.Info("WebSocket client %s connected, filter: %v", ws.Request().RemoteAddr, filter)
+	for {
+		select {
+		case <-gone:
+			log.Info("WebSocket client %s gone", ws.Request().RemoteAddr)
+			return
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := websocket.JSON.Send(ws, ev); err != nil {
+				log.Debug("WebSocket send to %s failed: %v", ws.Request().RemoteAddr, err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package torc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"regexp"
+	"runtime"
+	rpprof "runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watcher error fails readiness for a while, categories are rescanned meanwhile
+const FSW_ERROR_GRACE = time.Minute
+
+type ReadyResponse struct {
+	Ready  bool              `json:"Ready"`
+	Checks map[string]string `json:"Checks"`
+}
+
+var fswState struct {
+	err  error
+	at   time.Time
+	dead bool
+	sync.Mutex
+}
+
+func fswSetError(err error, dead bool) {
+	fswState.Lock()
+	defer fswState.Unlock()
+	fswState.err = err
+	fswState.at = time.Now()
+	fswState.dead = fswState.dead || dead
+}
+
+func fswCheck() error {
+	fswState.Lock()
+	defer fswState.Unlock()
+	if fswState.dead || (fswState.err != nil && time.Since(fswState.at) < FSW_ERROR_GRACE) {
+		return fswState.err
+	}
+	return nil
+}
+
+// dirWritable creates and removes a temporary file in dir
+func dirWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".ttv-ready-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (c *TorrentClient) Loaded() bool {
+	select {
+	case <-c.LoadDone:
+		return true
+	default:
+		return false
+	}
+}
+
+func _Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, StatusResponse{Status: "ok"})
+}
+
+// _Readyz checks initial category scan, torrent client listener, category watcher and storage
+func _Readyz(w http.ResponseWriter, r *http.Request) {
+	rc := ReadyResponse{Ready: true, Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			rc.Ready = false
+			rc.Checks[name] = err.Error()
+		} else {
+			rc.Checks[name] = "ok"
+		}
+	}
+	if tc.Loaded() {
+		check("categories", nil)
+	} else {
+		check("categories", newError("initial scan of %s is not finished", tc.TorrentsDir))
+	}
+	if len(tc.tc.ListenAddrs()) > 0 {
+		check("listening", nil)
+	} else {
+		check("listening", newError("torrent client has no listeners"))
+	}
+	check("watcher", fswCheck())
+	check("storage", dirWritable(tc.DbDir))
+	for name, cat := range GetCategories() {
+		if cat.download != "" {
+			check("storage:"+name, dirWritable(cat.download))
+		}
+	}
+	status := http.StatusOK
+	if !rc.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, status, rc)
+}
+
+var reGoroutineFunc = regexp.MustCompile(`^#\s+0x[0-9a-f]+\s+([^\s+]+)`)
+
+// goroutineCounts groups goroutines by function on top of the stack
+func goroutineCounts() map[string]int {
+	rc := map[string]int{}
+	var buf bytes.Buffer
+	if err := rpprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return rc
+	}
+	count := 0
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.Contains(line, " @ ") {
+			count, _ = strconv.Atoi(strings.Fields(line)[0])
+			continue
+		}
+		if m := reGoroutineFunc.FindStringSubmatch(line); m != nil && count > 0 {
+			rc[m[1]] += count
+			count = 0
+		}
+	}
+	return rc
+}
+
+// _DebugStatus is plain text: goroutines, then WriteStatus of torrent client and magnet loader
+func _DebugStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "goroutines: %d\n", runtime.NumGoroutine())
+	counts := goroutineCounts()
+	funcs := make([]string, 0)
+	for f := range counts {
+		funcs = append(funcs, f)
+	}
+	sort.Slice(funcs, func(i, j int) bool {
+		if counts[funcs[i]] != counts[funcs[j]] {
+			return counts[funcs[i]] > counts[funcs[j]]
+		}
+		return funcs[i] < funcs[j]
+	})
+	for _, f := range funcs {
+		fmt.Fprintf(w, "  %6d %s\n", counts[f], f)
+	}
+	fmt.Fprintf(w, "\ncategories loaded: %v, torrents: %d, active plays: %d\n", tc.Loaded(), len(tc.GetTorrents()), tc.ActivePlays())
+	if err := fswCheck(); err != nil {
+		fmt.Fprintf(w, "watcher: %v\n", err)
+	}
+	fmt.Fprintf(w, "\n== torrent client ==\n")
+	tc.tc.WriteStatus(w)
+	if tc.ml != nil {
+		fmt.Fprintf(w, "\n== magnet loader ==\n")
+		tc.ml.tc.WriteStatus(w)
+	}
+}
+
+func registerDebugRoutes() {
+	rr.HandleFunc("/healthz", _Healthz).Methods("GET", "HEAD")
+	rr.HandleFunc("/readyz", _Readyz).Methods("GET", "HEAD")
+	rr.HandleFunc("/debug/status", _DebugStatus).Methods("GET")
+	rr.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	rr.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	rr.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	rr.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// index serves named profiles too: heap, goroutine, allocs, block, mutex, threadcreate
+	rr.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+}
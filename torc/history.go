@@ -0,0 +1,388 @@
+package torc
+
+import (
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"ttv/client"
+)
+
+type PlaySession = client.PlaySession
+type WatchState = client.WatchState
+
+const (
+	// how many closed sessions are remembered
+	HISTORY_SESSIONS = 500
+	// shorter streams are players probing the file, they don't move resume position
+	PLAY_MIN_SECONDS = 10
+	// file is watched when playback got this far
+	WATCHED_PERCENT = 90
+)
+
+// historyFile is what is kept on disk, files are keyed by infohash and file path
+type historyFile struct {
+	NextId   int                    `yaml:"next_id"`
+	Sessions []*PlaySession         `yaml:"sessions"`
+	Files    map[string]*WatchState `yaml:"files"`
+}
+
+type historyStore struct {
+	historyFile
+	file string
+
+	sync.Mutex
+}
+
+var history = historyStore{historyFile: historyFile{Files: map[string]*WatchState{}}}
+
+// LoadHistory reads sessions and watch states, sessions which were running on exit are closed
+func LoadHistory(file string) {
+	history.Lock()
+	defer history.Unlock()
+	history.file = file
+	if data, err := ioutil.ReadFile(file); err == nil {
+		if err := yaml.Unmarshal(data, &history.historyFile); err != nil {
+			log.Error("failed to yaml.Unmarshal %s: %v, starting without watch history", file, err)
+		}
+	}
+	if history.Files == nil {
+		history.Files = map[string]*WatchState{}
+	}
+	for _, s := range history.Sessions {
+		s.Active = false
+	}
+	log.Info("%d sessions and %d watched files loaded from %s", len(history.Sessions), len(history.Files), file)
+}
+
+func (h *historyStore) save() {
+	data, err := yaml.Marshal(&h.historyFile)
+	if err != nil {
+		log.Error("failed to yaml.Marshal history: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(h.file, data, 0664); err != nil {
+		log.Error("failed to WriteFile %s: %v", h.file, err)
+	}
+}
+
+func watchKey(f *TorrentFile) string {
+	return f.Tud.Tags.getString("infohash", f.Tud.Name) + "/" + f.file.DisplayPath()
+}
+
+// watchState of file, new one is added when create is set
+func (h *historyStore) watchState(f *TorrentFile, create bool) *WatchState {
+	ws, ok := h.Files[watchKey(f)]
+	if !ok && create {
+		ws = &WatchState{InfoHash: f.Tud.Tags.getString("infohash", ""), File: f.file.DisplayPath()}
+		h.Files[watchKey(f)] = ws
+	}
+	if ws != nil {
+		ws.Torrent = f.Tud.Name
+		ws.Index = f.Index
+		ws.Size = f.file.Length()
+	}
+	return ws
+}
+
+// reached moves furthest offset of file, watched ones start from the beginning next time
+func reached(ws *WatchState, position int64, max int64) {
+	ws.Position = position
+	if max > ws.MaxOffset {
+		ws.MaxOffset = max
+	}
+	if ws.Size > 0 {
+		ws.Progress = int(ws.MaxOffset * 100 / ws.Size)
+	}
+	if ws.Progress >= WATCHED_PERCENT || position >= ws.Size {
+		ws.Watched = true
+		ws.Position = 0
+	}
+}
+
+// tailProbe is stream of index at the end of file (moov, Cues) which doesn't go on from what was played
+func tailProbe(s *PlaySession, ws *WatchState, size int64) bool {
+	if size <= 0 || s.StartOffset*100/size < WATCHED_PERCENT {
+		return false
+	}
+	return ws == nil || s.StartOffset > ws.MaxOffset
+}
+
+// openSession starts session of GET stream, share is id of share link it came through
+func openSession(r *http.Request, f *TorrentFile, share string) *PlaySession {
+	s := &PlaySession{
+		InfoHash:  f.Tud.Tags.getString("infohash", ""),
+		Torrent:   f.Tud.Name,
+		File:      f.file.DisplayPath(),
+		Index:     f.Index,
+		Client:    r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+		Share:     share,
+		Started:   time.Now(),
+		Active:    true,
+	}
+	if id := RequestIdentity(r); id != nil {
+		s.User = id.Name
+	}
+	history.Lock()
+	defer history.Unlock()
+	history.NextId++
+	s.Id = history.NextId
+	history.Sessions = append(history.Sessions, s)
+	if n := len(history.Sessions) - HISTORY_SESSIONS; n > 0 {
+		history.Sessions = history.Sessions[n:]
+	}
+	return s
+}
+
+// closeSession updates watch state of file unless stream was too short to be playback
+func closeSession(s *PlaySession, f *TorrentFile) {
+	history.Lock()
+	defer history.Unlock()
+	s.Active = false
+	s.Duration = time.Since(s.Started).Seconds()
+	if s.Duration >= PLAY_MIN_SECONDS && s.BytesServed >= PREBUFFER_PROBE && !tailProbe(s, history.watchState(f, false), f.file.Length()) {
+		ws := history.watchState(f, true)
+		ws.Plays++
+		ws.LastPlayed = time.Now()
+		reached(ws, s.Offset, s.MaxOffset)
+	}
+	history.save()
+}
+
+// sessionReader counts what is read through it into session
+type sessionReader struct {
+	rs      io.ReadSeeker
+	s       *PlaySession
+	pos     int64
+	started bool
+}
+
+func (r *sessionReader) Read(p []byte) (n int, err error) {
+	n, err = r.rs.Read(p)
+	history.Lock()
+	if !r.started {
+		r.s.StartOffset = r.pos
+		r.s.MaxOffset = r.pos
+		r.started = true
+	}
+	// only bytes played on from StartOffset move MaxOffset, not a jump ahead
+	contiguous := r.pos <= r.s.MaxOffset
+	r.pos += int64(n)
+	r.s.BytesServed += int64(n)
+	r.s.Offset = r.pos
+	if contiguous && r.pos > r.s.MaxOffset {
+		r.s.MaxOffset = r.pos
+	}
+	history.Unlock()
+	return
+}
+
+func (r *sessionReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.rs.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+// WatchState is nil if file was never played, PositionSeconds is filled in when bitrate is known
+func (f *TorrentFile) WatchState() *WatchState {
+	history.Lock()
+	defer history.Unlock()
+	ws := history.watchState(f, false)
+	if ws == nil {
+		return nil
+	}
+	rc := *ws
+	if br := f.Bitrate(); br > 0 {
+		rc.PositionSeconds = float64(rc.Position) / float64(br)
+	}
+	return &rc
+}
+
+func (f *TorrentFile) Watched() bool {
+	ws := f.WatchState()
+	return ws != nil && ws.Watched
+}
+
+// Watched is true when torrent has media files to download and all of them were watched
+func (tu *TorrentWithUserData) Watched() bool {
+	if !tu.InfoReady {
+		return false
+	}
+	media := 0
+	for _, item := range playlistItems(tu, false) {
+		if !item.file.Wanted() {
+			continue
+		}
+		if !item.file.Watched() {
+			return false
+		}
+		media++
+	}
+	return media > 0
+}
+
+// _apiHistory lists sessions newest first, limit= and torrent= narrow it
+func _apiHistory(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	hash := ""
+	if v := r.FormValue("torrent"); v != "" {
+		tu, _ := tc.GetTorrent(v)
+		if tu == nil {
+			httpError(w, http.StatusNotFound, "torrent '%s' not found", v)
+			return
+		}
+		hash = tu.Tags.getString("infohash", "")
+	}
+	history.Lock()
+	rc := make([]PlaySession, 0)
+	for i := len(history.Sessions) - 1; i >= 0 && (limit <= 0 || len(rc) < limit); i-- {
+		s := history.Sessions[i]
+		if hash != "" && s.InfoHash != hash {
+			continue
+		}
+		c := *s
+		if c.Active {
+			c.Duration = time.Since(c.Started).Seconds()
+		}
+		rc = append(rc, c)
+	}
+	history.Unlock()
+	writeJson(w, http.StatusOK, rc)
+}
+
+// _apiContinueWatching has one file per torrent, newest first: the last played one if it isn't
+// finished, the next episode when it is
+func _apiContinueWatching(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	rc := make([]WatchState, 0)
+	for _, tu := range tc.GetTorrents() {
+		if tu == nil || !tu.InfoReady {
+			continue
+		}
+		items := playlistItems(tu, false)
+		var last *WatchState
+		next := -1
+		for i, item := range items {
+			if ws := item.file.WatchState(); ws != nil && (last == nil || ws.LastPlayed.After(last.LastPlayed)) {
+				last, next = ws, i+1
+			}
+		}
+		switch {
+		case last == nil:
+			continue
+		case !last.Watched:
+			rc = append(rc, *last)
+		case next < len(items) && items[next].file.WatchState() == nil:
+			f := items[next].file
+			rc = append(rc, WatchState{
+				InfoHash:   tu.Tags.getString("infohash", ""),
+				Torrent:    tu.Name,
+				File:       f.file.DisplayPath(),
+				Index:      f.Index,
+				Size:       f.file.Length(),
+				LastPlayed: last.LastPlayed,
+			})
+		}
+	}
+	sort.Slice(rc, func(i, j int) bool { return rc[i].LastPlayed.After(rc[j].LastPlayed) })
+	if limit > 0 && len(rc) > limit {
+		rc = rc[:limit]
+	}
+	writeJson(w, http.StatusOK, rc)
+}
+
+func _apiWatchGet(w http.ResponseWriter, r *http.Request) {
+	f := apiFile(w, r)
+	if f == nil {
+		return
+	}
+	ws := f.WatchState()
+	if ws == nil {
+		httpError(w, http.StatusNotFound, "%s was never played", f.file.DisplayPath())
+		return
+	}
+	writeJson(w, http.StatusOK, ws)
+}
+
+// _apiWatchSet takes watched=yes|no, position in bytes or seconds. It's admin only as drop_watched removes
+// data of watched torrents
+func _apiWatchSet(w http.ResponseWriter, r *http.Request) {
+	f := apiFile(w, r)
+	if f == nil {
+		return
+	}
+	position := int64(-1)
+	if v := r.FormValue("position"); v != "" {
+		p, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || p < 0 || p > f.file.Length() {
+			httpError(w, http.StatusBadRequest, "bad position '%s', file has %d bytes", v, f.file.Length())
+			return
+		}
+		position = p
+	}
+	if v := r.FormValue("seconds"); v != "" {
+		sec, err := strconv.ParseFloat(v, 64)
+		if err != nil || sec < 0 {
+			httpError(w, http.StatusBadRequest, "bad seconds '%s'", v)
+			return
+		}
+		br := f.Bitrate()
+		if br == 0 {
+			httpError(w, http.StatusConflict, "duration of %s isn't known yet, use position in bytes", f.file.DisplayPath())
+			return
+		}
+		if position = int64(sec * float64(br)); position > f.file.Length() {
+			position = f.file.Length()
+		}
+	}
+	watched := r.FormValue("watched")
+	if watched != "" && watched != "yes" && watched != "no" {
+		httpError(w, http.StatusBadRequest, "bad watched '%s', it's yes or no", watched)
+		return
+	}
+	history.Lock()
+	ws := history.watchState(f, true)
+	if position >= 0 {
+		ws.LastPlayed = time.Now()
+		reached(ws, position, position)
+	}
+	switch watched {
+	case "yes":
+		ws.Watched = true
+		ws.Position = 0
+	case "no":
+		// or the next stream marks it again
+		ws.Watched = false
+		ws.MaxOffset = ws.Position
+		ws.Progress = 0
+		if ws.Size > 0 {
+			ws.Progress = int(ws.MaxOffset * 100 / ws.Size)
+		}
+	}
+	history.save()
+	history.Unlock()
+	writeJson(w, http.StatusOK, f.WatchState())
+}
+
+func _apiWatchDelete(w http.ResponseWriter, r *http.Request) {
+	f := apiFile(w, r)
+	if f == nil {
+		return
+	}
+	history.Lock()
+	defer history.Unlock()
+	if _, ok := history.Files[watchKey(f)]; !ok {
+		httpError(w, http.StatusNotFound, "%s was never played", f.file.DisplayPath())
+		return
+	}
+	delete(history.Files, watchKey(f))
+	history.save()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,73 @@
+package torc
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSessionReaderMaxOffsetIsContiguous(t *testing.T) {
+	data := make([]byte, 1000)
+	s := &PlaySession{}
+	r := &sessionReader{rs: bytes.NewReader(data), s: s}
+	r.Seek(100, io.SeekStart)
+	io.CopyN(ioutil.Discard, r, 200)
+	if s.StartOffset != 100 || s.MaxOffset != 300 {
+		t.Errorf("start %d max %d, want 100 and 300", s.StartOffset, s.MaxOffset)
+	}
+	// jump to the tail isn't played
+	r.Seek(900, io.SeekStart)
+	io.CopyN(ioutil.Discard, r, 100)
+	if s.MaxOffset != 300 || s.Offset != 1000 {
+		t.Errorf("after jump max %d offset %d, want 300 and 1000", s.MaxOffset, s.Offset)
+	}
+}
+
+func TestTailProbe(t *testing.T) {
+	for _, c := range []struct {
+		start int64
+		ws    *WatchState
+		probe bool
+	}{
+		{0, nil, false},
+		{500, nil, false},
+		{950, nil, true},
+		{950, &WatchState{MaxOffset: 400}, true},
+		{950, &WatchState{MaxOffset: 960}, false},
+	} {
+		if got := tailProbe(&PlaySession{StartOffset: c.start}, c.ws, 1000); got != c.probe {
+			t.Errorf("start %d ws %+v: probe %v, want %v", c.start, c.ws, got, c.probe)
+		}
+	}
+}
+
+func TestDropWatchedRemovesData(t *testing.T) {
+	tu := addTestTorrent(t, "Drop Watched", map[string]int{"e01.mkv": 40000, "e02.mkv": 40000})
+	datapath := tu.Tags.getString("datapath", "")
+	if datapath == "" {
+		t.Fatal("no datapath tag")
+	}
+	tu.Tags.Set("drop_watched", "yes")
+	history.Lock()
+	history.watchState(tu.GetFile("Drop Watched/e01.mkv"), true).Watched = true
+	history.Unlock()
+	tu.ProcessTags()
+	if tu.Tags.getString("want_drop", "") != "" {
+		t.Fatalf("dropped with e02 not watched")
+	}
+	history.Lock()
+	history.watchState(tu.GetFile("Drop Watched/e02.mkv"), true).Watched = true
+	history.Unlock()
+	// first pass pauses torrent, second one removes it
+	for i := 0; i < 2 && !tu.Dead; i++ {
+		tu.ProcessTags()
+	}
+	if !tu.Dead {
+		t.Fatalf("not dropped when all watched, want_drop %q", tu.Tags.getString("want_drop", ""))
+	}
+	if _, err := os.Stat(datapath); !os.IsNotExist(err) {
+		t.Errorf("data is still in %s: %v", datapath, err)
+	}
+}
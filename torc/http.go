@@ -1,16 +1,22 @@
 package torc
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/anacrolix/missinggo"
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
 	"time"
+	"ttv/client"
 )
 
 const TMDB_URL = `https://api.themoviedb.org/3`
@@ -19,12 +25,23 @@ const tmdb_API_KEY = `09c7d97911b06031f851d23554154de2`
 const JACK_URL = `http://linux:9117`
 const jack_API_KEY = `tnwamc70lv1xygeh9f7v5v71a739u0re`
 
+// no read and write timeouts, /play streams and event streams last for hours
+const HTTP_READ_HEADER_TIMEOUT = 20 * time.Second
+const HTTP_IDLE_TIMEOUT = 2 * time.Minute
+
 type HttpServer struct {
 	r          *mux.Router
 	tc         *TorrentClient
 	ListenAddr string
 	ListenPort int64
+	TLS        bool
+	CertFile   string
+	KeyFile    string
+	DLNA       bool
+	DlnaSsdp   string
 	configured bool
+	server     *http.Server
+	err        error
 	done       missinggo.Event
 }
 
@@ -41,7 +58,15 @@ func NewHttpServer(torClient *TorrentClient) *HttpServer {
 	}
 	srv.ListenAddr = GetEnv("TC_HTTPADDR", "0.0.0.0")
 	srv.ListenPort, _ = strconv.ParseInt(GetEnv("TC_HTTPPORT", "3003"), 10, 64)
+	srv.TLS = GetEnv("TC_TLS", "no") == "yes"
+	srv.CertFile = GetEnv("TC_TLS_CERT", "tls/cert.pem")
+	srv.KeyFile = GetEnv("TC_TLS_KEY", "tls/key.pem")
+	srv.DLNA = GetEnv("TC_DLNA", "no") == "yes"
+	srv.DlnaSsdp = GetEnv("TC_DLNA_SSDP", SSDP_ADDR)
 	cache = NewCache(GetEnv("TC_CACHEDIR", "./cache"))
+	LoadAuth(GetEnv("TC_AUTHFILE", "auth.yaml"))
+	LoadShares(GetEnv("TC_SHAREFILE", "shares.yaml"))
+	LoadHistory(GetEnv("TC_HISTORYFILE", "history.yaml"))
 	srv.configured = true
 	srv.r = rr
 	srv.tc = torClient
@@ -53,30 +78,72 @@ func NewHttpServer(torClient *TorrentClient) *HttpServer {
 	rr.HandleFunc("/playPrepare/{name}/{file}", _playPrepare)
 	rr.HandleFunc("/torrentStatus/{name}", _torrentStatus)
 	rr.HandleFunc("/play/{name}/{file}", _Play)
+	rr.HandleFunc("/subtitles/{name}/{index:[0-9]+}.vtt", _SubtitleVtt).Methods("GET")
+	rr.HandleFunc("/subtitles/{name}/{index:[0-9]+}", _Subtitle).Methods("GET")
+	rr.HandleFunc("/playlist/category/{category}.{ext:m3u8?}", _CategoryPlaylist).Methods("GET")
+	rr.HandleFunc("/playlist/{name}.{ext:m3u8?}", _Playlist).Methods("GET")
+	rr.HandleFunc("/share/{id}/{exp}/{sig}/{name}", _Share).Methods("GET", "HEAD")
 	rr.HandleFunc("/tag/{name}", _tagTorrent)
 	rr.HandleFunc("/watchLaterList", _watchLaterList)
 	//
 	rr.HandleFunc("/api/tmdb", _ApiTmdb)
 	rr.HandleFunc("/api/jacket", _ApiJacket)
+	rr.HandleFunc("/api/events", _ApiEvents).Methods("GET")
+	rr.HandleFunc("/api/openapi.json", _ApiOpenApi).Methods("GET")
+	rr.HandleFunc("/metrics", _Metrics).Methods("GET")
+	registerDebugRoutes()
+	registerApiV2(rr)
+	rr.HandleFunc("/transmission/rpc", _TransmissionRpc).Methods("GET", "POST")
+	registerQbitApi(rr.PathPrefix(QB_PREFIX).Subrouter())
+	if srv.DLNA {
+		initDlna(srv.ListenPort)
+	}
 	//
+	rr.Use(metricsMiddleware)
 	rr.Use(loggingMiddleware)
+	rr.Use(authMiddleware)
 	return &srv
 }
 
-type httpE struct {
-	Error string `json:"error"`
-}
+type httpE = client.Error
 
 func httpError(w http.ResponseWriter, status int, f string, v ...interface{}) (msg string) {
 	msg = fmt.Sprintf(f, v...)
 	_je, _ := json.Marshal(httpE{Error: msg})
 	log.Error(string(_je))
-	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(_je)
 	return msg
 }
 
+// baseUrl is scheme and host as client sees them, proxies set X-Forwarded-*
+func baseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		scheme = p
+	}
+	host := r.Host
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+		host = h
+	}
+	return scheme + "://" + host
+}
+
+// playUrl is like client.PlayUrl, file is escaped twice as /play unescapes it once more. Links are
+// signed instead of carrying token of whoever asked for them
+func playUrl(r *http.Request, tu *TorrentWithUserData, file *TorrentFile) string {
+	name := tu.Tags.getString("infohash", tu.Name)
+	u := baseUrl(r) + "/play/" + url.PathEscape(name) + "/" + url.PathEscape(url.QueryEscape(file.file.DisplayPath()))
+	if auth.Enabled() {
+		u += "?" + playLinkQuery(name, file.file.DisplayPath())
+	}
+	return u
+}
+
 func doGet(req string) (data []byte, magnet string, err error) {
 	baseUrl, err := url.Parse(req)
 	magnet = ""
@@ -115,24 +182,71 @@ func (s *HttpServer) Closed() <-chan struct{} {
 	return s.done.C()
 }
 
-func (s *HttpServer) Start() {
+// Err is why server stopped
+func (s *HttpServer) Err() error {
+	return s.err
+}
+
+// Start returns error if server can't listen, errors after that are reported by Err once Closed
+func (s *HttpServer) Start() error {
+	s.server = &http.Server{
+		Addr:              fmt.Sprintf("%v:%v", s.ListenAddr, s.ListenPort),
+		Handler:           corsMiddleware(rr),
+		ReadHeaderTimeout: HTTP_READ_HEADER_TIMEOUT,
+		IdleTimeout:       HTTP_IDLE_TIMEOUT,
+	}
+	if s.TLS {
+		cfg, err := newTlsConfig(s.CertFile, s.KeyFile, s.ListenAddr)
+		if err != nil {
+			return err
+		}
+		s.server.TLSConfig = cfg
+		if err := http2.ConfigureServer(s.server, nil); err != nil {
+			return newError("failed to configure http2: %v", err)
+		}
+	}
+	ln, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return newError("failed to listen on %s: %v", s.server.Addr, err)
+	}
+	if s.TLS {
+		ln = tls.NewListener(ln, s.server.TLSConfig)
+	}
+	log.Info("listening on %s, tls: %v", ln.Addr(), s.TLS)
 	go func() {
-		http.Handle("/", rr)
-		http.ListenAndServe(fmt.Sprintf("%v:%v", s.ListenAddr, s.ListenPort), nil)
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.err = newError("http server failed: %v", err)
+			log.Error(s.err)
+		}
 		s.done.Set()
 	}()
+	if s.DLNA {
+		startSsdp(s.DlnaSsdp, s.ListenPort, s.TLS)
+	}
+	return nil
+}
+
+// Close stops server, running streams are cut
+func (s *HttpServer) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	stopSsdp()
+	return s.server.Close()
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		q, _ := url.QueryUnescape(r.URL.RequestURI())
-		log.Debug("< " + r.Method + " " + q)
+		log.Debug("< " + r.Method + " " + maskToken(q))
 		//		log.Debug(r.RequestURI)
 		for k, v := range r.Header {
+			if k == "Authorization" || k == "X-Api-Key" {
+				v = []string{"***"}
+			}
 			log.Trace(fmt.Sprintf("    '%s' : '%s'", k, v))
 		}
 
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 		next.ServeHTTP(w, r)
 
 		log.Trace("> " + r.Host)
@@ -142,39 +256,6 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func _Home(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprint(w, "<html><pre>")
-	err := rr.Walk(func(route *mux.Route, router *mux.Router, ancestor []*mux.Route) error {
-		pathTemplate, err := route.GetPathTemplate()
-		if err == nil {
-			fmt.Fprintln(w, "ROUTE:", pathTemplate)
-		}
-		pathRegexp, err := route.GetPathRegexp()
-		if err == nil {
-			fmt.Fprintln(w, "Path regexp:", pathRegexp)
-		}
-		queriesTemplates, err := route.GetQueriesTemplates()
-		if err == nil {
-			fmt.Fprintln(w, "Queries templates:", strings.Join(queriesTemplates, ","))
-		}
-		queriesRegexps, err := route.GetQueriesRegexp()
-		if err == nil {
-			fmt.Fprintln(w, "Queries regexps:", strings.Join(queriesRegexps, ","))
-		}
-		methods, err := route.GetMethods()
-		if err == nil {
-			fmt.Fprintln(w, "Methods:", strings.Join(methods, ","))
-		}
-		fmt.Println("</pre>")
-		return nil
-	})
-	if err != nil {
-		fmt.Fprint(w, "Error: %v", err)
-	}
-}
-
 func _List(w http.ResponseWriter, r *http.Request) {
 	rc := struct {
 		Torrents []TorrentInfo `json:"Torrents"`
@@ -187,11 +268,6 @@ func _List(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(rc)
-
-	//
-	//	buf := bytes.NewBufferString("")
-	//	tc.tc.WriteStatus(buf)
-	//	log.Debug("\n%s", buf.String())
 }
 
 func _torrentFileList(w http.ResponseWriter, r *http.Request) {
@@ -286,14 +362,12 @@ func _playPrepare(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tc.PauseNotInPlay()
-	go tfile.PrepareForPlay()
-	w.WriteHeader(http.StatusAccepted)
+	tfile.StartPrepare(false)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte("{\"status\":\"started\"}"))
 }
 
-var id = 0
-
 func _Play(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name, ok := vars["name"]
@@ -320,36 +394,137 @@ func _Play(w http.ResponseWriter, r *http.Request) {
 		log.Error(httpError(w, http.StatusBadRequest, "failed to find file '%v' in '%v'", fname, name))
 		return
 	}
+	playFile(w, r, tu, file, nil)
+}
+
+// playHeaders are the same for HEAD and GET, ServeContent takes If-None-Match, If-Range
+// and If-Modified-Since from ETag and modtime
+func playHeaders(w http.ResponseWriter, r *http.Request, file *TorrentFile) {
+	disposition := "inline"
+	if dl := r.FormValue("download"); dl == "yes" || dl == "true" || dl == "1" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Type", file.ContentType())
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, path.Base(file.file.DisplayPath())))
+	w.Header().Set("ETag", file.ETag())
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	dlnaHeaders(w, r, file)
+}
+
+// zeroReader has size of file for HEAD
+type zeroReader struct{}
+
+func (zeroReader) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// etagMatch is If-Match or If-None-Match list against etag, weak ones match too
+func etagMatch(list string, etag string) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// playPreconditions answers 412 and 304 the way ServeContent does, false when it did
+func playPreconditions(w http.ResponseWriter, r *http.Request, file *TorrentFile) bool {
+	etag := file.ETag()
+	modtime := file.LastModified().Truncate(time.Second)
+	since := func(header string) (time.Time, bool) {
+		t, err := http.ParseTime(r.Header.Get(header))
+		return t, err == nil && !modtime.IsZero()
+	}
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagMatch(im, etag) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return false
+		}
+	} else if t, ok := since("If-Unmodified-Since"); ok && modtime.After(t) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		notModified = etagMatch(inm, etag)
+	} else if t, ok := since("If-Modified-Since"); ok {
+		notModified = !modtime.After(t)
+	}
+	if notModified {
+		h := w.Header()
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		h.Del("Content-Disposition")
+		w.WriteHeader(http.StatusNotModified)
+		return false
+	}
+	return true
+}
+
+// playFile streams torrent file, share is set when request came through share link
+func playFile(w http.ResponseWriter, r *http.Request, tu *TorrentWithUserData, file *TorrentFile, share *shareLink) {
+	playHeaders(w, r, file)
 
-	// play
 	if r.Method == "HEAD" {
-		w.Header().Set("Content-Type", "video/mp4")
-		w.Header().Set("Content-Length", strconv.FormatInt(file.file.Length(), 10))
-		w.Header().Set("Accept-Ranges", "bytes")
-		w.Header().Set("Connection", "Keep-Alive")
-		w.Write([]byte(" "))
+		// nothing is read for HEAD, torrent reader would prioritize pieces ServeContent seeks to
+		http.ServeContent(w, r, file.file.DisplayPath(), file.LastModified(), io.NewSectionReader(zeroReader{}, 0, file.file.Length()))
 		return
 	}
 
 	if r.Method == "GET" {
+		// revalidation doesn't open a stream, hold other torrents or count as play
+		if !playPreconditions(w, r, file) {
+			return
+		}
 		tc.PauseNotInPlay()
 		rdr := file.OpenFileReader()
 		start := time.Now()
-		id += 1
+		via := ""
+		var rs io.ReadSeeker = rdr
+		if share != nil {
+			via = share.Id
+			rs = share.Open(r.Context(), rdr)
+		}
+		ps := openSession(r, file, via)
+		sid := ps.Id
+		rs = &sessionReader{rs: rs, s: ps}
+		file.StartPrefetch()
 		defer func() {
-			log.Info("stream %d done after: %v sec", id, time.Since(start).Seconds())
+			file.StopPrefetch()
+			served := int64(0)
+			if share != nil {
+				served = share.Close(rs.(*sessionReader).rs)
+				log.Info("stream %d done after: %v sec, share %s served %d bytes", sid, time.Since(start).Seconds(), via, served)
+			} else {
+				log.Info("stream %d done after: %v sec", sid, time.Since(start).Seconds())
+			}
 			file.CloseFileReader(rdr)
+			closeSession(ps, file)
+			Emit(EvStreamClosed, tu, file.file.DisplayPath(), map[string]interface{}{
+				"Stream":    sid,
+				"Client":    r.RemoteAddr,
+				"Duration":  time.Since(start).Seconds(),
+				"Share":     via,
+				"Served":    served,
+				"Offset":    ps.Offset,
+				"MaxOffset": ps.MaxOffset,
+			})
 		}()
 
-		log.Info("starting stream id: %d for %v - %v", id, tu.torrent.Name(), file.file.Path())
+		if share != nil {
+			log.Info("starting stream id: %d for %v - %v, share %s from %s", sid, tu.torrent.Name(), file.file.Path(), via, r.RemoteAddr)
+		} else {
+			log.Info("starting stream id: %d for %v - %v", sid, tu.torrent.Name(), file.file.Path())
+		}
+		Emit(EvStreamOpened, tu, file.file.DisplayPath(), map[string]interface{}{"Stream": sid, "Client": r.RemoteAddr, "Share": via})
 
-		// w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("Connection", "Keep-Alive")
-		w.Header().Set("Content-Length", strconv.FormatInt(file.file.Length(), 10))
-		w.Header().Set("Content-Type", "application/octet-stream")
-		// io.Copy(w, rdr)
-		http.ServeContent(w, r, file.file.Path(), time.Now(), rdr)
+		http.ServeContent(w, r, file.file.DisplayPath(), file.LastModified(), rs)
 	}
 }
 
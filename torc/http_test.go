@@ -0,0 +1,90 @@
+package torc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func playRequest(t *testing.T, method string, tu *TorrentWithUserData, file *TorrentFile, header map[string]string) *http.Response {
+	t.Helper()
+	u := testServer.URL + "/play/" + url.PathEscape(tu.torrent.InfoHash().HexString()) + "/" + url.PathEscape(url.QueryEscape(file.file.DisplayPath()))
+	req, _ := http.NewRequest(method, u, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func sessionCount() int {
+	history.Lock()
+	defer history.Unlock()
+	return len(history.Sessions)
+}
+
+func TestPlayRevalidationOpensNothing(t *testing.T) {
+	tu := addTestTorrent(t, "Play Cond", map[string]int{"movie.mkv": 40000})
+	f := tu.GetFile(0)
+	sessions := sessionCount()
+
+	resp := playRequest(t, "HEAD", tu, f, nil)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 40000 || resp.Header.Get("ETag") != f.ETag() {
+		t.Fatalf("HEAD: %d, length %d, etag %s", resp.StatusCode, resp.ContentLength, resp.Header.Get("ETag"))
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	past := f.LastModified().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	for _, c := range []struct {
+		header map[string]string
+		status int
+	}{
+		{map[string]string{"If-None-Match": f.ETag()}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"other", W/` + f.ETag()}, http.StatusNotModified},
+		{map[string]string{"If-Modified-Since": future}, http.StatusNotModified},
+		{map[string]string{"If-Match": `"other"`}, http.StatusPreconditionFailed},
+		{map[string]string{"If-Unmodified-Since": past}, http.StatusPreconditionFailed},
+	} {
+		if resp = playRequest(t, "GET", tu, f, c.header); resp.StatusCode != c.status {
+			t.Errorf("GET %v: %d, want %d", c.header, resp.StatusCode, c.status)
+		}
+	}
+	if n := sessionCount(); n != sessions {
+		t.Errorf("%d play sessions after HEAD and revalidation, want %d", n, sessions)
+	}
+
+	resp = playRequest(t, "GET", tu, f, map[string]string{"If-None-Match": `"other"`, "Range": "bytes=0-9"})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("GET with stale etag: %d, want 206", resp.StatusCode)
+	}
+	if n := sessionCount(); n != sessions+1 {
+		t.Errorf("%d play sessions after GET, want %d", n, sessions+1)
+	}
+}
+
+// handlers ask for type and duration of the same file at once, go test -race catches unguarded caches
+func TestFileCacheConcurrent(t *testing.T) {
+	tu := addTestTorrent(t, "Concurrent", map[string]int{"movie.bin": 50000})
+	f := tu.GetFile(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.ContentType()
+			f.Duration()
+			f.setDuration(0)
+		}()
+	}
+	wg.Wait()
+	if f.ContentType() == "" {
+		t.Errorf("no content type")
+	}
+}
@@ -0,0 +1,310 @@
+package torc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"ttv/client"
+)
+
+type ImportRequest = client.ImportRequest
+type ImportItem = client.ImportItem
+type ImportResponse = client.ImportResponse
+
+const (
+	IMPORT_TRANSMISSION = "transmission"
+	IMPORT_QBITTORRENT  = "qbittorrent"
+)
+
+// transmissionResume is what import looks at in resume/<name>.resume, .torrent is in torrents with the same name
+type transmissionResume struct {
+	Destination   string   `bencode:"destination"`
+	IncompleteDir string   `bencode:"incomplete-dir"`
+	Name          string   `bencode:"name"`
+	Labels        []string `bencode:"labels,ignore_unmarshal_type_error"`
+	Paused        int64    `bencode:"paused,ignore_unmarshal_type_error"`
+	AddedDate     int64    `bencode:"added-date"`
+	Uploaded      int64    `bencode:"uploaded"`
+	Downloaded    int64    `bencode:"downloaded"`
+}
+
+// qbFastResume is <hash>.fastresume of BT_backup, newer ones keep info there when there is no <hash>.torrent
+type qbFastResume struct {
+	SavePath     string        `bencode:"save_path"`
+	QbtSavePath  string        `bencode:"qBt-savePath"`
+	DownloadPath string        `bencode:"qBt-downloadPath"`
+	Category     string        `bencode:"qBt-category"`
+	Tags         []string      `bencode:"qBt-tags,ignore_unmarshal_type_error"`
+	Name         string        `bencode:"qBt-name"`
+	Paused       int64         `bencode:"paused,ignore_unmarshal_type_error"`
+	AddedTime    int64         `bencode:"added_time"`
+	Uploaded     int64         `bencode:"total_uploaded"`
+	Downloaded   int64         `bencode:"total_downloaded"`
+	Trackers     [][]string    `bencode:"trackers,ignore_unmarshal_type_error"`
+	Info         bencode.Bytes `bencode:"info"`
+}
+
+// importEntry is torrent of other client, data is in the first of savePaths which has it
+type importEntry struct {
+	resume     string
+	data       []byte
+	name       string
+	category   string
+	labels     []string
+	savePaths  []string
+	paused     bool
+	added      int64
+	uploaded   int64
+	downloaded int64
+	err        error
+}
+
+// adoptData hash checks data of tu where its download tag points, it has to be done before it is
+// resumed. pieces which don't match are downloaded again right there
+func adoptData(tu *TorrentWithUserData) {
+	start := time.Now()
+	tu.torrent.VerifyData()
+	log.Info("%s: %d of %d bytes in %s are good, checked in %v", tu.Name, tu.torrent.BytesCompleted(), tu.torrent.Length(),
+		tu.Tags.getString("download", ""), time.Since(start))
+}
+
+func readBencoded(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err = bencode.Unmarshal(data, v); err != nil {
+		return newError("%s: %v", path.Base(file), err)
+	}
+	return nil
+}
+
+// transmissionEntries takes config dir of transmission or its resume dir
+func transmissionEntries(dir string) ([]importEntry, error) {
+	resumeDir, torrentDir := dir, dir
+	if st, err := os.Stat(path.Join(dir, "resume")); err == nil && st.IsDir() {
+		resumeDir, torrentDir = path.Join(dir, "resume"), path.Join(dir, "torrents")
+	} else if path.Base(dir) == "resume" {
+		torrentDir = path.Join(path.Dir(dir), "torrents")
+	}
+	files, err := filepath.Glob(path.Join(resumeDir, "*.resume"))
+	if err != nil {
+		return nil, err
+	}
+	rc := make([]importEntry, 0)
+	for _, file := range files {
+		e := importEntry{resume: file}
+		r := transmissionResume{}
+		if e.err = readBencoded(file, &r); e.err == nil {
+			e.data, e.err = ioutil.ReadFile(path.Join(torrentDir, strings.TrimSuffix(path.Base(file), ".resume")+".torrent"))
+		}
+		e.name = r.Name
+		e.labels = r.Labels
+		// incomplete ones are in incomplete dir if it is on
+		e.savePaths = []string{r.Destination, r.IncompleteDir}
+		e.paused = r.Paused != 0
+		e.added, e.uploaded, e.downloaded = r.AddedDate, r.Uploaded, r.Downloaded
+		rc = append(rc, e)
+	}
+	return rc, nil
+}
+
+// qbittorrentEntries takes BT_backup dir of qbittorrent
+func qbittorrentEntries(dir string) ([]importEntry, error) {
+	files, err := filepath.Glob(path.Join(dir, "*.fastresume"))
+	if err != nil {
+		return nil, err
+	}
+	rc := make([]importEntry, 0)
+	for _, file := range files {
+		e := importEntry{resume: file}
+		r := qbFastResume{}
+		if e.err = readBencoded(file, &r); e.err == nil {
+			e.data, e.err = ioutil.ReadFile(strings.TrimSuffix(file, ".fastresume") + ".torrent")
+			if e.err != nil && len(r.Info) > 0 {
+				mi := metainfo.MetaInfo{InfoBytes: r.Info, AnnounceList: r.Trackers}
+				e.data, e.err = bencode.Marshal(mi)
+			}
+		}
+		e.name = r.Name
+		e.category = r.Category
+		e.labels = r.Tags
+		e.savePaths = []string{r.QbtSavePath, r.SavePath, r.DownloadPath}
+		e.paused = r.Paused != 0
+		e.added, e.uploaded, e.downloaded = r.AddedTime, r.Uploaded, r.Downloaded
+		rc = append(rc, e)
+	}
+	return rc, nil
+}
+
+// importCategory is category or label which is ttv category, then category of save path, then
+// req.Category. the other labels are left for tags
+func importCategory(req ImportRequest, e importEntry) (cat string, labels []string) {
+	for _, l := range append([]string{e.category}, e.labels...) {
+		if l == "" {
+			continue
+		}
+		if _, ok := GetCategory(l); ok && cat == "" {
+			cat = l
+			continue
+		}
+		labels = append(labels, l)
+	}
+	for _, dir := range e.savePaths {
+		if cat != "" || dir == "" {
+			continue
+		}
+		if c, ok := FindCategoryByDir(dir); ok {
+			cat = c.name
+		}
+	}
+	if cat == "" {
+		cat = req.Category
+	}
+	if cat == "" {
+		cat = tc.KodiCategory
+	}
+	return
+}
+
+func importItem(req ImportRequest, e importEntry) ImportItem {
+	item := ImportItem{Resume: e.resume, Name: e.name, Tags: map[string]string{}}
+	if e.err != nil {
+		item.Status, item.Error = "failed", e.err.Error()
+		return item
+	}
+	mi, err := metainfo.Load(bytes.NewReader(e.data))
+	if err != nil {
+		item.Status, item.Error = "failed", fmt.Sprintf("not a torrent file: %v", err)
+		return item
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		item.Status, item.Error = "failed", fmt.Sprintf("bad info: %v", err)
+		return item
+	}
+	item.InfoHash = mi.HashInfoBytes().HexString()
+	if item.Name == "" {
+		item.Name = info.Name
+	}
+	var labels []string
+	item.Category, labels = importCategory(req, e)
+	// labels can't act as control or bookkeeping tags, kill_it of other client would drop the torrent
+	for _, l := range labels {
+		k, v := qbParseTag(l)
+		if k == "" || qbSystemTags[k] {
+			log.Warn("import of %s: label '%s' is reserved, skipped", item.Name, l)
+			continue
+		}
+		item.Tags[k] = v
+	}
+	if e.added > 0 {
+		item.Tags["added"] = time.Unix(e.added, 0).Format(time.RFC822)
+	}
+	// totals go on from what other client counted
+	item.Tags["upload_bytes"] = fmt.Sprintf("%d", e.uploaded)
+	item.Tags["downloaded_bytes"] = fmt.Sprintf("%d", e.downloaded)
+	for _, dir := range e.savePaths {
+		if dir != "" && path.IsAbs(dir) && fileExists(path.Join(dir, info.Name)) {
+			item.DataPath = path.Clean(dir)
+			break
+		}
+	}
+
+	if tu, _ := tc.GetTorrent(item.InfoHash); tu != nil {
+		item.Status, item.Error = "duplicate", fmt.Sprintf("already there as %s", tu.Name)
+		return item
+	}
+	if req.DryRun {
+		item.Status = "new"
+		return item
+	}
+	added, status, err := addTorrent(AddTorrentRequest{
+		Name:     item.Name,
+		Category: item.Category,
+		Paused:   req.Paused || e.paused,
+		Tags:     item.Tags,
+		DataPath: item.DataPath,
+	}, e.data, "import_"+req.Client)
+	switch {
+	case status == http.StatusConflict:
+		item.Status = "duplicate"
+	case err != nil:
+		item.Status, item.Error = "failed", err.Error()
+	default:
+		item.Status, item.Name = "added", added.Name
+		if added.Torrent != nil {
+			item.Completed = added.Torrent.Completion
+		}
+	}
+	return item
+}
+
+// ImportTorrents adds torrents of other client with data where that client has it, one by one as
+// each of them is hash checked
+func ImportTorrents(req ImportRequest) (rc ImportResponse, status int, err error) {
+	if req.Category != "" {
+		if _, ok := GetCategory(req.Category); !ok {
+			return rc, http.StatusBadRequest, newError("unknown category '%s'", req.Category)
+		}
+	}
+	if !path.IsAbs(req.Dir) {
+		return rc, http.StatusBadRequest, newError("dir '%s' isn't absolute", req.Dir)
+	}
+	if st, err := os.Stat(req.Dir); err != nil || !st.IsDir() {
+		return rc, http.StatusNotFound, newError("%s is not a directory", req.Dir)
+	}
+	var entries []importEntry
+	switch req.Client {
+	case IMPORT_TRANSMISSION:
+		entries, err = transmissionEntries(req.Dir)
+	case IMPORT_QBITTORRENT:
+		entries, err = qbittorrentEntries(req.Dir)
+	default:
+		return rc, http.StatusBadRequest, newError("bad client '%s', it's %s or %s", req.Client, IMPORT_TRANSMISSION, IMPORT_QBITTORRENT)
+	}
+	if err != nil {
+		return rc, http.StatusInternalServerError, newError("failed to list %s: %v", req.Dir, err)
+	}
+	log.Info("import of %d torrents from %s in %s, dry run %v", len(entries), req.Client, req.Dir, req.DryRun)
+	rc = ImportResponse{Client: req.Client, Dir: req.Dir, DryRun: req.DryRun, Items: make([]ImportItem, 0)}
+	for _, e := range entries {
+		item := importItem(req, e)
+		switch item.Status {
+		case "added":
+			rc.Added++
+		case "failed":
+			rc.Failed++
+			log.Warn("import of %s failed: %s", e.resume, item.Error)
+		case "duplicate":
+			rc.Skipped++
+		}
+		rc.Items = append(rc.Items, item)
+	}
+	log.Info("import from %s: %d added, %d skipped, %d failed", req.Dir, rc.Added, rc.Skipped, rc.Failed)
+	return rc, http.StatusOK, nil
+}
+
+// _apiImport answers when all data found is checked, that takes a while
+func _apiImport(w http.ResponseWriter, r *http.Request) {
+	req := ImportRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "failed to decode json: %v", err)
+		return
+	}
+	rc, status, err := ImportTorrents(req)
+	if err != nil {
+		httpError(w, status, "%v", err)
+		return
+	}
+	writeJson(w, status, rc)
+}
@@ -0,0 +1,32 @@
+package torc
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestImportSkipsReservedLabels(t *testing.T) {
+	cat, _ := GetCategory(TEST_CATEGORY)
+	data := makeTorrent(t, cat.download, "Imported Show", map[string]int{"e01.mkv": 20000})
+	defer os.RemoveAll(path.Join(cat.download, "Imported Show"))
+	item := importItem(ImportRequest{DryRun: true}, importEntry{
+		data:      data,
+		labels:    []string{"from_transmission", "kill_it", "drop_watched", "seed_until=2000-01-01", "infohash=00"},
+		savePaths: []string{cat.download},
+	})
+	if item.Status != "new" || item.Category != TEST_CATEGORY {
+		t.Fatalf("item %+v", item)
+	}
+	if item.Tags["from_transmission"] != "yes" {
+		t.Errorf("label is lost: %v", item.Tags)
+	}
+	for _, k := range []string{"kill_it", "drop_watched", "seed_until", "infohash"} {
+		if _, ok := item.Tags[k]; ok {
+			t.Errorf("reserved %s is imported: %v", k, item.Tags)
+		}
+	}
+	if item.DataPath != cat.download {
+		t.Errorf("data path %s, want %s", item.DataPath, cat.download)
+	}
+}
@@ -40,6 +40,8 @@ func NewMagnetLoader(dldir string) *MagnetLoader {
 
 func (c *MagnetLoader) LoadMagnet(magnet string) (mi []byte, err error) {
 	log.Debug("LoadMagnet: %v", magnet)
+	done := metrics.MagnetStarted()
+	defer done()
 	torrent, err := c.tc.AddMagnet(magnet)
 	if err != nil {
 		log.Error("Failed to add magnet: %v : %v", magnet, err)
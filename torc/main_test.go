@@ -0,0 +1,123 @@
+package torc
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"ttv/logger"
+
+	tt "github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+const TEST_CATEGORY = "movies"
+
+var (
+	testDir    string
+	testServer *httptest.Server
+)
+
+// TestMain runs http server of ttv on loopback with torrent client which has no dht and no listener,
+// torrents are added from data made up in downloads of TEST_CATEGORY
+func TestMain(m *testing.M) {
+	log = &logger.Log{}
+	log.InitLogger(ioutil.Discard)
+	var err error
+	if testDir, err = ioutil.TempDir("", "torc-test"); err != nil {
+		panic(err)
+	}
+	for _, d := range []string{"torrents/" + TEST_CATEGORY, "downloads/" + TEST_CATEGORY, "db", "cache"} {
+		if err := os.MkdirAll(path.Join(testDir, d), 0755); err != nil {
+			panic(err)
+		}
+	}
+	categories[TEST_CATEGORY] = &tCategory{
+		name:     TEST_CATEGORY,
+		fullpath: path.Join(testDir, "torrents", TEST_CATEGORY),
+		download: path.Join(testDir, "downloads", TEST_CATEGORY),
+		ready:    true,
+	}
+	for k, v := range map[string]string{
+		"TC_AUTHFILE":    path.Join(testDir, "auth.yaml"),
+		"TC_SHAREFILE":   path.Join(testDir, "shares.yaml"),
+		"TC_HISTORYFILE": path.Join(testDir, "history.yaml"),
+		"TC_CACHEDIR":    path.Join(testDir, "cache"),
+		"TC_DLNA":        "yes",
+		"TC_DLNA_NAME":   "ttv test",
+	} {
+		os.Setenv(k, v)
+	}
+
+	torClient.KodiCategory = TEST_CATEGORY
+	torClient.torrents = make([]*TorrentWithUserData, 0)
+	torClient.cfg = tt.NewDefaultClientConfig()
+	torClient.cfg.DefaultStorage = storage.NewFileWithCustomPathMaker(path.Join(testDir, "db"), customPathMaker)
+	torClient.cfg.NoDHT = true
+	torClient.cfg.ListenPort = 0
+	if torClient.tc, err = tt.NewClient(torClient.cfg); err != nil {
+		panic(err)
+	}
+	NewHttpServer(&torClient)
+	testServer = httptest.NewServer(rr)
+
+	code := m.Run()
+	testServer.Close()
+	torClient.tc.Close()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+// makeTorrent writes files of given sizes under dir/name and returns .torrent of them
+func makeTorrent(t *testing.T, dir string, name string, files map[string]int) []byte {
+	t.Helper()
+	root := path.Join(dir, name)
+	for f, size := range files {
+		p := path.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		rand.Read(data)
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info := metainfo.Info{PieceLength: 16 << 10}
+	if err := info.BuildFromFilePath(root); err != nil {
+		t.Fatal(err)
+	}
+	mi := metainfo.MetaInfo{}
+	var err error
+	if mi.InfoBytes, err = bencode.Marshal(info); err != nil {
+		t.Fatal(err)
+	}
+	data, err := bencode.Marshal(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// addTestTorrent adds torrent with its data complete in downloads of TEST_CATEGORY, it's removed
+// when test is over
+func addTestTorrent(t *testing.T, name string, files map[string]int) *TorrentWithUserData {
+	t.Helper()
+	cat, _ := GetCategory(TEST_CATEGORY)
+	data := makeTorrent(t, cat.download, name, files)
+	tu, err := tc.AddTorrentFromData(TEST_CATEGORY, name, data, &Tags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tu.torrent.VerifyData()
+	t.Cleanup(func() {
+		tc.RemoveTorrent(tu.Name)
+		os.RemoveAll(path.Join(cat.download, name))
+	})
+	return tu
+}
@@ -0,0 +1,301 @@
+package torc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// piecesComplete tells if bytes [off, off+n) of file are downloaded already
+func (f *TorrentFile) piecesComplete(off int64, n int64) bool {
+	t := f.Tud.torrent
+	pl := t.Info().PieceLength
+	begin := f.file.Offset() + off
+	for p := begin / pl; p*pl < begin+n; p++ {
+		if !t.PieceState(int(p)).Complete {
+			return false
+		}
+	}
+	return true
+}
+
+// readComplete reads n bytes at off only if they are downloaded, it never makes torrent fetch anything
+func (f *TorrentFile) readComplete(off int64, n int64) []byte {
+	if off < 0 {
+		off = 0
+	}
+	if off+n > f.file.Length() {
+		n = f.file.Length() - off
+	}
+	if n <= 0 || !f.piecesComplete(off, n) {
+		return nil
+	}
+	rdr := f.file.NewReader()
+	defer rdr.Close()
+	rdr.SetReadahead(0)
+	if _, err := rdr.Seek(off, io.SeekStart); err != nil {
+		return nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rdr, buf); err != nil {
+		log.Warn("failed to read %d bytes at %d of %s: %v", n, off, f.file.DisplayPath(), err)
+		return nil
+	}
+	return buf
+}
+
+// Duration in seconds from container header, 0 if it's unknown yet. only start and end of file
+// are looked at, PrepareForPlay downloads them
+func (f *TorrentFile) Duration() float64 {
+	f.cacheLock.Lock()
+	defer f.cacheLock.Unlock()
+	if f.duration > 0 {
+		return f.duration
+	}
+	pl := f.Tud.torrent.Info().PieceLength
+	for i, region := range [][2]int64{
+		{0, pl * LOAD_FROM_START},
+		{f.file.Length() - pl*LOAD_FROM_END, pl * LOAD_FROM_END},
+	} {
+		if f.durationLooked[i] {
+			continue
+		}
+		data := f.readComplete(region[0], region[1])
+		if data == nil {
+			continue
+		}
+		f.durationLooked[i] = true
+		if d := mp4Duration(data); d > 0 {
+			f.duration = d
+		} else if d := mkvDuration(data); d > 0 {
+			f.duration = d
+		}
+		if f.duration > 0 {
+			break
+		}
+	}
+	return f.duration
+}
+
+// setDuration keeps duration found first
+func (f *TorrentFile) setDuration(d float64) {
+	f.cacheLock.Lock()
+	defer f.cacheLock.Unlock()
+	if f.duration == 0 {
+		f.duration = d
+	}
+}
+
+// mp4Duration finds movie header box, it's the first one in moov
+func mp4Duration(data []byte) float64 {
+	i := bytes.Index(data, []byte("mvhd"))
+	if i < 0 || i+4+32 > len(data) {
+		return 0
+	}
+	box := data[i+4:]
+	var timescale, duration uint64
+	if box[0] == 1 {
+		timescale = uint64(binary.BigEndian.Uint32(box[20:24]))
+		duration = binary.BigEndian.Uint64(box[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(box[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(box[16:20]))
+	}
+	if timescale == 0 || duration == 0 || duration == math.MaxUint32 || duration == math.MaxUint64 {
+		return 0
+	}
+	return float64(duration) / float64(timescale)
+}
+
+var (
+	mkvInfoId          = []byte{0x15, 0x49, 0xa9, 0x66}
+	mkvTimecodeScaleId = []byte{0x2a, 0xd7, 0xb1}
+	mkvDurationId      = []byte{0x44, 0x89}
+)
+
+// ebmlSize reads variable size integer, returns value and its length
+func ebmlSize(data []byte) (uint64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	l := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		l++
+	}
+	if l > len(data) {
+		return 0, 0
+	}
+	v := uint64(data[0] & (0xff >> uint(l)))
+	for _, b := range data[1:l] {
+		v = v<<8 | uint64(b)
+	}
+	return v, l
+}
+
+// mkvDuration looks into Segment Info: Duration is float in TimecodeScale units, nanoseconds
+func mkvDuration(data []byte) float64 {
+	i := bytes.Index(data, mkvInfoId)
+	if i < 0 {
+		return 0
+	}
+	size, l := ebmlSize(data[i+4:])
+	if l == 0 {
+		return 0
+	}
+	info := data[i+4+l:]
+	if uint64(len(info)) > size {
+		info = info[:size]
+	}
+	scale := uint64(1000000)
+	if j := bytes.Index(info, mkvTimecodeScaleId); j >= 0 {
+		if n, l := ebmlSize(info[j+3:]); l > 0 && n <= 8 && j+3+l+int(n) <= len(info) {
+			scale = 0
+			for _, b := range info[j+3+l : j+3+l+int(n)] {
+				scale = scale<<8 | uint64(b)
+			}
+		}
+	}
+	j := bytes.Index(info, mkvDurationId)
+	if j < 0 {
+		return 0
+	}
+	n, l := ebmlSize(info[j+2:])
+	if l == 0 || j+2+l+int(n) > len(info) {
+		return 0
+	}
+	v := info[j+2+l : j+2+l+int(n)]
+	var d float64
+	switch n {
+	case 4:
+		d = float64(math.Float32frombits(binary.BigEndian.Uint32(v)))
+	case 8:
+		d = math.Float64frombits(binary.BigEndian.Uint64(v))
+	default:
+		return 0
+	}
+	return d * float64(scale) / 1e9
+}
+
+// readFunc returns n bytes at off or less if file ends there, nil if they can't be read
+type readFunc func(off int64, n int64) []byte
+
+// mp4Moov walks top level boxes, header of each one is read only, returns offset and size of movie box.
+// moov is either right after ftyp or after mdat at the end of file
+func mp4Moov(read readFunc, size int64) (int64, int64) {
+	for off, i := int64(0), 0; off+8 <= size && i < 64; i++ {
+		h := read(off, 16)
+		if len(h) < 8 {
+			return 0, 0
+		}
+		typ := string(h[4:8])
+		if i == 0 && typ != "ftyp" {
+			return 0, 0
+		}
+		bs := int64(binary.BigEndian.Uint32(h[0:4]))
+		switch {
+		case bs == 1 && len(h) == 16:
+			bs = int64(binary.BigEndian.Uint64(h[8:16]))
+		case bs == 0:
+			bs = size - off
+		}
+		if bs < 8 {
+			return 0, 0
+		}
+		if typ == "moov" {
+			if off+bs > size {
+				bs = size - off
+			}
+			return off, bs
+		}
+		off += bs
+	}
+	return 0, 0
+}
+
+var (
+	ebmlMagic        = []byte{0x1a, 0x45, 0xdf, 0xa3}
+	mkvSegmentId     = []byte{0x18, 0x53, 0x80, 0x67}
+	mkvSeekHeadId    = []byte{0x11, 0x4d, 0x9b, 0x74}
+	mkvSeekIdId      = []byte{0x53, 0xab}
+	mkvSeekPosId     = []byte{0x53, 0xac}
+	mkvCuesId        = []byte{0x1c, 0x53, 0xbb, 0x6b}
+	mkvCuesHeaderLen = int64(12)
+)
+
+// mkvCues finds Cues through SeekHead in head of file, returns offset and size of cues element.
+// cues is where players look for keyframes when seeking, muxers put it at the end
+func mkvCues(head []byte, read readFunc, size int64) (int64, int64) {
+	if !bytes.HasPrefix(head, ebmlMagic) {
+		return 0, 0
+	}
+	i := bytes.Index(head, mkvSegmentId)
+	if i < 0 {
+		return 0, 0
+	}
+	_, l := ebmlSize(head[i+4:])
+	if l == 0 {
+		return 0, 0
+	}
+	segment := int64(i + 4 + l)
+	j := bytes.Index(head[segment:], mkvSeekHeadId)
+	if j < 0 {
+		return 0, 0
+	}
+	seekHead := head[segment+int64(j)+4:]
+	n, l := ebmlSize(seekHead)
+	if l == 0 {
+		return 0, 0
+	}
+	if seekHead = seekHead[l:]; uint64(len(seekHead)) > n {
+		seekHead = seekHead[:n]
+	}
+	var pos int64 = -1
+	for rest := seekHead; pos < 0; {
+		k := bytes.Index(rest, mkvSeekIdId)
+		if k < 0 {
+			break
+		}
+		seek := rest[k+2:]
+		idLen, l := ebmlSize(seek)
+		if l == 0 || uint64(len(seek)) < uint64(l)+idLen {
+			break
+		}
+		id := seek[l : uint64(l)+idLen]
+		rest = seek[uint64(l)+idLen:]
+		if !bytes.Equal(id, mkvCuesId) {
+			continue
+		}
+		// position follows id in the same Seek
+		p := bytes.Index(rest, mkvSeekPosId)
+		if p < 0 {
+			break
+		}
+		pn, l := ebmlSize(rest[p+2:])
+		if l == 0 || pn > 8 || p+2+l+int(pn) > len(rest) {
+			break
+		}
+		pos = 0
+		for _, b := range rest[p+2+l : p+2+l+int(pn)] {
+			pos = pos<<8 | int64(b)
+		}
+	}
+	if pos < 0 || segment+pos >= size {
+		return 0, 0
+	}
+	off := segment + pos
+	h := read(off, mkvCuesHeaderLen)
+	if len(h) < 5 || !bytes.Equal(h[:4], mkvCuesId) {
+		return 0, 0
+	}
+	cn, l := ebmlSize(h[4:])
+	// all ones is unknown size, cues run to the end then
+	if l == 0 || cn == 1<<uint(7*l)-1 {
+		return off, size - off
+	}
+	n64 := int64(4+l) + int64(cn)
+	if off+n64 > size {
+		n64 = size - off
+	}
+	return off, n64
+}
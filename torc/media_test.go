@@ -0,0 +1,23 @@
+package torc
+
+import (
+	"testing"
+)
+
+func TestDurationNotFoundIsRemembered(t *testing.T) {
+	tu := addTestTorrent(t, "Noise", map[string]int{"noise.mkv": 100000})
+	f := tu.GetFile(0)
+	if d := f.Duration(); d != 0 {
+		t.Fatalf("duration %f of random data", d)
+	}
+	if !f.durationLooked[0] || !f.durationLooked[1] {
+		t.Errorf("complete head and tail aren't marked as looked at: %v", f.durationLooked)
+	}
+}
+
+func TestCapIndex(t *testing.T) {
+	tu := addTestTorrent(t, "Index", map[string]int{"index.mp4": 1000})
+	if n := capIndex(tu.GetFile(0), "moov", 1<<40); n != MAX_INDEX_SIZE {
+		t.Errorf("%d bytes of moov, want %d", n, MAX_INDEX_SIZE)
+	}
+}
@@ -0,0 +1,352 @@
+package torc
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// seconds, streams are not observed, see streamingRoutes
+var HTTP_LATENCY_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+var MAGNET_LATENCY_BUCKETS = []float64{1, 2, 5, 10, 20, 30, 60, 120, 300, 600}
+
+// routes which last as long as player or client keeps them open
+var streamingRoutes = map[string]bool{
+	"/play/{name}/{file}":            true,
+	"/share/{id}/{exp}/{sig}/{name}": true,
+	"/api/events":                    true,
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type metricsRegistry struct {
+	cacheHits      uint64
+	cacheMisses    uint64
+	magnetsPending int64
+	magnetLatency  *histogram
+	fswEvents      map[string]uint64
+	httpLatency    map[string]*histogram // key is rendered labels
+	sync.Mutex
+}
+
+var metrics = metricsRegistry{
+	magnetLatency: newHistogram(MAGNET_LATENCY_BUCKETS),
+	fswEvents:     make(map[string]uint64),
+	httpLatency:   make(map[string]*histogram),
+}
+
+func (m *metricsRegistry) CacheHit(hit bool) {
+	if hit {
+		atomic.AddUint64(&m.cacheHits, 1)
+	} else {
+		atomic.AddUint64(&m.cacheMisses, 1)
+	}
+}
+
+// MagnetStarted returns func to call when resolution is done
+func (m *metricsRegistry) MagnetStarted() func() {
+	atomic.AddInt64(&m.magnetsPending, 1)
+	started := time.Now()
+	return func() {
+		atomic.AddInt64(&m.magnetsPending, -1)
+		m.Lock()
+		m.magnetLatency.observe(time.Since(started).Seconds())
+		m.Unlock()
+	}
+}
+
+func (m *metricsRegistry) FswEvent(op string) {
+	m.Lock()
+	m.fswEvents[op]++
+	m.Unlock()
+}
+
+func (m *metricsRegistry) HttpRequest(route string, method string, code int, d time.Duration) {
+	key := labels("route", route, "method", method, "code", strconv.Itoa(code))
+	m.Lock()
+	defer m.Unlock()
+	h, ok := m.httpLatency[key]
+	if !ok {
+		h = newHistogram(HTTP_LATENCY_BUCKETS)
+		m.httpLatency[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// labels renders k, v pairs as {k="v",...}
+func labels(kv ...string) string {
+	if len(kv) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+		pairs = append(pairs, kv[i]+`="`+v+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metricsWriter writes HELP/TYPE once per metric name
+type metricsWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+func (mw *metricsWriter) metric(name string, kind string, help string) {
+	if mw.seen[name] {
+		return
+	}
+	mw.seen[name] = true
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (mw *metricsWriter) sample(name string, lbls string, v float64) {
+	fmt.Fprintf(mw.w, "%s%s %s\n", name, lbls, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (mw *metricsWriter) gauge(name string, help string, lbls string, v float64) {
+	mw.metric(name, "gauge", help)
+	mw.sample(name, lbls, v)
+}
+
+func (mw *metricsWriter) counter(name string, help string, lbls string, v float64) {
+	mw.metric(name, "counter", help)
+	mw.sample(name, lbls, v)
+}
+
+// histogram takes labels without braces so le can be appended
+func (mw *metricsWriter) histogram(name string, help string, lbls string, h *histogram) {
+	mw.metric(name, "histogram", help)
+	prefix := ""
+	if lbls != "" {
+		prefix = strings.TrimSuffix(lbls, "}")[1:] + ","
+	}
+	for i, b := range h.buckets {
+		mw.sample(name+"_bucket", "{"+prefix+`le="`+strconv.FormatFloat(b, 'g', -1, 64)+`"}`, float64(h.counts[i]))
+	}
+	mw.sample(name+"_bucket", "{"+prefix+`le="+Inf"}`, float64(h.count))
+	mw.sample(name+"_sum", lbls, h.sum)
+	mw.sample(name+"_count", lbls, float64(h.count))
+}
+
+// per torrent families, values of a torrent are in the same order
+var torrentMetricFamilies = []struct{ name, kind, help string }{
+	{"ttv_torrent_downloaded_bytes_total", "counter", "Useful bytes downloaded by torrent."},
+	{"ttv_torrent_uploaded_bytes_total", "counter", "Bytes uploaded by torrent."},
+	{"ttv_torrent_download_rate_bytes", "gauge", "Download rate of torrent, bytes per second."},
+	{"ttv_torrent_upload_rate_bytes", "gauge", "Upload rate of torrent, bytes per second."},
+	{"ttv_torrent_peers", "gauge", "Active peers of torrent."},
+	{"ttv_torrent_seeders", "gauge", "Connected seeders of torrent."},
+	{"ttv_torrent_completion_ratio", "gauge", "Completed part of torrent, 0 to 1."},
+	{"ttv_torrent_size_bytes", "gauge", "Size of torrent."},
+	{"ttv_torrent_paused", "gauge", "1 if torrent is paused."},
+	{"ttv_torrent_readers", "gauge", "Open file readers of torrent."},
+}
+
+type torrentMetricValues struct {
+	labels string
+	values []float64
+}
+
+// writeTorrentMetrics collects all torrents first so each family is written as one group
+func writeTorrentMetrics(mw *metricsWriter) {
+	var downloaded, uploaded int64
+	var dlRate, ulRate, peers, seeders, plays, readers, count int
+	rows := make([]torrentMetricValues, 0)
+	for _, tu := range tc.GetTorrents() {
+		if tu == nil || tu.Dead {
+			continue
+		}
+		count++
+		if tu.torrent == nil || !tu.InfoReady {
+			continue
+		}
+		st := tu.torrent.Stats()
+		l := labels("name", tu.Name, "infohash", tu.torrent.InfoHash().HexString(), "category", tu.Tags.getString("category", ""))
+		ur := tu.UploadRate()
+		dr := 0
+		if !tu.Paused && !tu.Completed() {
+			dr = tu.dl_rate
+		}
+		r := tu.ActiveReaders()
+		completion := 1.0
+		if tu.torrent.Length() > 0 {
+			completion = float64(tu.torrent.BytesCompleted()) / float64(tu.torrent.Length())
+		}
+		rows = append(rows, torrentMetricValues{l, []float64{
+			float64(st.BytesReadUsefulData.Int64()),
+			float64(st.BytesWrittenData.Int64()),
+			float64(dr),
+			float64(ur),
+			float64(st.ActivePeers),
+			float64(st.ConnectedSeeders),
+			completion,
+			float64(tu.torrent.Length()),
+			boolMetric(tu.Paused),
+			float64(r),
+		}})
+		downloaded += st.BytesReadUsefulData.Int64()
+		uploaded += st.BytesWrittenData.Int64()
+		dlRate += dr
+		ulRate += ur
+		peers += st.ActivePeers
+		seeders += st.ConnectedSeeders
+		readers += r
+		if r > 0 {
+			plays++
+		}
+	}
+	for i, f := range torrentMetricFamilies {
+		for _, row := range rows {
+			mw.metric(f.name, f.kind, f.help)
+			mw.sample(f.name, row.labels, row.values[i])
+		}
+	}
+	mw.gauge("ttv_torrents", "Torrents in client.", "", float64(count))
+	mw.counter("ttv_downloaded_bytes_total", "Useful bytes downloaded by torrents in client.", "", float64(downloaded))
+	mw.counter("ttv_uploaded_bytes_total", "Bytes uploaded by torrents in client.", "", float64(uploaded))
+	mw.gauge("ttv_download_rate_bytes", "Download rate, bytes per second.", "", float64(dlRate))
+	mw.gauge("ttv_upload_rate_bytes", "Upload rate, bytes per second.", "", float64(ulRate))
+	mw.gauge("ttv_peers", "Active peers.", "", float64(peers))
+	mw.gauge("ttv_seeders", "Connected seeders.", "", float64(seeders))
+	mw.gauge("ttv_plays", "Torrents with open readers.", "", float64(plays))
+	mw.gauge("ttv_readers", "Open file readers.", "", float64(readers))
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func _Metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	mw := &metricsWriter{w: bw, seen: map[string]bool{}}
+
+	writeTorrentMetrics(mw)
+	mw.gauge("ttv_magnets_resolving", "Magnets waiting on metainfo in MagnetLoader.", "", float64(atomic.LoadInt64(&metrics.magnetsPending)))
+	if tc.cw != nil {
+		mw.gauge("ttv_file_events_queued", "Category file events waiting to be processed.", "", float64(len(tc.cw)))
+	}
+	mw.counter("ttv_cache_hits_total", "Cache reads served from cache.", "", float64(atomic.LoadUint64(&metrics.cacheHits)))
+	mw.counter("ttv_cache_misses_total", "Cache reads not found or expired.", "", float64(atomic.LoadUint64(&metrics.cacheMisses)))
+
+	names := make([]string, 0)
+	for name := range GetCategories() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if cat, ok := GetCategory(name); ok && cat.download != "" {
+			if free := diskFree(cat.download); free >= 0 {
+				mw.gauge("ttv_disk_free_bytes", "Free space in category download dir.", labels("category", name, "dir", cat.download), float64(free))
+			}
+		}
+	}
+
+	metrics.Lock()
+	mw.histogram("ttv_magnet_resolve_seconds", "Time to resolve magnet metainfo.", "", metrics.magnetLatency)
+	ops := make([]string, 0)
+	for op := range metrics.fswEvents {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		mw.counter("ttv_fsnotify_events_total", "Filesystem events in torrents dir.", labels("op", op), float64(metrics.fswEvents[op]))
+	}
+	keys := make([]string, 0)
+	for k := range metrics.httpLatency {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mw.histogram("ttv_http_request_duration_seconds", "HTTP request latency by route.", k, metrics.httpLatency[k])
+	}
+	metrics.Unlock()
+	bw.Flush()
+}
+
+// statusWriter keeps Flusher and Hijacker of wrapped writer, events and logs stream through it
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := s.ResponseWriter.(http.Hijacker); ok {
+		s.status = http.StatusSwitchingProtocols
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("hijack is not supported")
+}
+
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		route := r.URL.Path
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if t, err := cr.GetPathTemplate(); err == nil {
+				route = t
+			}
+		}
+		if streamingRoutes[route] || (route == API_PREFIX+"/logs" && followLogs(r)) {
+			return
+		}
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		metrics.HttpRequest(route, r.Method, sw.status, time.Since(started))
+	})
+}
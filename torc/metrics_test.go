@@ -0,0 +1,45 @@
+package torc
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsFamiliesAreContiguous(t *testing.T) {
+	addTestTorrent(t, "Metrics One", map[string]int{"a.mkv": 20000})
+	addTestTorrent(t, "Metrics Two", map[string]int{"b.mkv": 0, "c.mkv": 1000})
+	resp, err := http.Get(testServer.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	done := map[string]bool{}
+	current := ""
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := strings.FieldsFunc(line, func(r rune) bool { return r == '{' || r == ' ' })[0]
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			name = strings.TrimSuffix(name, suffix)
+		}
+		if strings.Contains(line, "NaN") {
+			t.Errorf("NaN in %s", line)
+		}
+		if name == current {
+			continue
+		}
+		if done[name] {
+			t.Errorf("%s is split in several groups", name)
+		}
+		done[current] = true
+		current = name
+	}
+	if !done["ttv_torrent_completion_ratio"] {
+		t.Errorf("no torrent metrics")
+	}
+}
@@ -0,0 +1,98 @@
+package torc
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// players care about these, system mime.types often has them wrong or missing
+var mediaTypes = map[string]string{
+	".mkv":  "video/x-matroska",
+	".mk3d": "video/x-matroska",
+	".mka":  "audio/x-matroska",
+	".webm": "video/webm",
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".m4a":  "audio/mp4",
+	".mov":  "video/quicktime",
+	".avi":  "video/x-msvideo",
+	".wmv":  "video/x-ms-wmv",
+	".flv":  "video/x-flv",
+	".ts":   "video/mp2t",
+	".m2ts": "video/mp2t",
+	".mts":  "video/mp2t",
+	".mpg":  "video/mpeg",
+	".mpeg": "video/mpeg",
+	".vob":  "video/mpeg",
+	".ogv":  "video/ogg",
+	".mp3":  "audio/mpeg",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".srt":  "application/x-subrip",
+	".vtt":  "text/vtt",
+	".ass":  "text/x-ssa",
+	".ssa":  "text/x-ssa",
+	".sub":  "text/plain",
+	".nfo":  "text/plain",
+	".txt":  "text/plain; charset=utf-8",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+}
+
+// SNIFF_SIZE is what http.DetectContentType looks at
+const SNIFF_SIZE = 512
+
+// mimeByExtension returns empty string for unknown extensions
+func mimeByExtension(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	if t, ok := mediaTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// sniffMime knows video containers http.DetectContentType doesn't tell apart,
+// returns application/octet-stream if nothing matched
+func sniffMime(data []byte) string {
+	switch {
+	case len(data) >= 4 && bytes.Equal(data[:4], []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		if bytes.Contains(data, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		if string(data[8:11]) == "qt " {
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "AVI ":
+		return "video/x-msvideo"
+	case len(data) > 188 && data[0] == 0x47 && data[188] == 0x47:
+		return "video/mp2t"
+	case len(data) >= 4 && bytes.Equal(data[:4], []byte{0x00, 0x00, 0x01, 0xba}):
+		return "video/mpeg"
+	case len(data) >= 3 && string(data[:3]) == "FLV":
+		return "video/x-flv"
+	}
+	return http.DetectContentType(data)
+}
+
+// contentDisposition has ascii fallback for old players and RFC 5987 filename* for the rest
+func contentDisposition(kind string, name string) string {
+	ascii := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	return kind + `; filename="` + ascii + `"; filename*=UTF-8''` + url.PathEscape(name)
+}
@@ -0,0 +1,356 @@
+package torc
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const OPENAPI_VERSION = "3.0.3"
+const API_VERSION = "2.0.0"
+
+// apiDoc describes one route, key in apiDocs is "METHOD /path/template"
+type apiDoc struct {
+	Summary  string
+	Query    []string
+	Body     interface{}
+	BodyType string
+	Response interface{}
+	Status   int
+}
+
+// schemas are generated from these, so spec follows the structs
+var apiSchemas = []interface{}{
+	TorrentInfo{},
+	TorrentFileInfo{},
+	SubtitleInfo{},
+	PrepareInfo{},
+	PlaySession{},
+	WatchState{},
+	ArbiterInfo{},
+	ArbiterStream{},
+	ArbiterDecision{},
+	FilePieces{},
+	PieceRun{},
+	PieceRange{},
+	BufferInfo{},
+	CategoryInfo{},
+	TrackerInfo{},
+	AddTorrentRequest{},
+	AddTorrentResponse{},
+	CreateTorrentRequest{},
+	CreateTorrentResponse{},
+	ImportRequest{},
+	ImportItem{},
+	ImportResponse{},
+	StatusResponse{},
+	BusEvent{},
+	AuthToken{},
+	ShareLink{},
+	ShareLinkResponse{},
+	httpE{},
+}
+
+var apiDocs = map[string]apiDoc{
+	"GET /":                                              {Summary: "web dashboard", BodyType: "text/html"},
+	"GET /list":                                          {Summary: "all torrents", Response: struct{ Torrents []TorrentInfo }{}},
+	"GET /torrent_file_list":                             {Summary: "find torrent by name, adds it from link when not found", Query: []string{"name", "link"}, Response: TorrentInfo{}},
+	"GET /playPrepare/{name}/{file}":                     {Summary: "start fetching file for play, progress is in Prepare of file info", Response: StatusResponse{}, Status: http.StatusAccepted},
+	"GET /torrentStatus/{name}":                          {Summary: "torrent status", Response: TorrentInfo{}},
+	"GET /play/{name}/{file}":                            {Summary: "stream file, supports Range and conditional requests, HEAD has the same headers, download=yes for attachment, exp and sig of signed links stand for token", Query: []string{"download", "exp", "sig"}, BodyType: "application/octet-stream"},
+	"GET /tag/{name}":                                    {Summary: "add tags given as query parameters"},
+	"GET /watchLaterList":                                {Summary: "not implemented"},
+	"GET /api/tmdb":                                      {Summary: "cached TMDB proxy", Query: []string{"path", "ttl"}},
+	"GET /api/jacket":                                    {Summary: "cached Jackett proxy", Query: []string{"path", "ttl"}},
+	"GET /api/events":                                    {Summary: "event stream, SSE or WebSocket on Upgrade", Query: []string{"torrent", "type", "last_id"}, Response: BusEvent{}, BodyType: "text/event-stream"},
+	"GET /api/openapi.json":                              {Summary: "this document"},
+	"GET /healthz":                                       {Summary: "process is alive", Response: StatusResponse{}},
+	"GET /readyz":                                        {Summary: "categories scanned, torrent client listening, watcher ok, storage writable; 503 if not", Response: ReadyResponse{}},
+	"HEAD /healthz":                                      {Summary: "process is alive, no body"},
+	"HEAD /readyz":                                       {Summary: "ready as GET /readyz tells, no body"},
+	"GET /debug/status":                                  {Summary: "goroutines and torrent client status as plain text", BodyType: "text/plain"},
+	"GET /debug/pprof/":                                  {Summary: "pprof index and named profiles, /debug/pprof/{profile}", BodyType: "text/plain"},
+	"GET /debug/pprof/cmdline":                           {Summary: "pprof command line", BodyType: "text/plain"},
+	"GET /debug/pprof/profile":                           {Summary: "pprof cpu profile", Query: []string{"seconds"}, BodyType: "application/octet-stream"},
+	"GET /debug/pprof/symbol":                            {Summary: "pprof symbol lookup", BodyType: "text/plain"},
+	"GET /debug/pprof/trace":                             {Summary: "execution trace", Query: []string{"seconds"}, BodyType: "application/octet-stream"},
+	"GET /metrics":                                       {Summary: "Prometheus metrics: torrents, cache, magnets, fsnotify, http latency, free disk", BodyType: "text/plain"},
+	"POST /qbittorrent/api/v2/auth/login":                {Summary: "qBittorrent login, user and password from auth config or token as password, sets SID cookie", Query: []string{"username", "password"}, BodyType: "text/plain"},
+	"POST /qbittorrent/api/v2/auth/logout":               {Summary: "qBittorrent logout", BodyType: "text/plain"},
+	"GET /qbittorrent/api/v2/app/version":                {Summary: "qBittorrent version we pretend to be", BodyType: "text/plain"},
+	"GET /qbittorrent/api/v2/app/webapiVersion":          {Summary: "qBittorrent web api version", BodyType: "text/plain"},
+	"GET /qbittorrent/api/v2/app/preferences":            {Summary: "qBittorrent preferences", Response: map[string]interface{}{}},
+	"GET /qbittorrent/api/v2/app/defaultSavePath":        {Summary: "download dir of default category", BodyType: "text/plain"},
+	"GET /qbittorrent/api/v2/transfer/info":              {Summary: "qBittorrent global transfer info", Response: map[string]interface{}{}},
+	"GET /qbittorrent/api/v2/torrents/info":              {Summary: "qBittorrent torrents list", Query: []string{"filter", "category", "tag", "hashes", "sort", "reverse", "limit", "offset"}, Response: []qbTorrentInfo{}},
+	"GET /qbittorrent/api/v2/torrents/properties":        {Summary: "qBittorrent torrent properties", Query: []string{"hash"}, Response: map[string]interface{}{}},
+	"GET /qbittorrent/api/v2/torrents/files":             {Summary: "qBittorrent torrent files", Query: []string{"hash"}, Response: []map[string]interface{}{}},
+	"GET /qbittorrent/api/v2/torrents/trackers":          {Summary: "qBittorrent torrent trackers", Query: []string{"hash"}, Response: []map[string]interface{}{}},
+	"POST /qbittorrent/api/v2/torrents/add":              {Summary: "qBittorrent add, urls one per line and torrents files, savepath picks category", Query: []string{"urls", "category", "savepath", "tags", "paused", "rename"}, BodyType: "text/plain"},
+	"POST /qbittorrent/api/v2/torrents/pause":            {Summary: "qBittorrent pause, hashes separated by | or all", Query: []string{"hashes"}, BodyType: "text/plain"},
+	"POST /qbittorrent/api/v2/torrents/stop":             {Summary: "qBittorrent 5 name of pause", Query: []string{"hashes"}, BodyType: "text/plain"},
+	"POST /qbittorrent/api/v2/torrents/resume":           {Summary: "qBittorrent resume", Query: []string{"hashes"}, BodyType: "text/plain"},
+	"POST /qbittorrent/api/v2/torrents/start":            {Summary: "qBittorrent 5 name of resume", Query: []string{"hashes"}, BodyType: "text/plain"},
+	"POST /qbittorrent/api/v2/torrents/delete":           {Summary: "qBittorrent delete", Query: []string{"hashes", "deleteFiles"}, BodyType: "text/plain"},
+	"GET /qbittorrent/api/v2/torrents/categories":        {Summary: "qBittorrent categories, ttv categories with download dir as savePath", Response: map[string]qbCategory{}},
+	"POST /qbittorrent/api/v2/torrents/createCategory":   {Summary: "create category dir, savePath is ignored", Query: []string{"category"}, BodyType: "text/plain"},
+	"POST /qbittorrent/api/v2/torrents/setCategory":      {Summary: "accepted only when category doesn't change, data is not moved", Query: []string{"hashes", "category"}, BodyType: "text/plain"},
+	"GET /qbittorrent/api/v2/torrents/tags":              {Summary: "qBittorrent tags, ttv tags as key or key=value", Response: []string{}},
+	"POST /qbittorrent/api/v2/torrents/createTags":       {Summary: "does nothing, tags exist on torrents only", Query: []string{"tags"}, BodyType: "text/plain"},
+	"POST /qbittorrent/api/v2/torrents/deleteTags":       {Summary: "remove tags from all torrents", Query: []string{"tags"}, BodyType: "text/plain"},
+	"POST /qbittorrent/api/v2/torrents/addTags":          {Summary: "set tags, comma separated key or key=value", Query: []string{"hashes", "tags"}, BodyType: "text/plain"},
+	"POST /qbittorrent/api/v2/torrents/removeTags":       {Summary: "remove tags", Query: []string{"hashes", "tags"}, BodyType: "text/plain"},
+	"GET /api/v2/torrents":                               {Summary: "list torrents", Query: []string{"category"}, Response: []TorrentInfo{}},
+	"POST /api/v2/torrents":                              {Summary: "add torrent from multipart .torrent upload (field torrent), magnet or url, datapath adopts data already in that dir", Body: AddTorrentRequest{}, Response: AddTorrentResponse{}, Status: http.StatusCreated},
+	"GET /api/v2/torrents/{id}":                          {Summary: "torrent by name or infohash", Response: TorrentInfo{}},
+	"POST /api/v2/torrents/create":                       {Summary: "build .torrent of a file or directory inside downloads of category and write it to category dir, it's added and seeded from data in place", Body: CreateTorrentRequest{}, Response: CreateTorrentResponse{}, Status: http.StatusCreated},
+	"DELETE /api/v2/torrents/{id}":                       {Summary: "drop torrent, data=yes removes downloaded data, force=yes doesn't wait for seed_until", Query: []string{"data", "force"}, Status: http.StatusNoContent},
+	"POST /api/v2/torrents/{id}/pause":                   {Summary: "pause torrent", Response: TorrentInfo{}},
+	"POST /api/v2/torrents/{id}/resume":                  {Summary: "resume torrent", Response: TorrentInfo{}},
+	"GET /api/v2/torrents/{id}/files":                    {Summary: "torrent files", Response: []TorrentFileInfo{}},
+	"GET /api/v2/torrents/{id}/files/{index}":            {Summary: "file by index", Response: TorrentFileInfo{}},
+	"GET /api/v2/torrents/{id}/files/{index}/subtitles":  {Summary: "subtitles paired with video file", Response: []SubtitleInfo{}},
+	"PUT /api/v2/torrents/{id}/files/{index}/priority":   {Summary: "set file priority skip, normal or high, it's kept in file_priorities tag; empty priority drops it and category rules apply", Query: []string{"priority"}, Response: TorrentFileInfo{}},
+	"GET /api/v2/torrents/{id}/files/{index}/prepare":    {Summary: "progress of fetching file for play, 404 if it was never prepared", Response: PrepareInfo{}},
+	"POST /api/v2/torrents/{id}/files/{index}/prepare":   {Summary: "fetch container index and first seconds of file for play, wait=yes answers when done and cancels the job if request is gone", Query: []string{"wait"}, Response: PrepareInfo{}, Status: http.StatusAccepted},
+	"DELETE /api/v2/torrents/{id}/files/{index}/prepare": {Summary: "cancel fetching file for play", Status: http.StatusNoContent},
+	"GET /api/v2/torrents/{id}/files/{index}/pieces":     {Summary: "run-length encoded piece map, requested pieces and what readers have buffered ahead; offset or seconds of a seek fill in Seek", Query: []string{"offset", "seconds"}, Response: FilePieces{}},
+	"GET /api/v2/torrents/{id}/files/{index}/watch":      {Summary: "resume position and watched flag of file, 404 if it was never played", Response: WatchState{}},
+	"PUT /api/v2/torrents/{id}/files/{index}/watch":      {Summary: "set resume position in bytes or seconds, watched=yes|no", Query: []string{"position", "seconds", "watched"}, Response: WatchState{}},
+	"DELETE /api/v2/torrents/{id}/files/{index}/watch":   {Summary: "forget watch state of file", Status: http.StatusNoContent},
+	"GET /api/v2/torrents/{id}/tags":                     {Summary: "torrent tags", Response: map[string]interface{}{}},
+	"PATCH /api/v2/torrents/{id}/tags":                   {Summary: "set tags", Body: map[string]string{}, Response: map[string]interface{}{}},
+	"PUT /api/v2/torrents/{id}/tags":                     {Summary: "set tags", Body: map[string]string{}, Response: map[string]interface{}{}},
+	"DELETE /api/v2/torrents/{id}/tags/{key}":            {Summary: "remove tag", Status: http.StatusNoContent},
+	"GET /api/v2/torrents/{id}/trackers":                 {Summary: "torrent trackers", Response: []TrackerInfo{}},
+	"POST /api/v2/torrents/{id}/trackers":                {Summary: "add trackers", Body: []string{}, Response: []TrackerInfo{}},
+	"GET /api/v2/categories":                             {Summary: "list categories", Response: []CategoryInfo{}},
+	"POST /api/v2/categories":                            {Summary: "create category", Query: []string{"name"}, Response: CategoryInfo{}, Status: http.StatusCreated},
+	"GET /api/v2/categories/{name}":                      {Summary: "category by name", Response: CategoryInfo{}},
+	"GET /api/v2/categories/{name}/rules":                {Summary: "file priority globs of category, * is for all categories", Response: FileRules{}},
+	"PUT /api/v2/categories/{name}/rules":                {Summary: "replace file priority globs like {\"skip\": [\"*sample*\", \"*.nfo\"]}; high beats normal beats skip", Body: FileRules{}, Response: FileRules{}},
+	"GET /api/v2/history":                                {Summary: "play sessions newest first, running ones included", Query: []string{"limit", "torrent"}, Response: []PlaySession{}},
+	"GET /api/v2/continue":                               {Summary: "continue watching: last played unfinished file or next episode, one per torrent", Query: []string{"limit"}, Response: []WatchState{}},
+	"GET /api/v2/arbiter":                                {Summary: "bandwidth sharing during playback: stream rates, held and running downloads, recent decisions", Response: ArbiterInfo{}},
+	"POST /api/v2/import":                                {Summary: "import torrents of transmission or qbittorrent from their resume files, data is hash checked and seeded where it is", Body: ImportRequest{}, Response: ImportResponse{}},
+	"GET /api/v2/tokens":                                 {Summary: "api tokens, without secrets", Response: []AuthToken{}},
+	"POST /api/v2/tokens":                                {Summary: "create api token, secret is returned only once. while auth is off only this host may create the first one", Query: []string{"name", "scope"}, Response: AuthToken{}, Status: http.StatusCreated},
+	"DELETE /api/v2/tokens/{name}":                       {Summary: "revoke api token", Status: http.StatusNoContent},
+	"GET /api/v2/logs":                                   {Summary: "server log, last lines and new ones with follow=yes", Query: []string{"lines", "follow"}, BodyType: "text/plain"},
+	"GET /api/v2/shares":                                 {Summary: "share links", Response: []ShareLinkResponse{}},
+	"POST /api/v2/shares":                                {Summary: "create signed share link, rate is bytes/sec, ttl is duration like 48h", Query: []string{"torrent", "file", "ttl", "rate", "streams", "comment"}, Response: ShareLinkResponse{}, Status: http.StatusCreated},
+	"DELETE /api/v2/shares/{id}":                         {Summary: "revoke share link, running streams stop", Status: http.StatusNoContent},
+	"GET /transmission/rpc":                              {Summary: "transmission rpc session handshake, always 409 with X-Transmission-Session-Id", Status: http.StatusConflict},
+	"POST /transmission/rpc":                             {Summary: "transmission rpc: torrent-add, torrent-get, torrent-start, torrent-stop, torrent-remove, session-get, session-stats", Body: trRequest{}, Response: trResponse{}},
+	"GET /subtitles/{name}/{index}":                      {Summary: "subtitle file as is in UTF-8, charset overrides detected code page", Query: []string{"charset"}, BodyType: "text/plain"},
+	"GET /subtitles/{name}/{index}.vtt":                  {Summary: "subtitle converted to WebVTT, srt, ass, ssa and vtt", Query: []string{"charset"}, BodyType: "text/vtt"},
+	"GET /playlist/{name}.{ext}":                         {Summary: "extended M3U of media files in episode order, samples and extras left out, ext is m3u or m3u8, links are signed for a day", BodyType: "application/vnd.apple.mpegurl"},
+	"GET /playlist/category/{category}.{ext}":            {Summary: "extended M3U of files ready to stream in category, grouped by torrent", BodyType: "application/vnd.apple.mpegurl"},
+	"GET /share/{id}/{exp}/{sig}/{name}":                 {Summary: "stream shared file, no auth, supports Range", Query: []string{"download"}, BodyType: "application/octet-stream"},
+	"HEAD /share/{id}/{exp}/{sig}/{name}":                {Summary: "shared file headers", Query: []string{"download"}},
+	"GET /dlna/device.xml":                               {Summary: "UPnP MediaServer device description, TC_DLNA=yes, local network only", BodyType: "text/xml"},
+	"GET /dlna/{service}.xml":                            {Summary: "UPnP service description of ContentDirectory or ConnectionManager", BodyType: "text/xml"},
+	"POST /dlna/control/{service}":                       {Summary: "UPnP SOAP control: Browse, GetSystemUpdateID, GetProtocolInfo and others", BodyType: "text/xml"},
+}
+
+var (
+	reTemplateVar  = regexp.MustCompile(`{([^:}]+)(:[^}]+)?}`)
+	openApiMethods = map[string]bool{"GET": true, "PUT": true, "POST": true, "DELETE": true, "OPTIONS": true, "HEAD": true, "PATCH": true, "TRACE": true}
+)
+
+func _ApiOpenApi(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, OpenApiSpec(rr))
+}
+
+// OpenApiSpec describes every route registered on router, routes without apiDocs entry get generic description
+func OpenApiSpec(router *mux.Router) map[string]interface{} {
+	paths := map[string]map[string]interface{}{}
+	_ = router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil {
+			return nil
+		}
+		// drop regexps from {var:regexp}
+		tmpl = reTemplateVar.ReplaceAllString(tmpl, "{$1}")
+		methods, err := route.GetMethods()
+		if err != nil {
+			// routes registered without Methods accept anything, kodi uses GET
+			methods = []string{"GET"}
+		}
+		if _, ok := paths[tmpl]; !ok {
+			paths[tmpl] = map[string]interface{}{}
+		}
+		for _, m := range methods {
+			if !openApiMethods[m] {
+				// dlna eventing methods, openapi has no place for them
+				continue
+			}
+			doc, ok := apiDocs[m+" "+tmpl]
+			if !ok {
+				log.Warn("route %s %s has no api docs", m, tmpl)
+				doc = apiDoc{Summary: tmpl}
+			}
+			paths[tmpl][strings.ToLower(m)] = openApiOperation(tmpl, doc)
+		}
+		return nil
+	})
+
+	schemas := map[string]interface{}{}
+	for _, v := range apiSchemas {
+		t := reflect.TypeOf(v)
+		schemas[schemaName(t)] = jsonSchema(t, false)
+	}
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":   "ttv",
+			"version": API_VERSION,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+				"basic":  map[string]string{"type": "http", "scheme": "basic"},
+				"header": map[string]string{"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+				"query":  map[string]string{"type": "apiKey", "in": "query", "name": "token"},
+			},
+		},
+		"security": []map[string][]string{{"bearer": {}}, {"basic": {}}, {"header": {}}, {"query": {}}},
+	}
+}
+
+func openApiOperation(tmpl string, doc apiDoc) map[string]interface{} {
+	params := make([]interface{}, 0)
+	for _, m := range reTemplateVar.FindAllStringSubmatch(tmpl, -1) {
+		params = append(params, map[string]interface{}{
+			"name":     m[1],
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]string{"type": "string"},
+		})
+	}
+	for _, q := range doc.Query {
+		params = append(params, map[string]interface{}{
+			"name":   q,
+			"in":     "query",
+			"schema": map[string]string{"type": "string"},
+		})
+	}
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := map[string]interface{}{"description": http.StatusText(status)}
+	contentType := doc.BodyType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	if doc.Response != nil {
+		response["content"] = map[string]interface{}{
+			contentType: map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(doc.Response), true)},
+		}
+	}
+	op := map[string]interface{}{
+		"summary":    doc.Summary,
+		"parameters": params,
+		"responses": map[string]interface{}{
+			strconv.Itoa(status): response,
+			"default": map[string]interface{}{
+				"description": "error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(httpE{}), true)},
+				},
+			},
+		},
+	}
+	if doc.Body != nil {
+		op["requestBody"] = map[string]interface{}{
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(doc.Body), true)},
+			},
+		}
+	}
+	return op
+}
+
+func schemaName(t reflect.Type) string {
+	return t.Name()
+}
+
+func isApiSchema(t reflect.Type) bool {
+	for _, v := range apiSchemas {
+		if reflect.TypeOf(v) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonSchema follows encoding/json rules, known api types are referenced when ref is set
+func jsonSchema(t reflect.Type, ref bool) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if ref && isApiSchema(t) {
+		return map[string]interface{}{"$ref": "#/components/schemas/" + schemaName(t)}
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), true)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), true)}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		required := make([]string, 0)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			omitempty := false
+			if tag := f.Tag.Get("json"); tag != "" {
+				parts := strings.Split(tag, ",")
+				if parts[0] == "-" {
+					continue
+				}
+				if parts[0] != "" {
+					name = parts[0]
+				}
+				for _, p := range parts[1:] {
+					omitempty = omitempty || p == "omitempty"
+				}
+			}
+			props[name] = jsonSchema(f.Type, true)
+			if !omitempty {
+				required = append(required, name)
+			}
+		}
+		sort.Strings(required)
+		rc := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			rc["required"] = required
+		}
+		return rc
+	}
+	// interface{} - anything
+	return map[string]interface{}{}
+}
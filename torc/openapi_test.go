@@ -0,0 +1,60 @@
+package torc
+
+import (
+	"github.com/gorilla/mux"
+	"testing"
+	"ttv/client"
+)
+
+// every route has to be in apiDocs and every apiDocs entry has to be a route
+func TestApiDocsCoverRoutes(t *testing.T) {
+	routes := map[string]bool{}
+	_ = rr.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil {
+			return nil
+		}
+		tmpl = reTemplateVar.ReplaceAllString(tmpl, "{$1}")
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"GET"}
+		}
+		for _, m := range methods {
+			if openApiMethods[m] {
+				routes[m+" "+tmpl] = true
+			}
+		}
+		return nil
+	})
+	for r := range routes {
+		if _, ok := apiDocs[r]; !ok {
+			t.Errorf("route %s has no apiDocs entry", r)
+		}
+	}
+	for d := range apiDocs {
+		if !routes[d] {
+			t.Errorf("apiDocs has %s, there is no such route", d)
+		}
+	}
+}
+
+func TestOpenApiSpecServed(t *testing.T) {
+	c := client.New(testServer.URL)
+	spec, err := c.OpenApi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec["openapi"] != OPENAPI_VERSION {
+		t.Errorf("openapi is %v", spec["openapi"])
+	}
+	paths, _ := spec["paths"].(map[string]interface{})
+	for _, p := range []string{API_PREFIX + "/torrents", API_PREFIX + "/torrents/{id}/files/{index}"} {
+		if _, ok := paths[p]; !ok {
+			t.Errorf("spec has no %s", p)
+		}
+	}
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	if _, ok := schemas["TorrentInfo"]; !ok {
+		t.Errorf("spec has no TorrentInfo schema")
+	}
+}
@@ -0,0 +1,152 @@
+package torc
+
+import (
+	tt "github.com/anacrolix/torrent"
+	"net/http"
+	"strconv"
+	"ttv/client"
+)
+
+type FilePieces = client.FilePieces
+type PieceRun = client.PieceRun
+type PieceRange = client.PieceRange
+type BufferInfo = client.BufferInfo
+
+// piecePriority is empty for pieces nobody asks for
+func piecePriority(ps tt.PieceState) string {
+	switch ps.Priority {
+	case tt.PiecePriorityNormal:
+		return "normal"
+	case tt.PiecePriorityHigh:
+		return "high"
+	case tt.PiecePriorityReadahead:
+		return "readahead"
+	case tt.PiecePriorityNext:
+		return "next"
+	case tt.PiecePriorityNow:
+		return "now"
+	}
+	return ""
+}
+
+func pieceState(ps tt.PieceState) string {
+	switch {
+	case ps.Complete:
+		return "complete"
+	case ps.Checking:
+		return "checking"
+	case ps.Partial:
+		return "partial"
+	}
+	return "missing"
+}
+
+// pieceBounds are first and last piece of torrent file has bytes in, last is before first for empty
+// file, it has no pieces and the first one may be past the end of torrent
+func (f *TorrentFile) pieceBounds() (first int, last int) {
+	pl := f.Tud.torrent.Info().PieceLength
+	first = int(f.file.Offset() / pl)
+	last = first - 1
+	if f.file.Length() > 0 {
+		last = int((f.file.Offset() + f.file.Length() - 1) / pl)
+	}
+	return
+}
+
+// bufferInfo is from off to the first missing piece
+func (f *TorrentFile) bufferInfo(off int64) BufferInfo {
+	rc := BufferInfo{Offset: off, Buffered: f.bufferedFrom(off, 0)}
+	if br := f.Bitrate(); br > 0 {
+		rc.BufferedSeconds = float64(rc.Buffered) / float64(br)
+	}
+	return rc
+}
+
+// Pieces is run-length encoded piece map, what is asked for and what readers have ahead of them
+func (f *TorrentFile) Pieces() FilePieces {
+	t := f.Tud.torrent
+	first, last := f.pieceBounds()
+	rc := FilePieces{
+		Name:        f.file.DisplayPath(),
+		Size:        f.file.Length(),
+		PieceLength: t.Info().PieceLength,
+		FirstPiece:  first,
+		Pieces:      last - first + 1,
+		Runs:        make([]PieceRun, 0),
+		Requested:   make([]PieceRange, 0),
+		Readers:     make([]BufferInfo, 0),
+	}
+	for i := first; i <= last; i++ {
+		ps := t.PieceState(i)
+		state := pieceState(ps)
+		if ps.Complete {
+			rc.Complete++
+		}
+		if n := len(rc.Runs); n > 0 && rc.Runs[n-1].State == state {
+			rc.Runs[n-1].Count++
+		} else {
+			rc.Runs = append(rc.Runs, PieceRun{Count: 1, State: state})
+		}
+		prio := piecePriority(ps)
+		if ps.Complete || prio == "" {
+			continue
+		}
+		if n := len(rc.Requested); n > 0 && rc.Requested[n-1].Priority == prio && rc.Requested[n-1].First+rc.Requested[n-1].Count == i-first {
+			rc.Requested[n-1].Count++
+		} else {
+			rc.Requested = append(rc.Requested, PieceRange{First: i - first, Count: 1, Priority: prio})
+		}
+	}
+	history.Lock()
+	sessions := make([]PlaySession, 0)
+	for _, s := range history.Sessions {
+		if s.Active && s.InfoHash == f.Tud.Tags.getString("infohash", "") && s.File == f.file.DisplayPath() {
+			sessions = append(sessions, *s)
+		}
+	}
+	history.Unlock()
+	for _, s := range sessions {
+		bi := f.bufferInfo(s.Offset)
+		bi.Session, bi.Client = s.Id, s.Client
+		rc.Readers = append(rc.Readers, bi)
+	}
+	return rc
+}
+
+// _apiFilePieces takes offset= (bytes) or seconds= of a seek, Seek tells how much is there from it
+func _apiFilePieces(w http.ResponseWriter, r *http.Request) {
+	f := apiFile(w, r)
+	if f == nil {
+		return
+	}
+	rc := f.Pieces()
+	off := int64(-1)
+	if v := r.FormValue("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 || n > f.file.Length() {
+			httpError(w, http.StatusBadRequest, "bad offset '%s', file has %d bytes", v, f.file.Length())
+			return
+		}
+		off = n
+	}
+	if v := r.FormValue("seconds"); v != "" {
+		sec, err := strconv.ParseFloat(v, 64)
+		if err != nil || sec < 0 {
+			httpError(w, http.StatusBadRequest, "bad seconds '%s'", v)
+			return
+		}
+		br := f.Bitrate()
+		if br == 0 {
+			httpError(w, http.StatusConflict, "duration of %s isn't known yet, use offset in bytes", f.file.DisplayPath())
+			return
+		}
+		if off = int64(sec * float64(br)); off > f.file.Length() {
+			off = f.file.Length()
+		}
+	}
+	if off >= 0 {
+		bi := f.bufferInfo(off)
+		rc.Seek = &bi
+	}
+	writeJson(w, http.StatusOK, rc)
+}
@@ -0,0 +1,20 @@
+package torc
+
+import (
+	"testing"
+)
+
+func TestPiecesOfEmptyFile(t *testing.T) {
+	// zz.txt is the last file, its offset is the end of torrent
+	tu := addTestTorrent(t, "Empty Tail", map[string]int{"a.mkv": 40000, "zz.txt": 0})
+	empty := tu.GetFile("Empty Tail/zz.txt")
+	if empty == nil {
+		t.Fatal("no zz.txt")
+	}
+	if p := empty.Pieces(); p.Pieces != 0 || len(p.Runs) != 0 || p.Complete != 0 {
+		t.Errorf("empty file pieces %+v", p)
+	}
+	if p := tu.GetFile("Empty Tail/a.mkv").Pieces(); p.Pieces != 3 || p.Complete != 3 {
+		t.Errorf("a.mkv pieces %+v", p)
+	}
+}
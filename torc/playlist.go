@@ -0,0 +1,177 @@
+package torc
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	reSeasonEpisode = regexp.MustCompile(`(?i)\bs(\d{1,2})[ ._-]?e(\d{1,3})`)
+	reCrossEpisode  = regexp.MustCompile(`(?i)\b(\d{1,2})x(\d{2,3})\b`)
+	reEpisode       = regexp.MustCompile(`(?i)\b(?:ep?|episode|part)[ ._-]?(\d{1,3})\b`)
+	reTrack         = regexp.MustCompile(`^(\d{1,3})[ ._-]`)
+	// samples and extras are not worth playing one after another
+	reExtra  = regexp.MustCompile(`(?i)(^|[/ ._\-\[(])(sample|trailers?|featurettes?|extras|bonus|behind[ ._-]the[ ._-]scenes|deleted[ ._-]scenes)([/ ._\-\])]|$)`)
+	reDigits = regexp.MustCompile(`\d+|\D+`)
+)
+
+type playlistItem struct {
+	tu      *TorrentWithUserData
+	file    *TorrentFile
+	season  int
+	episode int
+}
+
+// episodeOf returns -1, -1 if name has no episode or track number
+func episodeOf(name string) (season int, episode int) {
+	base := path.Base(name)
+	if m := reSeasonEpisode.FindStringSubmatch(base); m != nil {
+		season, _ = strconv.Atoi(m[1])
+		episode, _ = strconv.Atoi(m[2])
+		return
+	}
+	if m := reCrossEpisode.FindStringSubmatch(base); m != nil {
+		season, _ = strconv.Atoi(m[1])
+		episode, _ = strconv.Atoi(m[2])
+		return
+	}
+	if m := reEpisode.FindStringSubmatch(base); m != nil {
+		episode, _ = strconv.Atoi(m[1])
+		return 0, episode
+	}
+	if m := reTrack.FindStringSubmatch(base); m != nil {
+		episode, _ = strconv.Atoi(m[1])
+		return 0, episode
+	}
+	return -1, -1
+}
+
+// naturalLess compares digit runs as numbers, so "Part 2" goes before "Part 10"
+func naturalLess(a string, b string) bool {
+	ca := reDigits.FindAllString(strings.ToLower(a), -1)
+	cb := reDigits.FindAllString(strings.ToLower(b), -1)
+	for i := 0; i < len(ca) && i < len(cb); i++ {
+		if ca[i] == cb[i] {
+			continue
+		}
+		na, erra := strconv.Atoi(ca[i])
+		nb, errb := strconv.Atoi(cb[i])
+		if erra == nil && errb == nil && na != nb {
+			return na < nb
+		}
+		return ca[i] < cb[i]
+	}
+	return len(ca) < len(cb)
+}
+
+func isPlaylistFile(f *TorrentFile) bool {
+	ct := mimeByExtension(f.file.DisplayPath())
+	if !strings.HasPrefix(ct, "video/") && !strings.HasPrefix(ct, "audio/") {
+		return false
+	}
+	return !reExtra.MatchString(f.file.DisplayPath())
+}
+
+// playlistItems has media files of torrent in episode order, ready only ones if readyOnly is set
+func playlistItems(tu *TorrentWithUserData, readyOnly bool) []playlistItem {
+	rc := make([]playlistItem, 0)
+	if !tu.InfoReady {
+		return rc
+	}
+	completed := tu.Completed()
+	for _, f := range tu.Files() {
+		if !isPlaylistFile(f) {
+			continue
+		}
+		if readyOnly && !(completed || f.Ready() || f.file.BytesCompleted() >= f.file.Length()) {
+			continue
+		}
+		s, e := episodeOf(f.file.DisplayPath())
+		rc = append(rc, playlistItem{tu: tu, file: f, season: s, episode: e})
+	}
+	sort.SliceStable(rc, func(i, j int) bool {
+		a, b := rc[i], rc[j]
+		if a.episode >= 0 && b.episode >= 0 && (a.season != b.season || a.episode != b.episode) {
+			if a.season != b.season {
+				return a.season < b.season
+			}
+			return a.episode < b.episode
+		}
+		return naturalLess(a.file.file.DisplayPath(), b.file.file.DisplayPath())
+	})
+	return rc
+}
+
+func fileTitle(name string) string {
+	base := path.Base(name)
+	base = strings.TrimSuffix(base, path.Ext(base))
+	return strings.TrimSpace(strings.NewReplacer(".", " ", "_", " ").Replace(base))
+}
+
+func writePlaylist(w http.ResponseWriter, r *http.Request, name string, items []playlistItem, groups bool) {
+	if mux.Vars(r)["ext"] == "m3u8" {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	} else {
+		w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Disposition", contentDisposition("inline", name+"."+mux.Vars(r)["ext"]))
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n#PLAYLIST:" + name + "\n")
+	var group *TorrentWithUserData
+	for _, it := range items {
+		duration := -1
+		if d := it.file.Duration(); d > 0 {
+			duration = int(d + 0.5)
+		}
+		if groups && group != it.tu {
+			group = it.tu
+			sb.WriteString("#EXTGRP:" + it.tu.Name + "\n")
+		}
+		fmt.Fprintf(&sb, "#EXTINF:%d,%s\n%s\n", duration, fileTitle(it.file.file.DisplayPath()), playUrl(r, it.tu, it.file))
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+func _Playlist(w http.ResponseWriter, r *http.Request) {
+	name, _ := url.QueryUnescape(mux.Vars(r)["name"])
+	tu, _ := tc.GetTorrent(name)
+	if tu == nil {
+		httpError(w, http.StatusNotFound, "failed to find torrent '%s'", name)
+		return
+	}
+	if !tu.InfoReady {
+		httpError(w, http.StatusConflict, "%s has no metainfo yet", tu.Name)
+		return
+	}
+	writePlaylist(w, r, tu.Name, playlistItems(tu, false), false)
+}
+
+// _CategoryPlaylist has files ready to stream of all torrents in category
+func _CategoryPlaylist(w http.ResponseWriter, r *http.Request) {
+	name, _ := url.QueryUnescape(mux.Vars(r)["category"])
+	if _, ok := GetCategory(name); !ok {
+		httpError(w, http.StatusNotFound, "category '%s' not found", name)
+		return
+	}
+	torrents := make([]*TorrentWithUserData, 0)
+	for _, tu := range tc.GetTorrents() {
+		if tu != nil && !tu.Dead && tu.Tags.getString("category", "") == name {
+			torrents = append(torrents, tu)
+		}
+	}
+	sort.Slice(torrents, func(i, j int) bool { return naturalLess(torrents[i].Name, torrents[j].Name) })
+	items := make([]playlistItem, 0)
+	for _, tu := range torrents {
+		items = append(items, playlistItems(tu, true)...)
+	}
+	writePlaylist(w, r, name, items, true)
+}
@@ -0,0 +1,148 @@
+package torc
+
+import (
+	"context"
+	tt "github.com/anacrolix/torrent"
+	"io"
+)
+
+const (
+	PREBUFFER_SECONDS = 30
+	// head of file read to find out container layout
+	PREBUFFER_PROBE      = 64 << 10
+	READAHEAD_MIN_PIECES = 2
+	READAHEAD_MAX_PIECES = 256
+	// index size comes from file header, broken or hostile one isn't read whole
+	MAX_INDEX_SIZE = 64 << 20
+)
+
+// byteRange is [Off, Off+Len) of file
+type byteRange struct {
+	Off int64
+	Len int64
+}
+
+func prebufferSeconds() int64 {
+	if torClient.PrebufferSeconds > 0 {
+		return int64(torClient.PrebufferSeconds)
+	}
+	return PREBUFFER_SECONDS
+}
+
+// Bitrate in bytes per second, 0 if duration isn't known yet
+func (f *TorrentFile) Bitrate() int64 {
+	d := f.Duration()
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(f.file.Length()) / d)
+}
+
+// readahead keeps prebuffer seconds of playback ahead of reader. when torrent downloads slower than
+// file plays pieces are asked for earlier, up to 4 times, when it's faster less is needed
+func (f *TorrentFile) readahead() int64 {
+	pl := f.Tud.torrent.Info().PieceLength
+	br := f.Bitrate()
+	if br == 0 {
+		return pl * 20
+	}
+	ra := br * prebufferSeconds()
+	if dl := int64(f.Tud.dl_rate); dl > 0 {
+		scaled := ra * br / dl
+		switch {
+		case scaled > ra*4:
+			ra *= 4
+		case scaled < ra/4:
+			ra /= 4
+		default:
+			ra = scaled
+		}
+	}
+	if ra < pl*READAHEAD_MIN_PIECES {
+		ra = pl * READAHEAD_MIN_PIECES
+	}
+	if ra > pl*READAHEAD_MAX_PIECES {
+		ra = pl * READAHEAD_MAX_PIECES
+	}
+	return ra
+}
+
+// readAt downloads n bytes at off through rdr, short read without error is end of file
+func readAt(ctx context.Context, rdr tt.Reader, off int64, n int64) ([]byte, error) {
+	if _, err := rdr.Seek(off, io.SeekStart); err != nil {
+		return nil, newError("failed to seek to %d: %v", off, err)
+	}
+	rdr.SetReadahead(n)
+	buf := make([]byte, n)
+	got := 0
+	for int64(got) < n {
+		k, err := rdr.ReadContext(ctx, buf[got:])
+		got += k
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return buf[:got], err
+		}
+	}
+	return buf[:got], nil
+}
+
+// containerIndex is where player looks first after the head: mp4 moov, mkv cues. last pieces
+// for other containers, most keep their index at the end if not in the head
+func (f *TorrentFile) containerIndex(head []byte, read readFunc) []byteRange {
+	size := f.file.Length()
+	if off, n := mp4Moov(read, size); n > 0 {
+		n = capIndex(f, "moov", n)
+		// mvhd is the first box of moov
+		// read isn't done under cacheLock, it waits for pieces
+		if f.Duration() == 0 {
+			if moov := read(off, minInt64(n, PREBUFFER_PROBE)); moov != nil {
+				f.setDuration(mp4Duration(moov))
+			}
+		}
+		log.Debug("%s: moov at %d, %d bytes", f.file.DisplayPath(), off, n)
+		return []byteRange{{off, n}}
+	}
+	if off, n := mkvCues(head, read, size); n > 0 {
+		n = capIndex(f, "cues", n)
+		f.setDuration(mkvDuration(head))
+		log.Debug("%s: cues at %d, %d bytes", f.file.DisplayPath(), off, n)
+		return []byteRange{{off, n}}
+	}
+	n := f.Tud.torrent.Info().PieceLength * LOAD_FROM_END
+	if n > size {
+		n = size
+	}
+	return []byteRange{{size - n, n}}
+}
+
+func capIndex(f *TorrentFile, what string, n int64) int64 {
+	if n > MAX_INDEX_SIZE {
+		log.Warn("%s: %s has %d bytes, only %d are fetched", f.file.DisplayPath(), what, n, MAX_INDEX_SIZE)
+		return MAX_INDEX_SIZE
+	}
+	return n
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// prebufferStart is prebuffer seconds at estimated bitrate, fixed number of pieces if it's unknown
+func (f *TorrentFile) prebufferStart() int64 {
+	n := f.Tud.torrent.Info().PieceLength * LOAD_FROM_START
+	if br := f.Bitrate(); br > 0 {
+		n = br * prebufferSeconds()
+	}
+	if n < PREBUFFER_PROBE {
+		n = PREBUFFER_PROBE
+	}
+	if n > f.file.Length() {
+		n = f.file.Length()
+	}
+	return n
+}
@@ -0,0 +1,140 @@
+package torc
+
+import (
+	"context"
+	tt "github.com/anacrolix/torrent"
+	"sync"
+	"time"
+)
+
+// how often next episode's ranges are looked at again, container index is found once head is here
+const PREFETCH_INTERVAL = 5 * time.Second
+
+// prefetch raises priority of head, index and start of next episode while one plays. it's High,
+// readers of playing file ask for their pieces above it, so prefetch takes what streams leave
+type prefetch struct {
+	next    *TorrentFile
+	streams int
+	pieces  map[int]bool
+	cancel  context.CancelFunc
+}
+
+var (
+	// by playing file
+	prefetches   = map[*TorrentFile]*prefetch{}
+	prefetchLock sync.Mutex
+)
+
+// nextEpisode is the file after f in playlist order, skipped files are left out
+func nextEpisode(f *TorrentFile) *TorrentFile {
+	items := playlistItems(f.Tud, false)
+	for i, item := range items {
+		if item.file != f {
+			continue
+		}
+		for _, n := range items[i+1:] {
+			if n.file.Wanted() {
+				return n.file
+			}
+		}
+		break
+	}
+	return nil
+}
+
+// prefetchRanges are what PrepareForPlay reads, from complete pieces only. until head is here
+// index is the end of file
+func (f *TorrentFile) prefetchRanges() []byteRange {
+	head := f.readComplete(0, PREBUFFER_PROBE)
+	return append(f.containerIndex(head, f.readComplete), byteRange{0, f.prebufferStart()})
+}
+
+// StartPrefetch is called when stream of f opens, next episode is prefetched until last one closes
+func (f *TorrentFile) StartPrefetch() {
+	prefetchLock.Lock()
+	defer prefetchLock.Unlock()
+	if p := prefetches[f]; p != nil {
+		p.streams++
+		return
+	}
+	next := nextEpisode(f)
+	if next == nil || next.Ready() || next.file.BytesCompleted() >= next.file.Length() {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prefetch{next: next, streams: 1, pieces: map[int]bool{}, cancel: cancel}
+	prefetches[f] = p
+	log.Info("prefetch %s while %s plays", next.file.DisplayPath(), f.file.DisplayPath())
+	go p.run(ctx)
+}
+
+func (f *TorrentFile) StopPrefetch() {
+	prefetchLock.Lock()
+	defer prefetchLock.Unlock()
+	p := prefetches[f]
+	if p == nil {
+		return
+	}
+	if p.streams--; p.streams > 0 {
+		return
+	}
+	delete(prefetches, f)
+	p.cancel()
+}
+
+func (p *prefetch) run(ctx context.Context) {
+	defer p.release()
+	for {
+		if p.raise() {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(PREFETCH_INTERVAL):
+		}
+	}
+}
+
+// raise asks for pieces of ranges which aren't here yet, true when all of them are. next episode
+// is ready then and PrepareForPlay has nothing to do
+func (p *prefetch) raise() bool {
+	f := p.next
+	t := f.Tud.torrent
+	pl := t.Info().PieceLength
+	want := int64(0)
+	done := true
+	for _, r := range f.prefetchRanges() {
+		want += r.Len
+		begin := f.file.Offset() + r.Off
+		for i := begin / pl; i*pl < begin+r.Len; i++ {
+			if t.PieceState(int(i)).Complete {
+				continue
+			}
+			done = false
+			if !p.pieces[int(i)] {
+				t.Piece(int(i)).SetPriority(tt.PiecePriorityHigh)
+				p.pieces[int(i)] = true
+			}
+		}
+	}
+	if done {
+		prepareLock.Lock()
+		if f.job == nil || f.job.state != PREPARE_RUNNING {
+			f.BytesWant, f.BytesHave = int(want), int(want)
+		}
+		prepareLock.Unlock()
+		log.Info("prefetch %s is done, %d bytes", f.file.DisplayPath(), want)
+	}
+	return done
+}
+
+// release puts pieces which didn't come back to what their file asks for
+func (p *prefetch) release() {
+	t := p.next.Tud.torrent
+	for i := range p.pieces {
+		if !t.PieceState(i).Complete {
+			t.Piece(i).SetPriority(tt.PiecePriorityNone)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package torc
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	tt "github.com/anacrolix/torrent"
+)
+
+// waitHigh waits for prefetch goroutine to raise piece to high or to put it back to normal
+func waitHigh(tu *TorrentWithUserData, piece int, high bool) bool {
+	want := tt.PiecePriorityNormal
+	if high {
+		want = tt.PiecePriorityHigh
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if tu.torrent.PieceState(piece).Priority == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPrefetchNextEpisode(t *testing.T) {
+	cat, _ := GetCategory(TEST_CATEGORY)
+	// e01 fills 4 pieces of 16 KiB, e02 is pieces 4..67 and none of them is here
+	data := makeTorrent(t, cat.download, "Prefetch Show", map[string]int{"e01.mkv": 64 << 10, "e02.mkv": 1 << 20})
+	defer os.RemoveAll(path.Join(cat.download, "Prefetch Show"))
+	os.Remove(path.Join(cat.download, "Prefetch Show", "e02.mkv"))
+	tu, err := tc.AddTorrentFromData(TEST_CATEGORY, "Prefetch Show", data, &Tags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.RemoveTorrent(tu.Name)
+	tu.torrent.VerifyData()
+	// files get their priorities when torrent runs
+	tu.Resume("test")
+	e01, e02 := tu.GetFile("Prefetch Show/e01.mkv"), tu.GetFile("Prefetch Show/e02.mkv")
+	if nextEpisode(e01) != e02 || nextEpisode(e02) != nil {
+		t.Fatalf("next of e01 %v, of e02 %v", nextEpisode(e01), nextEpisode(e02))
+	}
+	// LOAD_FROM_START pieces of head and start, LOAD_FROM_END of index as container isn't known
+	head, middle, tail := 4, 30, 67
+	if p := tu.torrent.PieceState(middle).Priority; p != tt.PiecePriorityNormal {
+		t.Fatalf("middle of e02 has priority %v before prefetch", p)
+	}
+
+	e01.StartPrefetch()
+	e01.StartPrefetch()
+	for _, piece := range []int{head, head + LOAD_FROM_START - 1, tail - LOAD_FROM_END + 1, tail} {
+		if !waitHigh(tu, piece, true) {
+			t.Errorf("piece %d isn't raised, %v", piece, tu.torrent.PieceState(piece).Priority)
+		}
+	}
+	if p := tu.torrent.PieceState(middle).Priority; p != tt.PiecePriorityNormal {
+		t.Errorf("middle of e02 has priority %v", p)
+	}
+
+	// one of two streams closes, prefetch goes on
+	e01.StopPrefetch()
+	prefetchLock.Lock()
+	running := prefetches[e01] != nil
+	prefetchLock.Unlock()
+	if !running {
+		t.Errorf("prefetch stopped while e01 still streams")
+	}
+	e01.StopPrefetch()
+	for _, piece := range []int{head, tail} {
+		if !waitHigh(tu, piece, false) {
+			t.Errorf("piece %d isn't released, %v", piece, tu.torrent.PieceState(piece).Priority)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package torc
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"ttv/client"
+)
+
+type PrepareInfo = client.PrepareInfo
+
+const (
+	PREPARE_RUNNING  = "running"
+	PREPARE_DONE     = "done"
+	PREPARE_FAILED   = "failed"
+	PREPARE_CANCELED = "canceled"
+)
+
+// prepareJob runs PrepareForPlay of a file. it's canceled by DELETE or when all requests waiting
+// for it are gone, unless someone started it without waiting
+type prepareJob struct {
+	f        *TorrentFile
+	cancel   context.CancelFunc
+	done     chan struct{}
+	state    string
+	err      error
+	started  time.Time
+	finished time.Time
+	waiters  int
+	detached bool
+}
+
+// jobs of all files are under one lock, there are few of them
+var prepareLock sync.Mutex
+
+// StartPrepare returns running job of file or starts new one, finished jobs are replaced.
+// waiting callers have to call leave when they are done
+func (f *TorrentFile) StartPrepare(wait bool) *prepareJob {
+	prepareLock.Lock()
+	defer prepareLock.Unlock()
+	j := f.job
+	if j == nil || j.state != PREPARE_RUNNING {
+		ctx, cancel := context.WithCancel(context.Background())
+		j = &prepareJob{f: f, cancel: cancel, done: make(chan struct{}), state: PREPARE_RUNNING, started: time.Now()}
+		f.job = j
+		go j.run(ctx)
+	}
+	if wait {
+		j.waiters++
+	} else {
+		j.detached = true
+	}
+	return j
+}
+
+func (j *prepareJob) run(ctx context.Context) {
+	err := j.f.PrepareForPlay(ctx)
+	prepareLock.Lock()
+	defer prepareLock.Unlock()
+	j.finished = time.Now()
+	switch {
+	case err == nil:
+		j.state = PREPARE_DONE
+	case ctx.Err() != nil:
+		j.state = PREPARE_CANCELED
+	default:
+		j.state = PREPARE_FAILED
+		j.err = err
+		log.Error("prepare %s failed: %v", j.f.file.DisplayPath(), err)
+	}
+	j.cancel()
+	close(j.done)
+}
+
+// leave is called by waiting request when it's finished, last one gone cancels the job
+func (j *prepareJob) leave() {
+	prepareLock.Lock()
+	defer prepareLock.Unlock()
+	if j.waiters--; j.waiters == 0 && !j.detached && j.state == PREPARE_RUNNING {
+		log.Info("prepare %s: nobody waits for it anymore", j.f.file.DisplayPath())
+		j.cancel()
+	}
+}
+
+// CancelPrepare stops running job, false if there is none
+func (f *TorrentFile) CancelPrepare() bool {
+	prepareLock.Lock()
+	defer prepareLock.Unlock()
+	if f.job == nil || f.job.state != PREPARE_RUNNING {
+		return false
+	}
+	f.job.cancel()
+	return true
+}
+
+// PrepareInfo is nil if file was never prepared
+func (f *TorrentFile) PrepareInfo() *PrepareInfo {
+	prepareLock.Lock()
+	defer prepareLock.Unlock()
+	j := f.job
+	if j == nil {
+		return nil
+	}
+	rc := PrepareInfo{State: j.state, BytesWant: int64(f.BytesWant), BytesHave: int64(f.BytesHave), Eta: -1}
+	end := j.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	// torrent rate is what is going on right now, average of job if torrent has none yet
+	rc.Rate = int64(f.Tud.dl_rate)
+	if el := end.Sub(j.started).Seconds(); rc.Rate == 0 && el > 0 {
+		rc.Rate = int64(float64(rc.BytesHave) / el)
+	}
+	switch {
+	case j.state == PREPARE_DONE:
+		rc.Eta = 0
+	case j.state == PREPARE_RUNNING && rc.Rate > 0 && rc.BytesWant > rc.BytesHave:
+		rc.Eta = (rc.BytesWant - rc.BytesHave + rc.Rate - 1) / rc.Rate
+	}
+	if j.err != nil {
+		rc.Error = j.err.Error()
+	}
+	return &rc
+}
+
+// apiFile finds file from {id} and {index} path variables, writes 404 if there is no such file
+func apiFile(w http.ResponseWriter, r *http.Request) *TorrentFile {
+	tu := apiTorrent(w, r)
+	if tu == nil {
+		return nil
+	}
+	index, _ := strconv.Atoi(mux.Vars(r)["index"])
+	f := tu.GetFile(index)
+	if f == nil {
+		httpError(w, http.StatusNotFound, "file %d not found in %s", index, tu.Name)
+	}
+	return f
+}
+
+// _apiPrepareStart returns 202 at once, with wait=yes it answers when job is finished
+func _apiPrepareStart(w http.ResponseWriter, r *http.Request) {
+	f := apiFile(w, r)
+	if f == nil {
+		return
+	}
+	wait := r.FormValue("wait") == "yes"
+	tc.PauseNotInPlay()
+	j := f.StartPrepare(wait)
+	if !wait {
+		writeJson(w, http.StatusAccepted, f.PrepareInfo())
+		return
+	}
+	defer j.leave()
+	select {
+	case <-j.done:
+	case <-r.Context().Done():
+		return
+	}
+	info := f.PrepareInfo()
+	status := http.StatusOK
+	if info.State == PREPARE_FAILED {
+		status = http.StatusBadGateway
+	}
+	writeJson(w, status, info)
+}
+
+func _apiPrepareGet(w http.ResponseWriter, r *http.Request) {
+	f := apiFile(w, r)
+	if f == nil {
+		return
+	}
+	info := f.PrepareInfo()
+	if info == nil {
+		httpError(w, http.StatusNotFound, "%s was not prepared", f.file.DisplayPath())
+		return
+	}
+	writeJson(w, http.StatusOK, info)
+}
+
+func _apiPrepareCancel(w http.ResponseWriter, r *http.Request) {
+	f := apiFile(w, r)
+	if f == nil {
+		return
+	}
+	if !f.CancelPrepare() {
+		httpError(w, http.StatusNotFound, "%s is not being prepared", f.file.DisplayPath())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,31 @@
+package torc
+
+import (
+	"context"
+	"testing"
+)
+
+// progress is read by api while PrepareForPlay counts it, go test -race catches unguarded counters
+func TestPrepareProgress(t *testing.T) {
+	tu := addTestTorrent(t, "Prepare Movie", map[string]int{"movie.mkv": 200000})
+	f := tu.GetFile(0)
+	done := make(chan error)
+	go func() {
+		done <- f.PrepareForPlay(context.Background())
+	}()
+	for running := true; running; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			running = false
+		default:
+			f.Ready()
+		}
+	}
+	want, have := f.prepared()
+	if !f.Ready() || want == 0 || have != want {
+		t.Errorf("after prepare want %d have %d", want, have)
+	}
+}
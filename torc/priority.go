@@ -0,0 +1,313 @@
+package torc
+
+import (
+	"encoding/json"
+	tt "github.com/anacrolix/torrent"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	PRIORITY_SKIP   = "skip"
+	PRIORITY_NORMAL = "normal"
+	PRIORITY_HIGH   = "high"
+	// tag with explicit priorities of files, "3=high,5=skip"
+	PRIORITIES_TAG = "file_priorities"
+	// rules of this category are for all categories
+	ANY_CATEGORY = "*"
+)
+
+// FileRules is priority -> globs for file path or name, like skip: ["*sample*", "*.nfo"]
+type FileRules map[string][]string
+
+type rulesFile struct {
+	Categories map[string]FileRules `yaml:"categories"`
+}
+
+type rulesStore struct {
+	rulesFile
+	file string
+
+	sync.Mutex
+}
+
+var rules = rulesStore{rulesFile: rulesFile{Categories: map[string]FileRules{}}}
+
+func ValidPriority(p string) bool {
+	return p == PRIORITY_SKIP || p == PRIORITY_NORMAL || p == PRIORITY_HIGH
+}
+
+// LoadFileRules reads glob rules of categories, there are no rules if file doesn't exist
+func LoadFileRules(file string) {
+	rules.Lock()
+	defer rules.Unlock()
+	rules.file = file
+	rules.Categories = map[string]FileRules{}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Info("no file rules in %s: %v", file, err)
+		return
+	}
+	if err := yaml.Unmarshal(data, &rules.rulesFile); err != nil {
+		log.Error("failed to yaml.Unmarshal %s: %v, starting without file rules", file, err)
+	}
+	for cat, fr := range rules.Categories {
+		for p := range fr {
+			if !ValidPriority(p) {
+				log.Warn("file rules of %s: unknown priority %s, ignoring", cat, p)
+				delete(fr, p)
+			}
+		}
+	}
+}
+
+func (r *rulesStore) save() {
+	data, err := yaml.Marshal(&r.rulesFile)
+	if err != nil {
+		log.Error("failed to yaml.Marshal file rules: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(r.file, data, 0664); err != nil {
+		log.Error("failed to WriteFile %s: %v", r.file, err)
+	}
+}
+
+func CategoryRules(category string) FileRules {
+	rules.Lock()
+	defer rules.Unlock()
+	rc := FileRules{}
+	for p, globs := range rules.Categories[category] {
+		rc[p] = append([]string{}, globs...)
+	}
+	return rc
+}
+
+func SetCategoryRules(category string, fr FileRules) {
+	rules.Lock()
+	defer rules.Unlock()
+	if len(fr) == 0 {
+		delete(rules.Categories, category)
+	} else {
+		rules.Categories[category] = fr
+	}
+	rules.save()
+}
+
+// matchRules tries high, then normal, then skip, so "skip: *" with "normal: *E03*" gets one episode.
+// globs match whole path or file name, case doesn't matter
+func matchRules(name string, category string) string {
+	rules.Lock()
+	defer rules.Unlock()
+	name = strings.ToLower(name)
+	base := path.Base(name)
+	for _, p := range []string{PRIORITY_HIGH, PRIORITY_NORMAL, PRIORITY_SKIP} {
+		for _, cat := range []string{category, ANY_CATEGORY} {
+			for _, glob := range rules.Categories[cat][p] {
+				glob = strings.ToLower(strings.TrimSpace(glob))
+				if ok, _ := path.Match(glob, name); ok {
+					return p
+				}
+				if ok, _ := path.Match(glob, base); ok {
+					return p
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// refreshPriorities parses PRIORITIES_TAG, bad entries are left out. it's done when tags change,
+// TrackProgress asks for priorities on every piece and tags aren't guarded
+func (tu *TorrentWithUserData) refreshPriorities() {
+	rc := map[int]string{}
+	for _, kv := range strings.Split(tu.Tags.getString(PRIORITIES_TAG, ""), ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(kv[:i]))
+		p := strings.TrimSpace(kv[i+1:])
+		if err != nil || !ValidPriority(p) {
+			continue
+		}
+		rc[index] = p
+	}
+	category := tu.Tags.getString("category", "")
+	tu.prio_lock.Lock()
+	tu.prio, tu.prio_category = rc, category
+	tu.prio_lock.Unlock()
+}
+
+// filePriorities is a copy of those in PRIORITIES_TAG
+func (tu *TorrentWithUserData) filePriorities() map[int]string {
+	tu.prio_lock.Lock()
+	defer tu.prio_lock.Unlock()
+	rc := map[int]string{}
+	for i, p := range tu.prio {
+		rc[i] = p
+	}
+	return rc
+}
+
+func (tu *TorrentWithUserData) filePriority(index int) (p string, ok bool) {
+	tu.prio_lock.Lock()
+	defer tu.prio_lock.Unlock()
+	p, ok = tu.prio[index]
+	return
+}
+
+func (tu *TorrentWithUserData) priorityCategory() string {
+	tu.prio_lock.Lock()
+	defer tu.prio_lock.Unlock()
+	return tu.prio_category
+}
+
+func (tu *TorrentWithUserData) setFilePriorities(prio map[int]string) {
+	indexes := make([]int, 0)
+	for i := range prio {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	kv := make([]string, 0)
+	for _, i := range indexes {
+		kv = append(kv, strconv.Itoa(i)+"="+prio[i])
+	}
+	if len(kv) == 0 {
+		tu.Tags.Remove(PRIORITIES_TAG)
+	} else {
+		tu.Tags.Set(PRIORITIES_TAG, strings.Join(kv, ","))
+	}
+	tu.refreshPriorities()
+}
+
+// SetFilePriority keeps priority in tags, empty one drops it and category rules apply again
+func (tu *TorrentWithUserData) SetFilePriority(index int, p string) {
+	prio := tu.filePriorities()
+	if p == "" {
+		delete(prio, index)
+	} else {
+		prio[index] = p
+	}
+	tu.setFilePriorities(prio)
+	Emit(EvTagsChanged, tu, "", Tags{PRIORITIES_TAG: tu.Tags.getString(PRIORITIES_TAG, "")})
+	if !tu.Paused {
+		tu.applyPriorities()
+	}
+	tu.SaveTags()
+}
+
+// Priority is from tags, from category rules if file has none there, normal otherwise
+func (f *TorrentFile) Priority() string {
+	if p, ok := f.Tud.filePriority(f.Index); ok {
+		return p
+	}
+	if p := matchRules(f.file.DisplayPath(), f.Tud.priorityCategory()); p != "" {
+		return p
+	}
+	return PRIORITY_NORMAL
+}
+
+func (f *TorrentFile) Wanted() bool {
+	return f.Priority() != PRIORITY_SKIP
+}
+
+// applyPriorities tells torrent what to download, files are touched only when their priority changes
+func (tu *TorrentWithUserData) applyPriorities() {
+	for _, f := range tu.Files() {
+		p := f.Priority()
+		if p == f.priority {
+			continue
+		}
+		log.Debug("%s: %s priority %s", tu.Name, f.file.DisplayPath(), p)
+		f.setPriority(p)
+	}
+}
+
+// setPriority tells torrent about priority of file, everything does it through here so applyPriorities
+// knows what torrent has
+func (f *TorrentFile) setPriority(p string) {
+	switch p {
+	case PRIORITY_SKIP:
+		f.file.SetPriority(tt.PiecePriorityNone)
+	case PRIORITY_HIGH:
+		f.file.SetPriority(tt.PiecePriorityHigh)
+	default:
+		f.file.SetPriority(tt.PiecePriorityNormal)
+	}
+	f.priority = p
+}
+
+// wantedBytes is length and completed bytes of files which are not skipped
+func (tu *TorrentWithUserData) wantedBytes() (length int64, completed int64) {
+	for _, f := range tu.Files() {
+		if !f.Wanted() {
+			continue
+		}
+		length += f.file.Length()
+		completed += f.file.BytesCompleted()
+	}
+	return
+}
+
+// _apiFilePriority sets priority of file, priority= without value drops it
+func _apiFilePriority(w http.ResponseWriter, r *http.Request) {
+	f := apiFile(w, r)
+	if f == nil {
+		return
+	}
+	p := r.FormValue("priority")
+	if p != "" && !ValidPriority(p) {
+		httpError(w, http.StatusBadRequest, "bad priority '%s', it's skip, normal or high", p)
+		return
+	}
+	f.Tud.SetFilePriority(f.Index, p)
+	writeJson(w, http.StatusOK, f.Info())
+}
+
+func _apiCategoryRulesGet(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, ok := GetCategory(name); !ok && name != ANY_CATEGORY {
+		httpError(w, http.StatusNotFound, "category '%s' not found", name)
+		return
+	}
+	writeJson(w, http.StatusOK, CategoryRules(name))
+}
+
+func _apiCategoryRulesSet(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, ok := GetCategory(name); !ok && name != ANY_CATEGORY {
+		httpError(w, http.StatusNotFound, "category '%s' not found", name)
+		return
+	}
+	fr := FileRules{}
+	if err := json.NewDecoder(r.Body).Decode(&fr); err != nil {
+		httpError(w, http.StatusBadRequest, "failed to decode json: %v", err)
+		return
+	}
+	for p, globs := range fr {
+		if !ValidPriority(p) {
+			httpError(w, http.StatusBadRequest, "bad priority '%s', it's skip, normal or high", p)
+			return
+		}
+		for _, glob := range globs {
+			if _, err := path.Match(glob, ""); err != nil {
+				httpError(w, http.StatusBadRequest, "bad glob '%s': %v", glob, err)
+				return
+			}
+		}
+	}
+	SetCategoryRules(name, fr)
+	for _, tu := range tc.GetTorrents() {
+		if tu != nil && tu.InfoReady && !tu.Paused && (name == ANY_CATEGORY || tu.Tags.getString("category", "") == name) {
+			tu.applyPriorities()
+		}
+	}
+	writeJson(w, http.StatusOK, CategoryRules(name))
+}
@@ -0,0 +1,46 @@
+package torc
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestApplyPrioritiesAfterSubtitleBoost(t *testing.T) {
+	tu := addTestTorrent(t, "Priority Movie", map[string]int{"movie.mkv": 40000, "movie.srt": 1000})
+	srt := tu.GetFile("Priority Movie/movie.srt")
+	if srt == nil {
+		t.Fatal("no movie.srt")
+	}
+	tu.SetFilePriority(srt.Index, PRIORITY_SKIP)
+	tu.applyPriorities()
+	if srt.priority != PRIORITY_SKIP {
+		t.Fatalf("priority %s, want %s", srt.priority, PRIORITY_SKIP)
+	}
+	// subtitle asked for by player, then rules are applied again
+	srt.setPriority(PRIORITY_HIGH)
+	tu.applyPriorities()
+	if srt.priority != PRIORITY_SKIP {
+		t.Errorf("priority %s after boost, want %s again", srt.priority, PRIORITY_SKIP)
+	}
+}
+
+func TestPrioritiesFollowTags(t *testing.T) {
+	tu := addTestTorrent(t, "Priority Tags", map[string]int{"e01.mkv": 40000, "e02.mkv": 40000})
+	e02 := tu.GetFile("Priority Tags/e02.mkv")
+	if e02 == nil {
+		t.Fatal("no e02.mkv")
+	}
+	// as if tags were edited through api
+	tu.Tags.Set(PRIORITIES_TAG, fmt.Sprintf("%d=skip", e02.Index))
+	tu.ProcessTags()
+	if e02.Priority() != PRIORITY_SKIP || e02.Wanted() {
+		t.Fatalf("priority %s from tag", e02.Priority())
+	}
+	if length, _ := tu.wantedBytes(); length != 40000 {
+		t.Errorf("%d bytes wanted, want 40000", length)
+	}
+	tu.SetFilePriority(e02.Index, "")
+	if e02.Priority() != PRIORITY_NORMAL || tu.Tags.getString(PRIORITIES_TAG, "") != "" {
+		t.Errorf("priority %s, tag %q after it's dropped", e02.Priority(), tu.Tags.getString(PRIORITIES_TAG, ""))
+	}
+}
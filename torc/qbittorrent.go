@@ -0,0 +1,802 @@
+package torc
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versions tools check before talking to us
+const QB_VERSION = "v4.3.9"
+const QB_WEBAPI_VERSION = "2.8.3"
+
+// qBittorrent Web API lives under its own prefix, tools take it as url base,
+// so it doesn't shadow ttv's /api/v2
+const QB_PREFIX = "/qbittorrent/api/v2"
+
+// qBittorrent's eta for "never"
+const QB_ETA_INFINITY = 8640000
+
+// qBittorrent file priorities: 0 is do not download, 6 is high
+var qbPriorities = map[string]int{PRIORITY_SKIP: 0, PRIORITY_NORMAL: 1, PRIORITY_HIGH: 6}
+
+// bookkeeping and control tags, not shown as qBittorrent tags and can't be set through it
+var qbSystemTags = map[string]bool{
+	"delete_data": true, "drop_it": true, "drop_watched": true, "kill_it": true,
+	"save_to_library": true, "watch_later": true, "watched": true,
+	"added": true, "category": true, "completed": true, "datapath": true, "download": true,
+	"downloaded_bytes": true, "drop_data": true, "file_priorities": true, "force_delete": true, "fullpath": true,
+	"infohash": true, "kodi_expires_at": true, "last_rate": true, "magnet": true,
+	"maxConnections": true, "max_rate": true, "max_seeders": true, "name": true,
+	"pause_reason": true, "paused": true, "private": true, "resume_reason": true,
+	"seed_until": true, "source": true, "tags_fullpath": true, "tags_updated": true,
+	"torrent_saved": true, "total_time": true, "upload_bytes": true, "user_paused": true,
+	"want_drop": true, "watch_later_expiration": true,
+}
+
+type qbTorrentInfo struct {
+	AddedOn           int64   `json:"added_on"`
+	AmountLeft        int64   `json:"amount_left"`
+	AutoTmm           bool    `json:"auto_tmm"`
+	Availability      float64 `json:"availability"`
+	Category          string  `json:"category"`
+	Completed         int64   `json:"completed"`
+	CompletionOn      int64   `json:"completion_on"`
+	ContentPath       string  `json:"content_path"`
+	DlLimit           int     `json:"dl_limit"`
+	Dlspeed           int     `json:"dlspeed"`
+	Downloaded        int64   `json:"downloaded"`
+	DownloadedSession int64   `json:"downloaded_session"`
+	Eta               int64   `json:"eta"`
+	ForceStart        bool    `json:"force_start"`
+	Hash              string  `json:"hash"`
+	LastActivity      int64   `json:"last_activity"`
+	MagnetUri         string  `json:"magnet_uri"`
+	MaxRatio          float64 `json:"max_ratio"`
+	MaxSeedingTime    int     `json:"max_seeding_time"`
+	Name              string  `json:"name"`
+	NumComplete       int     `json:"num_complete"`
+	NumIncomplete     int     `json:"num_incomplete"`
+	NumLeechs         int     `json:"num_leechs"`
+	NumSeeds          int     `json:"num_seeds"`
+	Priority          int     `json:"priority"`
+	Progress          float64 `json:"progress"`
+	Ratio             float64 `json:"ratio"`
+	RatioLimit        float64 `json:"ratio_limit"`
+	SavePath          string  `json:"save_path"`
+	SeedingTimeLimit  int     `json:"seeding_time_limit"`
+	SeenComplete      int64   `json:"seen_complete"`
+	SeqDl             bool    `json:"seq_dl"`
+	Size              int64   `json:"size"`
+	State             string  `json:"state"`
+	SuperSeeding      bool    `json:"super_seeding"`
+	Tags              string  `json:"tags"`
+	TimeActive        int64   `json:"time_active"`
+	TotalSize         int64   `json:"total_size"`
+	Tracker           string  `json:"tracker"`
+	UpLimit           int     `json:"up_limit"`
+	Uploaded          int64   `json:"uploaded"`
+	UploadedSession   int64   `json:"uploaded_session"`
+	Upspeed           int     `json:"upspeed"`
+}
+
+type qbCategory struct {
+	Name     string `json:"name"`
+	SavePath string `json:"savePath"`
+}
+
+// registerQbitApi adds qBittorrent Web API to QB_PREFIX subrouter
+func registerQbitApi(api *mux.Router) {
+	api.HandleFunc("/auth/login", _qbLogin).Methods("POST")
+	api.HandleFunc("/auth/logout", _qbLogout).Methods("POST")
+	api.HandleFunc("/app/version", _qbText(QB_VERSION)).Methods("GET")
+	api.HandleFunc("/app/webapiVersion", _qbText(QB_WEBAPI_VERSION)).Methods("GET")
+	api.HandleFunc("/app/preferences", _qbPreferences).Methods("GET")
+	api.HandleFunc("/app/defaultSavePath", _qbDefaultSavePath).Methods("GET")
+	api.HandleFunc("/transfer/info", _qbTransferInfo).Methods("GET")
+	api.HandleFunc("/torrents/info", _qbTorrentsInfo).Methods("GET")
+	api.HandleFunc("/torrents/properties", _qbTorrentProperties).Methods("GET")
+	api.HandleFunc("/torrents/files", _qbTorrentFiles).Methods("GET")
+	api.HandleFunc("/torrents/trackers", _qbTorrentTrackers).Methods("GET")
+	api.HandleFunc("/torrents/add", _qbTorrentsAdd).Methods("POST")
+	api.HandleFunc("/torrents/pause", _qbTorrentsPause).Methods("POST")
+	api.HandleFunc("/torrents/stop", _qbTorrentsPause).Methods("POST")
+	api.HandleFunc("/torrents/resume", _qbTorrentsResume).Methods("POST")
+	api.HandleFunc("/torrents/start", _qbTorrentsResume).Methods("POST")
+	api.HandleFunc("/torrents/delete", _qbTorrentsDelete).Methods("POST")
+	api.HandleFunc("/torrents/categories", _qbCategories).Methods("GET")
+	api.HandleFunc("/torrents/createCategory", _qbCreateCategory).Methods("POST")
+	api.HandleFunc("/torrents/setCategory", _qbSetCategory).Methods("POST")
+	api.HandleFunc("/torrents/tags", _qbTags).Methods("GET")
+	api.HandleFunc("/torrents/createTags", _qbCreateTags).Methods("POST")
+	api.HandleFunc("/torrents/deleteTags", _qbDeleteTags).Methods("POST")
+	api.HandleFunc("/torrents/addTags", _qbAddTags).Methods("POST")
+	api.HandleFunc("/torrents/removeTags", _qbRemoveTags).Methods("POST")
+}
+
+func qbWrite(w http.ResponseWriter, status int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write([]byte(text))
+}
+
+func _qbText(text string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		qbWrite(w, http.StatusOK, text)
+	}
+}
+
+func _qbLogin(w http.ResponseWriter, r *http.Request) {
+	id := auth.Login(r.FormValue("username"), r.FormValue("password"))
+	if id == nil {
+		log.Warn("qbittorrent login failed for '%s' from %s", r.FormValue("username"), r.RemoteAddr)
+		qbWrite(w, http.StatusOK, "Fails.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     AUTH_COOKIE,
+		Value:    auth.NewSession(id),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Now().Add(AUTH_SESSION_TTL),
+	})
+	qbWrite(w, http.StatusOK, "Ok.")
+}
+
+func _qbLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(AUTH_COOKIE); err == nil {
+		auth.EndSession(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: AUTH_COOKIE, Value: "", Path: "/", MaxAge: -1})
+	qbWrite(w, http.StatusOK, "")
+}
+
+func qbDefaultSavePath() string {
+	if cat, ok := GetCategory(tc.KodiCategory); ok {
+		return cat.download
+	}
+	return ""
+}
+
+func _qbDefaultSavePath(w http.ResponseWriter, r *http.Request) {
+	qbWrite(w, http.StatusOK, qbDefaultSavePath())
+}
+
+// _qbPreferences has only what download managers look at, ttv has no ratio limits and queueing
+func _qbPreferences(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"save_path":                qbDefaultSavePath(),
+		"temp_path_enabled":        false,
+		"auto_tmm_enabled":         false,
+		"max_ratio_enabled":        false,
+		"max_ratio":                -1,
+		"max_seeding_time_enabled": false,
+		"max_seeding_time":         -1,
+		"queueing_enabled":         false,
+		"dht":                      true,
+		"pex":                      true,
+		"listen_port":              tc.ExternalPort,
+		"dl_limit":                 0,
+		"up_limit":                 0,
+	})
+}
+
+func _qbTransferInfo(w http.ResponseWriter, r *http.Request) {
+	down, up := 0, 0
+	var downloaded, uploaded int64
+	for _, tu := range qbTorrents("all") {
+		info := tu.TorrentInfo()
+		down += info.DownloadRate
+		up += tu.UploadRate()
+		downloaded += info.BytesDownloaded
+		uploaded += info.BytesUploaded
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"dl_info_speed":     down,
+		"dl_info_data":      downloaded,
+		"up_info_speed":     up,
+		"up_info_data":      uploaded,
+		"dl_rate_limit":     0,
+		"up_rate_limit":     0,
+		"dht_nodes":         0,
+		"connection_status": "connected",
+	})
+}
+
+// qbTorrents finds torrents by hashes separated with |, all or empty means every torrent
+func qbTorrents(hashes string) []*TorrentWithUserData {
+	want := map[string]bool{}
+	if hashes != "" && hashes != "all" {
+		for _, h := range strings.Split(hashes, "|") {
+			want[strings.ToLower(h)] = true
+		}
+	}
+	rc := make([]*TorrentWithUserData, 0)
+	for _, tu := range tc.GetTorrents() {
+		if tu == nil || !tu.InfoReady || tu.Dead {
+			continue
+		}
+		if len(want) == 0 || want[strings.ToLower(tu.Tags.getString("infohash", ""))] {
+			rc = append(rc, tu)
+		}
+	}
+	return rc
+}
+
+// qbTorrent writes 404 as qBittorrent does if there is no torrent for hash parameter
+func qbTorrent(w http.ResponseWriter, r *http.Request) *TorrentWithUserData {
+	hash := r.FormValue("hash")
+	if hash == "" {
+		qbWrite(w, http.StatusBadRequest, "hash is required")
+		return nil
+	}
+	if list := qbTorrents(hash); len(list) == 1 {
+		return list[0]
+	}
+	qbWrite(w, http.StatusNotFound, "Torrent hash was not found")
+	return nil
+}
+
+func qbState(tu *TorrentWithUserData, info TorrentInfo) string {
+	if info.Completed {
+		switch {
+		case tu.Paused:
+			return "pausedUP"
+		case info.Leechers > 0:
+			return "uploading"
+		}
+		return "stalledUP"
+	}
+	switch {
+	case tu.UserPaused():
+		return "pausedDL"
+	case tu.Paused:
+		// paused by ttv itself, resumes on its own
+		return "queuedDL"
+	case tu.ForceDownload:
+		return "forcedDL"
+	case info.DownloadRate == 0 || info.Seeders == 0:
+		return "stalledDL"
+	}
+	return "downloading"
+}
+
+// qbFilters are filter parameter of /torrents/info to states
+var qbFilters = map[string][]string{
+	"downloading":         {"downloading", "stalledDL", "queuedDL", "forcedDL", "pausedDL"},
+	"seeding":             {"uploading", "stalledUP"},
+	"completed":           {"uploading", "stalledUP", "pausedUP"},
+	"paused":              {"pausedDL", "pausedUP"},
+	"stopped":             {"pausedDL", "pausedUP"},
+	"active":              {"downloading", "forcedDL", "uploading"},
+	"inactive":            {"stalledDL", "stalledUP", "queuedDL", "pausedDL", "pausedUP"},
+	"resumed":             {"downloading", "stalledDL", "queuedDL", "forcedDL", "uploading", "stalledUP"},
+	"running":             {"downloading", "stalledDL", "queuedDL", "forcedDL", "uploading", "stalledUP"},
+	"stalled":             {"stalledDL", "stalledUP"},
+	"stalled_uploading":   {"stalledUP"},
+	"stalled_downloading": {"stalledDL"},
+	"errored":             {},
+}
+
+// qbTags shows key=value tags as "key" when value is yes, "key=value" otherwise
+func qbTags(tu *TorrentWithUserData) []string {
+	rc := make([]string, 0)
+	for k, v := range *tu.Tags {
+		if qbSystemTags[k] {
+			continue
+		}
+		if s, ok := v.(string); ok && s == "yes" {
+			rc = append(rc, k)
+		} else {
+			rc = append(rc, k+"="+fmt.Sprint(v))
+		}
+	}
+	sort.Strings(rc)
+	return rc
+}
+
+// qbParseTag is reverse of qbTags
+func qbParseTag(tag string) (key string, value string) {
+	tag = strings.TrimSpace(tag)
+	if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 {
+		return strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+	}
+	return tag, "yes"
+}
+
+func qbSplitTags(tags string) []string {
+	rc := make([]string, 0)
+	for _, t := range strings.Split(tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			rc = append(rc, t)
+		}
+	}
+	return rc
+}
+
+func qbInfo(tu *TorrentWithUserData) qbTorrentInfo {
+	t := tu.torrent
+	mi := t.Metainfo()
+	info := tu.TorrentInfo()
+	// size and progress are of selected files, as in qBittorrent
+	size, done := tu.wantedBytes()
+	progress := 1.0
+	if size > 0 {
+		progress = float64(done) / float64(size)
+	}
+	left := tu.BytesLeft()
+	eta := int64(QB_ETA_INFINITY)
+	if left == 0 {
+		eta = 0
+	} else if info.DownloadRate > 0 && !tu.Paused {
+		eta = left / int64(info.DownloadRate)
+	}
+	ratio := 0.0
+	if info.BytesDownloaded > 0 {
+		ratio = float64(info.BytesUploaded) / float64(info.BytesDownloaded)
+	}
+	added := tu.Tags.getTime("added", time.Now())
+	completedOn := int64(0)
+	if tu.Tags.getString("completed", "") != "" {
+		completedOn = tu.Tags.getTime("completed", time.Time{}).Unix()
+	}
+	tracker := ""
+	if list := torrentTrackers(tu); len(list) > 0 {
+		tracker = list[0].Url
+	}
+	contentPath := tu.Tags.getString("datapath", "")
+	if len(t.Files()) == 1 {
+		contentPath = path.Join(tu.Tags.getString("download", ""), t.Files()[0].Path())
+	}
+	return qbTorrentInfo{
+		AddedOn:           added.Unix(),
+		AmountLeft:        left,
+		Availability:      -1,
+		Category:          tu.Tags.getString("category", ""),
+		Completed:         t.BytesCompleted(),
+		CompletionOn:      completedOn,
+		ContentPath:       contentPath,
+		DlLimit:           -1,
+		Dlspeed:           info.DownloadRate,
+		Downloaded:        info.BytesDownloaded,
+		DownloadedSession: info.BytesDownloaded,
+		Eta:               eta,
+		ForceStart:        tu.ForceDownload,
+		Hash:              tu.Tags.getString("infohash", ""),
+		LastActivity:      time.Now().Unix(),
+		MagnetUri:         mi.Magnet(t.Name(), t.InfoHash()).String(),
+		MaxRatio:          -1,
+		MaxSeedingTime:    -1,
+		Name:              tu.Name,
+		NumComplete:       info.Seeders,
+		NumIncomplete:     info.Leechers,
+		NumLeechs:         info.Leechers,
+		NumSeeds:          info.Seeders,
+		Progress:          progress,
+		Ratio:             ratio,
+		RatioLimit:        -2,
+		SavePath:          tu.Tags.getString("download", ""),
+		SeedingTimeLimit:  -2,
+		Size:              size,
+		State:             qbState(tu, info),
+		Tags:              strings.Join(qbTags(tu), ", "),
+		TimeActive:        int64(time.Since(added).Seconds()),
+		TotalSize:         t.Length(),
+		Tracker:           tracker,
+		UpLimit:           -1,
+		Uploaded:          info.BytesUploaded,
+		UploadedSession:   info.BytesUploaded,
+		Upspeed:           tu.UploadRate(),
+	}
+}
+
+// _qbTorrentsInfo supports filter, category, tag, hashes, sort, reverse, limit and offset
+func _qbTorrentsInfo(w http.ResponseWriter, r *http.Request) {
+	filter := r.FormValue("filter")
+	states, ok := qbFilters[filter]
+	if filter != "" && filter != "all" && !ok {
+		qbWrite(w, http.StatusBadRequest, "unknown filter "+filter)
+		return
+	}
+	_, byCategory := r.Form["category"]
+	_, byTag := r.Form["tag"]
+	rc := make([]qbTorrentInfo, 0)
+	for _, tu := range qbTorrents(r.FormValue("hashes")) {
+		info := qbInfo(tu)
+		if ok && !inList(info.State, states) {
+			continue
+		}
+		if byCategory && info.Category != r.FormValue("category") {
+			continue
+		}
+		if byTag && !inList(r.FormValue("tag"), qbTags(tu)) {
+			continue
+		}
+		rc = append(rc, info)
+	}
+	if key := r.FormValue("sort"); key != "" {
+		sort.SliceStable(rc, func(i, j int) bool { return qbLess(rc[i], rc[j], key) })
+	}
+	if r.FormValue("reverse") == "true" {
+		for i, j := 0, len(rc)-1; i < j; i, j = i+1, j-1 {
+			rc[i], rc[j] = rc[j], rc[i]
+		}
+	}
+	if offset, _ := strconv.Atoi(r.FormValue("offset")); offset > 0 {
+		if offset > len(rc) {
+			offset = len(rc)
+		}
+		rc = rc[offset:]
+	}
+	if limit, _ := strconv.Atoi(r.FormValue("limit")); limit > 0 && limit < len(rc) {
+		rc = rc[:limit]
+	}
+	writeJson(w, http.StatusOK, rc)
+}
+
+func inList(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func qbLess(a qbTorrentInfo, b qbTorrentInfo, key string) bool {
+	switch key {
+	case "name":
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	case "size", "total_size":
+		return a.Size < b.Size
+	case "progress":
+		return a.Progress < b.Progress
+	case "dlspeed":
+		return a.Dlspeed < b.Dlspeed
+	case "upspeed":
+		return a.Upspeed < b.Upspeed
+	case "eta":
+		return a.Eta < b.Eta
+	case "ratio":
+		return a.Ratio < b.Ratio
+	case "state":
+		return a.State < b.State
+	case "category":
+		return a.Category < b.Category
+	case "completion_on":
+		return a.CompletionOn < b.CompletionOn
+	}
+	return a.AddedOn < b.AddedOn
+}
+
+func _qbTorrentProperties(w http.ResponseWriter, r *http.Request) {
+	tu := qbTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	q := qbInfo(tu)
+	t := tu.torrent
+	mi := t.Metainfo()
+	have := 0
+	for _, run := range t.PieceStateRuns() {
+		if run.Complete {
+			have += run.Length
+		}
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"save_path":                q.SavePath,
+		"creation_date":            mi.CreationDate,
+		"piece_size":               t.Info().PieceLength,
+		"comment":                  mi.Comment,
+		"created_by":               mi.CreatedBy,
+		"total_wasted":             0,
+		"total_uploaded":           q.Uploaded,
+		"total_uploaded_session":   q.Uploaded,
+		"total_downloaded":         q.Downloaded,
+		"total_downloaded_session": q.Downloaded,
+		"up_limit":                 -1,
+		"dl_limit":                 -1,
+		"time_elapsed":             q.TimeActive,
+		"seeding_time":             0,
+		"nb_connections":           q.NumSeeds + q.NumLeechs,
+		"nb_connections_limit":     tu.maxConnections,
+		"share_ratio":              q.Ratio,
+		"addition_date":            q.AddedOn,
+		"completion_date":          q.CompletionOn,
+		"last_seen":                q.LastActivity,
+		"dl_speed":                 q.Dlspeed,
+		"dl_speed_avg":             q.Dlspeed,
+		"up_speed":                 q.Upspeed,
+		"up_speed_avg":             q.Upspeed,
+		"eta":                      q.Eta,
+		"peers":                    q.NumLeechs,
+		"peers_total":              q.NumLeechs,
+		"seeds":                    q.NumSeeds,
+		"seeds_total":              q.NumSeeds,
+		"pieces_num":               t.NumPieces(),
+		"pieces_have":              have,
+		"total_size":               q.TotalSize,
+	})
+}
+
+func _qbTorrentFiles(w http.ResponseWriter, r *http.Request) {
+	tu := qbTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	rc := make([]map[string]interface{}, 0)
+	pl := tu.torrent.Info().PieceLength
+	for i, f := range tu.Files() {
+		first := f.file.Offset() / pl
+		last := first
+		if f.file.Length() > 0 {
+			last = (f.file.Offset() + f.file.Length() - 1) / pl
+		}
+		progress := 1.0
+		if f.file.Length() > 0 {
+			progress = float64(f.file.BytesCompleted()) / float64(f.file.Length())
+		}
+		rc = append(rc, map[string]interface{}{
+			"index":        i,
+			"name":         f.file.Path(),
+			"size":         f.file.Length(),
+			"progress":     progress,
+			"priority":     qbPriorities[f.Priority()],
+			"is_seed":      progress == 1,
+			"piece_range":  []int64{first, last},
+			"availability": -1,
+		})
+	}
+	writeJson(w, http.StatusOK, rc)
+}
+
+func _qbTorrentTrackers(w http.ResponseWriter, r *http.Request) {
+	tu := qbTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	rc := make([]map[string]interface{}, 0)
+	for _, tr := range torrentTrackers(tu) {
+		rc = append(rc, map[string]interface{}{
+			"url":            tr.Url,
+			"tier":           tr.Tier,
+			"status":         1,
+			"num_peers":      -1,
+			"num_seeds":      -1,
+			"num_leeches":    -1,
+			"num_downloaded": -1,
+			"msg":            "",
+		})
+	}
+	writeJson(w, http.StatusOK, rc)
+}
+
+// qbCategoryFor picks category from category parameter or savepath, empty means default one
+func qbCategoryFor(category string, savepath string) (string, bool) {
+	if category != "" {
+		_, ok := GetCategory(category)
+		return category, ok
+	}
+	if savepath != "" {
+		if cat, ok := FindCategoryByDir(savepath); ok {
+			return cat.name, true
+		}
+		return "", false
+	}
+	return tc.KodiCategory, true
+}
+
+// _qbTorrentsAdd takes urls (one per line) and torrents files, answers Fails. if nothing was added
+func _qbTorrentsAdd(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(MAX_TORRENT_UPLOAD); err != nil && err != http.ErrNotMultipart {
+		qbWrite(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cat, ok := qbCategoryFor(r.FormValue("category"), r.FormValue("savepath"))
+	if !ok {
+		log.Warn("qbittorrent add: no category '%s' for savepath '%s'", r.FormValue("category"), r.FormValue("savepath"))
+		qbWrite(w, http.StatusConflict, "Incorrect category name")
+		return
+	}
+	base := AddTorrentRequest{
+		Name:     r.FormValue("rename"),
+		Category: cat,
+		Paused:   r.FormValue("paused") == "true" || r.FormValue("stopped") == "true",
+		Tags:     map[string]string{},
+	}
+	for _, t := range qbSplitTags(r.FormValue("tags")) {
+		if k, v := qbParseTag(t); k != "" && !qbSystemTags[k] {
+			base.Tags[k] = v
+		}
+	}
+	added, failed := 0, 0
+	add := func(req AddTorrentRequest, data []byte) {
+		if _, status, err := addTorrent(req, data, "qbittorrent"); err != nil && status != http.StatusConflict {
+			log.Warn("qbittorrent add failed: %v", err)
+			failed += 1
+		} else {
+			added += 1
+		}
+	}
+	for _, u := range strings.Split(r.FormValue("urls"), "\n") {
+		req := base
+		switch u = strings.TrimSpace(u); {
+		case u == "":
+			continue
+		case strings.HasPrefix(u, "magnet:"):
+			req.Magnet = u
+		default:
+			req.Url = u
+		}
+		add(req, nil)
+	}
+	if r.MultipartForm != nil {
+		for _, fh := range r.MultipartForm.File["torrents"] {
+			f, err := fh.Open()
+			if err != nil {
+				failed += 1
+				continue
+			}
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				failed += 1
+				continue
+			}
+			add(base, data)
+		}
+	}
+	if added == 0 {
+		if failed == 0 {
+			qbWrite(w, http.StatusBadRequest, "no urls or torrents given")
+			return
+		}
+		qbWrite(w, http.StatusOK, "Fails.")
+		return
+	}
+	qbWrite(w, http.StatusOK, "Ok.")
+}
+
+func _qbTorrentsPause(w http.ResponseWriter, r *http.Request) {
+	for _, tu := range qbTorrents(r.FormValue("hashes")) {
+		tu.UserPause("paused via qbittorrent api")
+		tu.SaveTags()
+	}
+	qbWrite(w, http.StatusOK, "")
+}
+
+func _qbTorrentsResume(w http.ResponseWriter, r *http.Request) {
+	for _, tu := range qbTorrents(r.FormValue("hashes")) {
+		tu.UserResume("resumed via qbittorrent api")
+		tu.SaveTags()
+	}
+	qbWrite(w, http.StatusOK, "")
+}
+
+func _qbTorrentsDelete(w http.ResponseWriter, r *http.Request) {
+	hashes := r.FormValue("hashes")
+	if hashes == "" {
+		qbWrite(w, http.StatusBadRequest, "hashes is required")
+		return
+	}
+	for _, tu := range qbTorrents(hashes) {
+		// torrents in play are removed by ProcessTags later
+		tc.DropTorrent(tu, "deleted via qbittorrent api", r.FormValue("deleteFiles") == "true", false)
+	}
+	qbWrite(w, http.StatusOK, "")
+}
+
+func _qbCategories(w http.ResponseWriter, r *http.Request) {
+	rc := map[string]qbCategory{}
+	for _, cat := range GetCategories() {
+		rc[cat.name] = qbCategory{Name: cat.name, SavePath: cat.download}
+	}
+	writeJson(w, http.StatusOK, rc)
+}
+
+// _qbCreateCategory creates category dir, savePath can't be chosen, it is always inside torrents dir
+func _qbCreateCategory(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("category")
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		qbWrite(w, http.StatusBadRequest, "Invalid category name")
+		return
+	}
+	if _, ok := GetCategory(name); ok {
+		qbWrite(w, http.StatusConflict, "Category already exists")
+		return
+	}
+	download := path.Join(basedir, name, "downloads")
+	if err := os.MkdirAll(download, 0775); err != nil {
+		log.Error("failed to create %s: %v", download, err)
+		qbWrite(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	qbWrite(w, http.StatusOK, "")
+}
+
+// _qbSetCategory can't move data between category dirs, only no-op changes are accepted
+func _qbSetCategory(w http.ResponseWriter, r *http.Request) {
+	cat := r.FormValue("category")
+	if _, ok := GetCategory(cat); !ok {
+		qbWrite(w, http.StatusConflict, "Incorrect category name")
+		return
+	}
+	for _, tu := range qbTorrents(r.FormValue("hashes")) {
+		if tu.Tags.getString("category", "") != cat {
+			qbWrite(w, http.StatusConflict, "moving torrents between categories is not supported")
+			return
+		}
+	}
+	qbWrite(w, http.StatusOK, "")
+}
+
+func _qbTags(w http.ResponseWriter, r *http.Request) {
+	set := map[string]bool{}
+	for _, tu := range qbTorrents("all") {
+		for _, t := range qbTags(tu) {
+			set[t] = true
+		}
+	}
+	rc := make([]string, 0)
+	for t := range set {
+		rc = append(rc, t)
+	}
+	sort.Strings(rc)
+	writeJson(w, http.StatusOK, rc)
+}
+
+// _qbCreateTags does nothing, ttv tags live on torrents only
+func _qbCreateTags(w http.ResponseWriter, r *http.Request) {
+	qbWrite(w, http.StatusOK, "")
+}
+
+func _qbDeleteTags(w http.ResponseWriter, r *http.Request) {
+	qbUpdateTags("all", r.FormValue("tags"), false)
+	qbWrite(w, http.StatusOK, "")
+}
+
+func _qbAddTags(w http.ResponseWriter, r *http.Request) {
+	qbUpdateTags(r.FormValue("hashes"), r.FormValue("tags"), true)
+	qbWrite(w, http.StatusOK, "")
+}
+
+func _qbRemoveTags(w http.ResponseWriter, r *http.Request) {
+	qbUpdateTags(r.FormValue("hashes"), r.FormValue("tags"), false)
+	qbWrite(w, http.StatusOK, "")
+}
+
+// qbUpdateTags sets or removes tags, bookkeeping tags can't be changed
+func qbUpdateTags(hashes string, tags string, set bool) {
+	changed := false
+	for _, tu := range qbTorrents(hashes) {
+		update := Tags{}
+		for _, t := range qbSplitTags(tags) {
+			k, v := qbParseTag(t)
+			if k == "" || qbSystemTags[k] {
+				continue
+			}
+			if set {
+				tu.Tags.Set(k, v)
+				update[k] = v
+			} else if _, ok := (*tu.Tags)[k]; ok {
+				tu.Tags.Remove(k)
+				update[k] = nil
+			}
+		}
+		if len(update) > 0 {
+			Emit(EvTagsChanged, tu, "", update)
+			changed = true
+		}
+	}
+	if changed {
+		tc.ProcessTags()
+	}
+}
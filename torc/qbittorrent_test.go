@@ -0,0 +1,148 @@
+package torc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// qbRequest sends request the way download managers do, form values in body
+func qbRequest(t *testing.T, method string, endpoint string, contentType string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, testServer.URL+QB_PREFIX+endpoint, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp, data
+}
+
+const qbFormType = "application/x-www-form-urlencoded"
+
+func TestQbitLogin(t *testing.T) {
+	// auth is off in tests, any user gets in
+	resp, body := qbRequest(t, "POST", "/auth/login", qbFormType, []byte("username=admin&password=adminadmin"))
+	if resp.StatusCode != http.StatusOK || string(body) != "Ok." {
+		t.Fatalf("login: %d %q", resp.StatusCode, body)
+	}
+	found := false
+	for _, c := range resp.Cookies() {
+		found = found || (c.Name == AUTH_COOKIE && c.Value != "")
+	}
+	if !found {
+		t.Errorf("no %s cookie in %v", AUTH_COOKIE, resp.Header["Set-Cookie"])
+	}
+	if resp, body = qbRequest(t, "GET", "/app/webapiVersion", "", nil); string(body) != QB_WEBAPI_VERSION {
+		t.Errorf("webapiVersion: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestQbitTorrents(t *testing.T) {
+	cat, _ := GetCategory(TEST_CATEGORY)
+	data := makeTorrent(t, cat.download, "Qbit Movie", map[string]int{"movie.mkv": 50000, "movie.srt": 2000})
+	defer os.RemoveAll(path.Join(cat.download, "Qbit Movie"))
+	mi, err := metainfo.Load(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := mi.HashInfoBytes().HexString()
+
+	// add as sent by sonarr, control tags are dropped
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, _ := mw.CreateFormFile("torrents", "Qbit Movie.torrent")
+	fw.Write(data)
+	mw.WriteField("category", TEST_CATEGORY)
+	mw.WriteField("paused", "true")
+	mw.WriteField("tags", "sonarr,kill_it,drop_watched=yes")
+	mw.Close()
+	resp, body := qbRequest(t, "POST", "/torrents/add", mw.FormDataContentType(), form.Bytes())
+	if resp.StatusCode != http.StatusOK || string(body) != "Ok." {
+		t.Fatalf("add: %d %q", resp.StatusCode, body)
+	}
+	defer tc.RemoveTorrent(hash)
+	tu, _ := tc.GetTorrent(hash)
+	if tu == nil {
+		t.Fatalf("%s isn't added", hash)
+	}
+	if tu.Tags.getString("sonarr", "") != "yes" || tu.Tags.getString("kill_it", "") != "" || tu.Tags.getString("drop_watched", "") != "" {
+		t.Errorf("tags after add %v", *tu.Tags)
+	}
+	tu.Tags.Set("watched", "yes")
+
+	resp, body = qbRequest(t, "GET", "/torrents/info?category="+TEST_CATEGORY+"&hashes="+hash, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("info: %d %q", resp.StatusCode, body)
+	}
+	var infos []qbTorrentInfo
+	if err := json.Unmarshal(body, &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("info has %d torrents", len(infos))
+	}
+	qi := infos[0]
+	if qi.Hash != hash || qi.Name != "Qbit Movie" || qi.Category != TEST_CATEGORY || qi.Size != 52000 {
+		t.Errorf("info %+v", qi)
+	}
+	if !strings.HasPrefix(qi.State, "paused") {
+		t.Errorf("state %s of paused torrent", qi.State)
+	}
+	if qi.Tags != "sonarr" {
+		t.Errorf("tags %q, want only sonarr", qi.Tags)
+	}
+
+	resp, body = qbRequest(t, "GET", "/torrents/files?hash="+hash, "", nil)
+	var files []map[string]interface{}
+	if err := json.Unmarshal(body, &files); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("files: %d %q", resp.StatusCode, body)
+	}
+	if len(files) != 2 {
+		t.Fatalf("%d files, want 2", len(files))
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f["name"].(string), "Qbit Movie/movie.") || f["size"].(float64) == 0 {
+			t.Errorf("file %v", f)
+		}
+	}
+	if resp, _ = qbRequest(t, "GET", "/torrents/files?hash=0000000000000000000000000000000000000000", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("files of unknown hash: %d, want 404", resp.StatusCode)
+	}
+
+	for _, c := range []struct {
+		category string
+		status   int
+	}{{TEST_CATEGORY, http.StatusOK}, {"tv", http.StatusConflict}} {
+		resp, body = qbRequest(t, "POST", "/torrents/setCategory", qbFormType, []byte("hashes="+hash+"&category="+c.category))
+		if resp.StatusCode != c.status {
+			t.Errorf("setCategory %s: %d %q, want %d", c.category, resp.StatusCode, body, c.status)
+		}
+	}
+}
+
+func TestQbitDoesNotShadowApi(t *testing.T) {
+	resp, err := http.Get(testServer.URL + API_PREFIX + "/torrents/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("ttv torrent named info: %d, want 404", resp.StatusCode)
+	}
+}
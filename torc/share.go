@@ -0,0 +1,355 @@
+package torc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"ttv/client"
+)
+
+// how long share link lives when ttl is not given
+const SHARE_DEFAULT_TTL = 24 * time.Hour
+
+// how long signed /play links work, they are signed with the same secret as share links
+const PLAY_LINK_TTL = 24 * time.Hour
+
+// smallest chunk rate limited stream reads at once
+const SHARE_MIN_BURST = 32 << 10
+
+type ShareLink = client.ShareLink
+type ShareLinkResponse = client.ShareLinkResponse
+
+// shareLink is link in shares, its counters change under shares lock
+type shareLink struct {
+	ShareLink `yaml:",inline"`
+	limiter   *rate.Limiter
+	revoked   int32
+}
+
+// shareFile is what is kept on disk
+type shareFile struct {
+	Secret string                `yaml:"secret"`
+	Links  map[string]*shareLink `yaml:"links"`
+}
+
+type shareStore struct {
+	shareFile
+	file string
+
+	sync.Mutex
+}
+
+var shares = shareStore{shareFile: shareFile{Links: map[string]*shareLink{}}}
+
+// LoadShares reads links and signing secret, secret is generated on first run
+func LoadShares(file string) {
+	shares.Lock()
+	defer shares.Unlock()
+	shares.file = file
+	if data, err := ioutil.ReadFile(file); err == nil {
+		if err := yaml.Unmarshal(data, &shares.shareFile); err != nil {
+			log.Error("failed to yaml.Unmarshal %s: %v, starting without share links", file, err)
+		}
+	}
+	if shares.Links == nil {
+		shares.Links = map[string]*shareLink{}
+	}
+	if shares.Secret == "" {
+		shares.Secret = randomHex(32)
+		log.Info("new share links secret generated")
+	}
+	now := time.Now()
+	for id, l := range shares.Links {
+		if l.Expires.Before(now) {
+			log.Debug("share %s for %s expired, dropping", id, l.File)
+			delete(shares.Links, id)
+			continue
+		}
+		l.limiter = newShareLimiter(l.Rate)
+	}
+	shares.save()
+	log.Info("%d share links loaded from %s", len(shares.Links), file)
+}
+
+func (s *shareStore) save() {
+	data, err := yaml.Marshal(&s.shareFile)
+	if err != nil {
+		log.Error("failed to yaml.Marshal shares: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(s.file, data, 0600); err != nil {
+		log.Error("failed to WriteFile %s: %v", s.file, err)
+	}
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(log.Error("failed to read random: %v", err))
+	}
+	return hex.EncodeToString(buf)
+}
+
+func newShareLimiter(bps int) *rate.Limiter {
+	if bps <= 0 {
+		return nil
+	}
+	burst := bps
+	if burst < SHARE_MIN_BURST {
+		burst = SHARE_MIN_BURST
+	}
+	return rate.NewLimiter(rate.Limit(bps), burst)
+}
+
+func (s *shareStore) sign(l *shareLink) string {
+	m := hmac.New(sha256.New, []byte(s.Secret))
+	fmt.Fprintf(m, "%s|%s|%s|%d", l.Id, l.InfoHash, l.File, l.Expires.Unix())
+	return hex.EncodeToString(m.Sum(nil))[:32]
+}
+
+func (s *shareStore) signPlay(name string, file string, exp int64) string {
+	m := hmac.New(sha256.New, []byte(s.Secret))
+	fmt.Fprintf(m, "play|%s|%s|%d", name, file, exp)
+	return hex.EncodeToString(m.Sum(nil))[:32]
+}
+
+// playLinkQuery is exp and sig of /play link to file of torrent name
+func playLinkQuery(name string, file string) string {
+	exp := time.Now().Add(PLAY_LINK_TTL).Unix()
+	shares.Lock()
+	defer shares.Unlock()
+	return fmt.Sprintf("exp=%d&sig=%s", exp, shares.signPlay(name, file, exp))
+}
+
+// validPlayLink is true for /play request with signature made by playLinkQuery which hasn't expired
+func validPlayLink(r *http.Request) bool {
+	vars := mux.Vars(r)
+	name, _ := url.QueryUnescape(vars["name"])
+	file, _ := url.QueryUnescape(vars["file"])
+	exp, err := strconv.ParseInt(r.URL.Query().Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	shares.Lock()
+	sig := shares.signPlay(name, file, exp)
+	shares.Unlock()
+	return hmac.Equal([]byte(sig), []byte(r.URL.Query().Get("sig")))
+}
+
+func (s *shareStore) path(l *shareLink) string {
+	return fmt.Sprintf("/share/%s/%d/%s/%s", l.Id, l.Expires.Unix(), s.sign(l), url.PathEscape(path.Base(l.File)))
+}
+
+// acquire counts new stream, false if link already has MaxStreams streams
+func (l *shareLink) acquire(client string) bool {
+	shares.Lock()
+	defer shares.Unlock()
+	if l.MaxStreams > 0 && l.ActiveStreams >= l.MaxStreams {
+		return false
+	}
+	l.ActiveStreams += 1
+	l.Uses += 1
+	l.LastUsed = time.Now()
+	l.LastClient = client
+	return true
+}
+
+func (l *shareLink) release() {
+	shares.Lock()
+	defer shares.Unlock()
+	l.ActiveStreams -= 1
+	shares.save()
+}
+
+type shareReader struct {
+	rs     io.ReadSeeker
+	ctx    context.Context
+	link   *shareLink
+	served int64
+}
+
+// Open wraps file reader with link's bandwidth cap
+func (l *shareLink) Open(ctx context.Context, rs io.ReadSeeker) io.ReadSeeker {
+	return &shareReader{rs: rs, ctx: ctx, link: l}
+}
+
+// Close returns bytes served by reader from Open
+func (l *shareLink) Close(rs io.ReadSeeker) int64 {
+	sr, ok := rs.(*shareReader)
+	if !ok {
+		return 0
+	}
+	shares.Lock()
+	l.BytesServed += sr.served
+	shares.Unlock()
+	return sr.served
+}
+
+func (r *shareReader) Read(p []byte) (n int, err error) {
+	if atomic.LoadInt32(&r.link.revoked) != 0 {
+		return 0, newError("share %s revoked", r.link.Id)
+	}
+	lim := r.link.limiter
+	if lim != nil && len(p) > lim.Burst() {
+		p = p[:lim.Burst()]
+	}
+	n, err = r.rs.Read(p)
+	r.served += int64(n)
+	if lim != nil && n > 0 {
+		if werr := lim.WaitN(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return
+}
+
+func (r *shareReader) Seek(offset int64, whence int) (int64, error) {
+	return r.rs.Seek(offset, whence)
+}
+
+func _Share(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shares.Lock()
+	l, ok := shares.Links[vars["id"]]
+	sig := ""
+	if ok {
+		sig = shares.sign(l)
+	}
+	shares.Unlock()
+	if !ok {
+		log.Error(httpError(w, http.StatusNotFound, "share link not found or revoked"))
+		return
+	}
+	exp, _ := strconv.ParseInt(vars["exp"], 10, 64)
+	if exp != l.Expires.Unix() || !hmac.Equal([]byte(sig), []byte(vars["sig"])) {
+		log.Error(httpError(w, http.StatusForbidden, "bad share link signature"))
+		return
+	}
+	if time.Now().After(l.Expires) {
+		log.Error(httpError(w, http.StatusGone, "share link expired at %s", l.Expires.Format(time.RFC822)))
+		return
+	}
+	tu, _ := tc.GetTorrent(l.InfoHash)
+	if tu == nil || !tu.InfoReady {
+		log.Error(httpError(w, http.StatusNotFound, "shared torrent %s is gone", l.Torrent))
+		return
+	}
+	file := tu.GetFile(l.File)
+	if file == nil {
+		log.Error(httpError(w, http.StatusNotFound, "shared file %s is gone", l.File))
+		return
+	}
+	if r.Method == "GET" {
+		if !l.acquire(r.RemoteAddr) {
+			log.Error(httpError(w, http.StatusTooManyRequests, "share %s already has %d streams", l.Id, l.MaxStreams))
+			return
+		}
+		defer l.release()
+	}
+	playFile(w, r, tu, file, l)
+}
+
+func _apiSharesList(w http.ResponseWriter, r *http.Request) {
+	shares.Lock()
+	rc := make([]ShareLinkResponse, 0)
+	for _, l := range shares.Links {
+		// copy, streams change counters
+		rc = append(rc, ShareLinkResponse{Url: baseUrl(r) + shares.path(l), Link: l.ShareLink})
+	}
+	shares.Unlock()
+	sort.Slice(rc, func(i, j int) bool { return rc[i].Link.Created.Before(rc[j].Link.Created) })
+	writeJson(w, http.StatusOK, rc)
+}
+
+// _apiShareCreate takes torrent, file (name or index), ttl (duration), rate (bytes/sec), streams and comment
+func _apiShareCreate(w http.ResponseWriter, r *http.Request) {
+	tu, _ := tc.GetTorrent(r.FormValue("torrent"))
+	if tu == nil || !tu.InfoReady {
+		httpError(w, http.StatusNotFound, "torrent '%s' not found", r.FormValue("torrent"))
+		return
+	}
+	var file *TorrentFile
+	if index, err := strconv.Atoi(r.FormValue("file")); err == nil {
+		file = tu.GetFile(index)
+	} else {
+		file = tu.GetFile(r.FormValue("file"))
+	}
+	if file == nil {
+		httpError(w, http.StatusNotFound, "file '%s' not found in %s", r.FormValue("file"), tu.Name)
+		return
+	}
+	ttl := SHARE_DEFAULT_TTL
+	if v := r.FormValue("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			httpError(w, http.StatusBadRequest, "bad ttl '%s'", v)
+			return
+		}
+		ttl = d
+	}
+	bps, _ := strconv.Atoi(r.FormValue("rate"))
+	streams, _ := strconv.Atoi(r.FormValue("streams"))
+	if bps < 0 || streams < 0 {
+		httpError(w, http.StatusBadRequest, "rate and streams can't be negative")
+		return
+	}
+	by := ""
+	if id := RequestIdentity(r); id != nil {
+		by = id.Name
+	}
+	now := time.Now()
+	l := &shareLink{ShareLink: ShareLink{
+		Id:         randomHex(8),
+		InfoHash:   tu.Tags.getString("infohash", ""),
+		Torrent:    tu.Name,
+		File:       file.file.DisplayPath(),
+		Expires:    now.Add(ttl).Truncate(time.Second),
+		Rate:       bps,
+		MaxStreams: streams,
+		Created:    now,
+		CreatedBy:  by,
+		Comment:    r.FormValue("comment"),
+	}, limiter: newShareLimiter(bps)}
+	shares.Lock()
+	shares.Links[l.Id] = l
+	shares.save()
+	rc := ShareLinkResponse{Url: baseUrl(r) + shares.path(l), Link: l.ShareLink}
+	shares.Unlock()
+	log.Info("share %s for %s - %s created by '%s', expires %s", l.Id, l.Torrent, l.File, by, l.Expires.Format(time.RFC822))
+
+	w.Header().Set("Location", API_PREFIX+"/shares/"+l.Id)
+	writeJson(w, http.StatusCreated, rc)
+}
+
+func _apiShareDelete(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	shares.Lock()
+	defer shares.Unlock()
+	l, ok := shares.Links[id]
+	if !ok {
+		httpError(w, http.StatusNotFound, "share '%s' not found", id)
+		return
+	}
+	// running streams stop on next read
+	atomic.StoreInt32(&l.revoked, 1)
+	delete(shares.Links, id)
+	shares.save()
+	log.Info("share %s for %s revoked, active streams: %d", id, l.File, l.ActiveStreams)
+	w.WriteHeader(http.StatusNoContent)
+}
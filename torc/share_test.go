@@ -0,0 +1,95 @@
+package torc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"ttv/client"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPlayLinkSignature(t *testing.T) {
+	name, file := "0123456789abcdef0123456789abcdef01234567", "Show/e01 & e02.mkv"
+	request := func(file string, query string) bool {
+		r := httptest.NewRequest("GET", "/play/x/y?"+query, nil)
+		r = mux.SetURLVars(r, map[string]string{"name": name, "file": url.QueryEscape(file)})
+		return validPlayLink(r)
+	}
+	q := playLinkQuery(name, file)
+	if !request(file, q) {
+		t.Errorf("%s isn't valid for %s", q, file)
+	}
+	if request("Show/e03.mkv", q) {
+		t.Errorf("signature of %s is valid for other file", file)
+	}
+	if request(file, strings.Replace(q, "exp=", "exp=1", 1)) {
+		t.Errorf("changed exp is valid")
+	}
+	if request(file, "exp=1&"+q[strings.Index(q, "sig="):]) {
+		t.Errorf("expired link is valid")
+	}
+}
+
+func TestClientShares(t *testing.T) {
+	tu := addTestTorrent(t, "Shared Movie", map[string]int{"movie.mkv": 40000})
+	c := client.New(testServer.URL)
+	sl, err := c.CreateShare(client.ShareRequest{Torrent: tu.Name, File: "0", Ttl: time.Hour, Rate: 1 << 20, Comment: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sl.Url, testServer.URL+"/share/"+sl.Link.Id+"/") || sl.Link.File != "movie.mkv" || sl.Link.Rate != 1<<20 {
+		t.Fatalf("created %+v", sl)
+	}
+	// list while share streams, counters are copied under lock
+	done := make(chan int)
+	go func() {
+		resp, err := http.Get(sl.Url)
+		if err != nil {
+			done <- 0
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	for running := true; running; {
+		select {
+		case status := <-done:
+			if status != http.StatusOK {
+				t.Errorf("GET share: %d", status)
+			}
+			running = false
+		default:
+			if _, err := c.Shares(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	list, err := c.Shares()
+	found := false
+	for _, l := range list {
+		if l.Link.Id == sl.Link.Id {
+			found = l.Url == sl.Url && l.Link.Uses == 1 && l.Link.BytesServed == 40000
+			if !found {
+				t.Errorf("listed %+v", l)
+			}
+		}
+	}
+	if err != nil || !found {
+		t.Errorf("shares %v: %v", err, list)
+	}
+	if err := c.RevokeShare(sl.Link.Id); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.Get(sl.Url); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("revoked share: %v %v", err, resp)
+	}
+	if err := c.RevokeShare(sl.Link.Id); apiStatus(err) != http.StatusNotFound {
+		t.Errorf("second revoke: %v, want 404", err)
+	}
+}
@@ -0,0 +1,239 @@
+package torc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"golang.org/x/net/ipv4"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const SSDP_ADDR = "239.255.255.250:1900"
+const SSDP_MAX_AGE = 1800
+
+// alive is repeated well before max-age runs out
+const SSDP_NOTIFY_INTERVAL = SSDP_MAX_AGE / 3 * time.Second
+
+// responses to M-SEARCH are delayed randomly up to MX, but not more than this
+const SSDP_MAX_DELAY = time.Second
+
+var ssdpServer = fmt.Sprintf("%s/1.0 UPnP/1.0 ttv/%s", runtime.GOOS, API_VERSION)
+
+// Ssdp announces root device at Location and answers searches for it and its services
+type Ssdp struct {
+	Uuid     string
+	Types    []string
+	Port     int64
+	Location string // path of device description
+	Tls      bool   // device description is served by https
+	group    *net.UDPAddr
+	conn     *net.UDPConn
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewSsdp(group string, uuid string, port int64, location string, types ...string) (*Ssdp, error) {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, newError("bad ssdp address %s: %v", group, err)
+	}
+	return &Ssdp{Uuid: uuid, Types: types, Port: port, Location: location, group: addr, done: make(chan struct{})}, nil
+}
+
+func (s *Ssdp) Start() (err error) {
+	if s.group.IP.IsMulticast() {
+		s.conn, err = net.ListenMulticastUDP("udp4", nil, s.group)
+	} else {
+		// unicast address is for tests and networks without multicast
+		s.conn, err = net.ListenUDP("udp4", s.group)
+	}
+	if err != nil {
+		return newError("failed to listen ssdp on %s: %v", s.group, err)
+	}
+	log.Info("ssdp on %s, %s", s.group, s.Uuid)
+	s.wg.Add(2)
+	go s.serve()
+	go s.announce()
+	return nil
+}
+
+func (s *Ssdp) Close() {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	close(s.done)
+	s.notify("ssdp:byebye")
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.wg.Wait()
+}
+
+// usn is unique service name for notification type
+func (s *Ssdp) usn(nt string) string {
+	if nt == "uuid:"+s.Uuid {
+		return nt
+	}
+	return "uuid:" + s.Uuid + "::" + nt
+}
+
+func (s *Ssdp) notificationTypes() []string {
+	return append([]string{"upnp:rootdevice", "uuid:" + s.Uuid}, s.Types...)
+}
+
+// location uses address of interface remote is reachable through
+func (s *Ssdp) location(local net.IP) string {
+	scheme := "http://"
+	if s.Tls {
+		scheme = "https://"
+	}
+	return scheme + net.JoinHostPort(local.String(), strconv.FormatInt(s.Port, 10)) + s.Location
+}
+
+func localIpFor(remote *net.UDPAddr) net.IP {
+	c, err := net.DialUDP("udp4", nil, remote)
+	if err != nil {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP
+}
+
+func (s *Ssdp) serve() {
+	defer s.wg.Done()
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Warn("ssdp read failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+		go s.answer(req.Header.Get("St"), req.Header.Get("Mx"), from)
+	}
+}
+
+// answer sends one response per matching type, ssdp:all gets all of them
+func (s *Ssdp) answer(st string, mx string, to *net.UDPAddr) {
+	types := make([]string, 0)
+	for _, nt := range s.notificationTypes() {
+		if st == "ssdp:all" || st == nt {
+			types = append(types, nt)
+		}
+	}
+	if len(types) == 0 {
+		return
+	}
+	delay := SSDP_MAX_DELAY
+	if v, err := strconv.Atoi(mx); err == nil && time.Duration(v)*time.Second < delay {
+		delay = time.Duration(v) * time.Second
+	}
+	if delay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(delay))))
+	}
+	location := s.location(localIpFor(to))
+	log.Debug("ssdp search %s from %s, answering %v", st, to, types)
+	for _, nt := range types {
+		msg := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=" + strconv.Itoa(SSDP_MAX_AGE) + "\r\n" +
+			"DATE: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+			"EXT:\r\n" +
+			"LOCATION: " + location + "\r\n" +
+			"SERVER: " + ssdpServer + "\r\n" +
+			"ST: " + nt + "\r\n" +
+			"USN: " + s.usn(nt) + "\r\n" +
+			"Content-Length: 0\r\n\r\n"
+		if _, err := s.conn.WriteToUDP([]byte(msg), to); err != nil {
+			log.Warn("ssdp answer to %s failed: %v", to, err)
+			return
+		}
+	}
+}
+
+func (s *Ssdp) announce() {
+	defer s.wg.Done()
+	s.notify("ssdp:alive")
+	t := time.NewTicker(SSDP_NOTIFY_INTERVAL)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.notify("ssdp:alive")
+		}
+	}
+}
+
+// notify sends alive or byebye through every multicast interface with its own location
+func (s *Ssdp) notify(nts string) {
+	if !s.group.IP.IsMulticast() {
+		return
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Warn("ssdp: no interfaces: %v", err)
+		return
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || ipn.IP.To4() == nil {
+				continue
+			}
+			s.notifyVia(iface, ipn.IP, nts)
+		}
+	}
+}
+
+func (s *Ssdp) notifyVia(iface net.Interface, ip net.IP, nts string) {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		log.Warn("ssdp: failed to bind %s: %v", ip, err)
+		return
+	}
+	defer c.Close()
+	pc := ipv4.NewPacketConn(c)
+	if err := pc.SetMulticastInterface(&iface); err != nil {
+		log.Warn("ssdp: failed to use %s for multicast: %v", iface.Name, err)
+		return
+	}
+	_ = pc.SetMulticastLoopback(true)
+	for _, nt := range s.notificationTypes() {
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: " + SSDP_ADDR + "\r\n" +
+			"NT: " + nt + "\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"USN: " + s.usn(nt) + "\r\n"
+		if nts == "ssdp:alive" {
+			msg += "CACHE-CONTROL: max-age=" + strconv.Itoa(SSDP_MAX_AGE) + "\r\n" +
+				"LOCATION: " + s.location(ip) + "\r\n" +
+				"SERVER: " + ssdpServer + "\r\n"
+		}
+		if _, err := c.WriteToUDP([]byte(msg+"\r\n"), s.group); err != nil {
+			log.Trace("ssdp notify via %s failed: %v", iface.Name, err)
+			return
+		}
+	}
+}
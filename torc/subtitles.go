@@ -0,0 +1,411 @@
+package torc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// subtitles are small, anything bigger is not a subtitle
+const MAX_SUBTITLE_SIZE = 10 << 20
+
+var subtitleFormats = map[string]string{".srt": "srt", ".ass": "ass", ".ssa": "ssa", ".vtt": "vtt", ".sub": "sub"}
+
+// language names and ISO 639-1/639-2 codes seen in subtitle names, all go to 639-1
+var subtitleLanguages = map[string]string{}
+
+func init() {
+	for _, l := range [][]string{
+		{"en", "eng", "english"}, {"ru", "rus", "russian"}, {"uk", "ukr", "ukrainian"}, {"es", "spa", "spanish", "esp", "espanol"},
+		{"fr", "fre", "fra", "french"}, {"de", "ger", "deu", "german"}, {"it", "ita", "italian"}, {"pt", "por", "portuguese", "brazilian"},
+		{"nl", "dut", "nld", "dutch"}, {"pl", "pol", "polish"}, {"cs", "cze", "ces", "czech"}, {"sk", "slo", "slk", "slovak"},
+		{"sl", "slv", "slovenian"}, {"hr", "hrv", "croatian"}, {"sr", "srp", "serbian"}, {"bg", "bul", "bulgarian"},
+		{"ro", "rum", "ron", "romanian"}, {"hu", "hun", "hungarian"}, {"el", "gre", "ell", "greek"}, {"tr", "tur", "turkish"},
+		{"he", "heb", "hebrew"}, {"ar", "ara", "arabic"}, {"sv", "swe", "swedish"}, {"no", "nor", "norwegian"},
+		{"da", "dan", "danish"}, {"fi", "fin", "finnish"}, {"ja", "jpn", "japanese"}, {"ko", "kor", "korean"},
+		{"zh", "chi", "zho", "chinese"}, {"vi", "vie", "vietnamese"}, {"th", "tha", "thai"}, {"id", "ind", "indonesian"},
+	} {
+		for _, name := range l {
+			subtitleLanguages[name] = l[0]
+		}
+	}
+}
+
+// legacy code page for subtitles which are not UTF-8, by language
+var subtitleCharsets = map[string]encoding.Encoding{
+	"ru": charmap.Windows1251, "uk": charmap.Windows1251, "bg": charmap.Windows1251, "sr": charmap.Windows1251,
+	"pl": charmap.Windows1250, "cs": charmap.Windows1250, "sk": charmap.Windows1250, "sl": charmap.Windows1250,
+	"hr": charmap.Windows1250, "hu": charmap.Windows1250, "ro": charmap.Windows1250,
+	"el": charmap.Windows1253, "tr": charmap.Windows1254, "he": charmap.Windows1255, "ar": charmap.Windows1256,
+}
+
+var (
+	reSubtitleToken = regexp.MustCompile(`[^\pL\pN]+`)
+	reSubsDir       = regexp.MustCompile(`(?i)^(subs?|subtitles?)$`)
+)
+
+func subtitleFormat(name string) string {
+	return subtitleFormats[strings.ToLower(path.Ext(name))]
+}
+
+func isVideo(name string) bool {
+	return strings.HasPrefix(mimeByExtension(name), "video/")
+}
+
+func nameWithoutExt(name string) string {
+	return strings.TrimSuffix(path.Base(name), path.Ext(name))
+}
+
+// subtitleLanguage takes language and forced flag from name part which is not video name
+func subtitleLanguage(rest string) (lang string, forced bool) {
+	for _, tok := range reSubtitleToken.Split(strings.ToLower(rest), -1) {
+		if tok == "forced" {
+			forced = true
+		} else if l, ok := subtitleLanguages[tok]; ok && lang == "" {
+			lang = l
+		}
+	}
+	return
+}
+
+// underSubsDir tells if sub is in dir or in Subs folder somewhere below it
+func underSubsDir(sub string, dir string) bool {
+	sd := path.Dir(sub)
+	if sd == dir {
+		return true
+	}
+	if dir != "." && !strings.HasPrefix(sd, dir+"/") {
+		return false
+	}
+	for _, c := range strings.Split(strings.TrimPrefix(sd, dir+"/"), "/") {
+		if reSubsDir.MatchString(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// pairSubtitles attaches subtitle files to videos: Movie.en.srt goes to Movie.mkv, Subs/Movie/2_English.srt
+// too, and when there is only one video every subtitle next to it or in Subs is its
+func (tu *TorrentWithUserData) pairSubtitles() {
+	videos := make([]*TorrentFile, 0)
+	for _, f := range tu.files {
+		f.subtitles = nil
+		if isVideo(f.file.DisplayPath()) && !reExtra.MatchString(f.file.DisplayPath()) {
+			videos = append(videos, f)
+		}
+	}
+	for _, s := range tu.files {
+		name := s.file.DisplayPath()
+		if subtitleFormat(name) == "" {
+			continue
+		}
+		sbase := strings.ToLower(nameWithoutExt(name))
+		var best *TorrentFile
+		score, tie := 0, false
+		rest := sbase
+		for _, v := range videos {
+			vname := v.file.DisplayPath()
+			vbase := strings.ToLower(nameWithoutExt(vname))
+			vdir := path.Dir(vname)
+			sc, r := 0, sbase
+			switch {
+			case strings.HasPrefix(sbase, vbase) && underSubsDir(name, vdir):
+				sc, r = 3, strings.TrimPrefix(sbase, vbase)
+			case strings.Contains(strings.ToLower("/"+path.Dir(name)+"/"), "/"+vbase+"/") && underSubsDir(name, vdir):
+				sc = 2
+			case len(videos) == 1 && underSubsDir(name, vdir):
+				sc = 1
+			}
+			if sc > score {
+				best, score, tie, rest = v, sc, false, r
+			} else if sc == score && sc > 0 {
+				tie = true
+			}
+		}
+		if best == nil || tie {
+			continue
+		}
+		s.language, s.forced = subtitleLanguage(rest)
+		best.subtitles = append(best.subtitles, s)
+	}
+}
+
+func (f *TorrentFile) SubtitlesInfo() []SubtitleInfo {
+	if len(f.subtitles) == 0 {
+		return nil
+	}
+	rc := make([]SubtitleInfo, 0, len(f.subtitles))
+	for _, s := range f.subtitles {
+		rc = append(rc, SubtitleInfo{
+			Index:    s.Index,
+			Name:     s.file.DisplayPath(),
+			Language: s.language,
+			Format:   subtitleFormat(s.file.DisplayPath()),
+			Forced:   s.forced,
+		})
+	}
+	return rc
+}
+
+// prioritizeSubtitles makes subtitles of video come first, they are tiny and needed right at start
+func (f *TorrentFile) prioritizeSubtitles() {
+	for _, s := range f.subtitles {
+		log.Debug("high priority for subtitle %s", s.file.DisplayPath())
+		s.setPriority(PRIORITY_HIGH)
+	}
+}
+
+// readAll reads whole file, waiting for download as long as ctx allows
+func (f *TorrentFile) readAll(ctx context.Context) ([]byte, error) {
+	if f.file.Length() > MAX_SUBTITLE_SIZE {
+		return nil, newError("%s is too big, %d bytes", f.file.DisplayPath(), f.file.Length())
+	}
+	if f.file.BytesCompleted() < f.file.Length() {
+		f.Tud.Resume("subtitle requested")
+		f.setPriority(PRIORITY_HIGH)
+	}
+	rdr := f.file.NewReader()
+	defer rdr.Close()
+	rdr.SetResponsive()
+	buf := make([]byte, f.file.Length())
+	for off := 0; off < len(buf); {
+		n, err := rdr.ReadContext(ctx, buf[off:])
+		off += n
+		if err == io.EOF && off == len(buf) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// toUTF8 decodes by BOM, keeps valid UTF-8, otherwise takes code page from charset or language
+func toUTF8(data []byte, charset string, lang string) ([]byte, error) {
+	var enc encoding.Encoding
+	switch {
+	case charset != "":
+		e, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, newError("unknown charset '%s'", charset)
+		}
+		enc = e
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return data[3:], nil
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}), bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		enc = unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)
+	case utf8.Valid(data):
+		return data, nil
+	default:
+		enc = charmap.Windows1252
+		if e, ok := subtitleCharsets[lang]; ok {
+			enc = e
+		}
+	}
+	return enc.NewDecoder().Bytes(data)
+}
+
+var (
+	reSrtTime   = regexp.MustCompile(`(\d{1,2}):(\d{2}):(\d{2})[,.](\d{1,3})`)
+	reAssTags   = regexp.MustCompile(`\{[^}]*\}`)
+	reFontTags  = regexp.MustCompile(`(?i)</?font[^>]*>`)
+	reAssFormat = regexp.MustCompile(`(?i)^format:\s*(.*)$`)
+)
+
+func vttTime(h string, m string, s string, frac string) string {
+	hh, _ := strconv.Atoi(h)
+	for len(frac) < 3 {
+		frac += "0"
+	}
+	return fmt.Sprintf("%02d:%s:%s.%s", hh, m, s, frac)
+}
+
+func srtToVtt(text string) string {
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n\n")
+	for _, line := range strings.Split(text, "\n") {
+		if strings.Contains(line, "-->") {
+			line = reSrtTime.ReplaceAllStringFunc(line, func(t string) string {
+				m := reSrtTime.FindStringSubmatch(t)
+				return vttTime(m[1], m[2], m[3], m[4])
+			})
+		} else {
+			line = reFontTags.ReplaceAllString(reAssTags.ReplaceAllString(line, ""), "")
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
+
+// assTime is H:MM:SS.cc
+func assTime(t string) string {
+	m := reSrtTime.FindStringSubmatch(strings.TrimSpace(t))
+	if m == nil {
+		return ""
+	}
+	return vttTime(m[1], m[2], m[3], m[4])
+}
+
+// assToVtt keeps dialogue text only, styles and positioning are dropped
+func assToVtt(text string) string {
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n\n")
+	events := false
+	fields := []string{"layer", "start", "end", "style", "name", "marginl", "marginr", "marginv", "effect", "text"}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			events = strings.EqualFold(line, "[events]")
+			continue
+		}
+		if !events {
+			continue
+		}
+		if m := reAssFormat.FindStringSubmatch(line); m != nil {
+			fields = fields[:0]
+			for _, f := range strings.Split(m[1], ",") {
+				fields = append(fields, strings.ToLower(strings.TrimSpace(f)))
+			}
+			continue
+		}
+		if !strings.HasPrefix(strings.ToLower(line), "dialogue:") {
+			continue
+		}
+		values := strings.SplitN(strings.TrimSpace(line[len("dialogue:"):]), ",", len(fields))
+		if len(values) != len(fields) {
+			continue
+		}
+		var start, end, txt string
+		for i, f := range fields {
+			switch f {
+			case "start":
+				start = assTime(values[i])
+			case "end":
+				end = assTime(values[i])
+			case "text":
+				txt = values[i]
+			}
+		}
+		txt = reAssTags.ReplaceAllString(txt, "")
+		txt = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ").Replace(txt)
+		if start == "" || end == "" || strings.TrimSpace(txt) == "" {
+			continue
+		}
+		sb.WriteString(start + " --> " + end + "\n" + strings.TrimSpace(txt) + "\n\n")
+	}
+	return sb.String()
+}
+
+// subtitleFile finds subtitle by {name} and {index} path variables, writes error if there is none
+func subtitleFile(w http.ResponseWriter, r *http.Request) *TorrentFile {
+	name, _ := url.QueryUnescape(mux.Vars(r)["name"])
+	tu, _ := tc.GetTorrent(name)
+	if tu == nil {
+		httpError(w, http.StatusNotFound, "failed to find torrent '%s'", name)
+		return nil
+	}
+	index, _ := strconv.Atoi(mux.Vars(r)["index"])
+	f := tu.GetFile(index)
+	if f == nil || subtitleFormat(f.file.DisplayPath()) == "" {
+		httpError(w, http.StatusNotFound, "no subtitle %d in %s", index, tu.Name)
+		return nil
+	}
+	return f
+}
+
+func subtitleText(w http.ResponseWriter, r *http.Request, f *TorrentFile) (string, bool) {
+	data, err := f.readAll(r.Context())
+	if err != nil {
+		httpError(w, http.StatusServiceUnavailable, "failed to read %s: %v", f.file.DisplayPath(), err)
+		return "", false
+	}
+	data, err = toUTF8(data, r.FormValue("charset"), f.language)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s: %v", f.file.DisplayPath(), err)
+		return "", false
+	}
+	return strings.Replace(string(data), "\r\n", "\n", -1), true
+}
+
+// _Subtitle serves subtitle file as is, only charset becomes UTF-8
+func _Subtitle(w http.ResponseWriter, r *http.Request) {
+	f := subtitleFile(w, r)
+	if f == nil {
+		return
+	}
+	text, ok := subtitleText(w, r, f)
+	if !ok {
+		return
+	}
+	ct := mimeByExtension(f.file.DisplayPath())
+	if !strings.Contains(ct, "charset") {
+		ct += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", contentDisposition("inline", path.Base(f.file.DisplayPath())))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(text))
+}
+
+func _SubtitleVtt(w http.ResponseWriter, r *http.Request) {
+	f := subtitleFile(w, r)
+	if f == nil {
+		return
+	}
+	format := subtitleFormat(f.file.DisplayPath())
+	if format == "sub" {
+		httpError(w, http.StatusUnsupportedMediaType, "%s: frame based subtitles can't be converted to WebVTT", f.file.DisplayPath())
+		return
+	}
+	text, ok := subtitleText(w, r, f)
+	if !ok {
+		return
+	}
+	switch format {
+	case "srt":
+		text = srtToVtt(text)
+	case "ass", "ssa":
+		text = assToVtt(text)
+	case "vtt":
+		if !strings.HasPrefix(text, "WEBVTT") {
+			text = "WEBVTT\n\n" + text
+		}
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Header().Set("Content-Disposition", contentDisposition("inline", nameWithoutExt(f.file.DisplayPath())+".vtt"))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(text))
+}
+
+func _apiSubtitlesList(w http.ResponseWriter, r *http.Request) {
+	tu := apiTorrent(w, r)
+	if tu == nil {
+		return
+	}
+	index, _ := strconv.Atoi(mux.Vars(r)["index"])
+	f := tu.GetFile(index)
+	if f == nil {
+		httpError(w, http.StatusNotFound, "file %d not found in %s", index, tu.Name)
+		return
+	}
+	rc := f.SubtitlesInfo()
+	if rc == nil {
+		rc = []SubtitleInfo{}
+	}
+	writeJson(w, http.StatusOK, rc)
+}
@@ -0,0 +1,131 @@
+package torc
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSrtToVtt(t *testing.T) {
+	for _, c := range []struct {
+		srt string
+		vtt string
+	}{
+		{"00:01:02,5 --> 00:01:03,25", "00:01:02.500 --> 00:01:03.250"},
+		{"1:02:03,004 --> 1:02:04,100", "01:02:03.004 --> 01:02:04.100"},
+		{"00:00:01.000 --> 00:00:02.000 X1:10", "00:00:01.000 --> 00:00:02.000 X1:10"},
+		{"<font color=\"red\">Hello</font>", "Hello"},
+		{"{\\an8}On top", "On top"},
+		{"<i>kept</i>", "<i>kept</i>"},
+	} {
+		got := srtToVtt(c.srt)
+		if want := "WEBVTT\n\n" + c.vtt + "\n"; got != want {
+			t.Errorf("%q: got %q, want %q", c.srt, got, want)
+		}
+	}
+}
+
+func TestAssToVtt(t *testing.T) {
+	const head = "[Script Info]\nTitle: test\n\n[V4+ Styles]\nFormat: Name, Fontname\nStyle: Default,Arial\n\n[Events]\n"
+	for _, c := range []struct {
+		events string
+		vtt    string
+	}{
+		{"Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+			"Dialogue: 0,0:00:01.50,0:00:03.00,Default,,0,0,0,,{\\i1}Hello{\\i0}, world\\Nsecond line",
+			"00:00:01.500 --> 00:00:03.000\nHello, world\nsecond line\n\n"},
+		// fields in other order, text is the last one and keeps its commas
+		{"Format: Start, End, Text\nDialogue: 0:00:05.00,0:00:06.10,a, b,\\hc",
+			"00:00:05.000 --> 00:00:06.100\na, b, c\n\n"},
+		// default format without Format line
+		{"Dialogue: 0,1:00:00.00,1:00:01.00,Default,,0,0,0,,late",
+			"01:00:00.000 --> 01:00:01.000\nlate\n\n"},
+		{"Comment: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,not shown", ""},
+		{"Dialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,{\\pos(1,2)}", ""},
+	} {
+		if got := assToVtt(head + c.events); got != "WEBVTT\n\n"+c.vtt {
+			t.Errorf("%q: got %q, want %q", c.events, got, "WEBVTT\n\n"+c.vtt)
+		}
+	}
+	if got := assToVtt("Dialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,before events"); got != "WEBVTT\n\n" {
+		t.Errorf("dialogue outside [Events]: %q", got)
+	}
+}
+
+func TestToUTF8(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		data    []byte
+		charset string
+		lang    string
+		want    string
+	}{
+		{"utf-8 bom", []byte("\xef\xbb\xbfПривет"), "", "ru", "Привет"},
+		{"utf-16le bom", []byte{0xff, 0xfe, 'h', 0, 'i', 0}, "", "", "hi"},
+		{"utf-16be bom", []byte{0xfe, 0xff, 0, 'h', 0, 'i'}, "", "", "hi"},
+		{"valid utf-8", []byte("Zażółć"), "", "pl", "Zażółć"},
+		{"cp1251 by language", []byte{0xcf, 0xf0, 0xe8, 0xe2, 0xe5, 0xf2}, "", "ru", "Привет"},
+		{"cp1250 by language", []byte{0x9c, 0xb9}, "", "pl", "śą"},
+		{"cp1252 by default", []byte{0xe9, 0xe8}, "", "fr", "éè"},
+		{"charset wins", []byte{0xcf, 0xf0}, "windows-1251", "fr", "Пр"},
+	} {
+		got, err := toUTF8(c.data, c.charset, c.lang)
+		if err != nil || string(got) != c.want {
+			t.Errorf("%s: got %q, %v, want %q", c.name, got, err, c.want)
+		}
+	}
+	if _, err := toUTF8([]byte("x"), "no-such-charset", ""); err == nil {
+		t.Errorf("no error for unknown charset")
+	}
+}
+
+// subtitlesOf is name:language[:forced] of subtitles paired with file
+func subtitlesOf(tu *TorrentWithUserData, name string) []string {
+	rc := make([]string, 0)
+	for _, f := range tu.Files() {
+		if f.file.DisplayPath() != name {
+			continue
+		}
+		for _, s := range f.SubtitlesInfo() {
+			v := s.Name + ":" + s.Language
+			if s.Forced {
+				v += ":forced"
+			}
+			rc = append(rc, v)
+		}
+	}
+	sort.Strings(rc)
+	return rc
+}
+
+func TestPairSubtitles(t *testing.T) {
+	movie := addTestTorrent(t, "Pair Movie", map[string]int{
+		"Movie.mkv":             20000,
+		"Movie.en.srt":          100,
+		"Subs/2_Russian.srt":    100,
+		"Subs/3_fre.forced.ass": 100,
+		"Extras/notes.srt":      100,
+	})
+	want := "Movie.en.srt:en Subs/2_Russian.srt:ru Subs/3_fre.forced.ass:fr:forced"
+	if got := strings.Join(subtitlesOf(movie, "Movie.mkv"), " "); got != want {
+		t.Errorf("single video: got %s, want %s", got, want)
+	}
+
+	show := addTestTorrent(t, "Pair Show", map[string]int{
+		"E01.mkv":          20000,
+		"E02.mkv":          20000,
+		"E01.rus.srt":      100,
+		"Subs/E01/eng.srt": 100,
+		"Subs/E02/spa.srt": 100,
+		// no video name in it, both videos are as good
+		"Subs/ukr.srt": 100,
+	})
+	for video, want := range map[string]string{
+		"E01.mkv": "E01.rus.srt:ru Subs/E01/eng.srt:en",
+		"E02.mkv": "Subs/E02/spa.srt:es",
+	} {
+		if got := strings.Join(subtitlesOf(show, video), " "); got != want {
+			t.Errorf("%s: got %s, want %s", video, got, want)
+		}
+	}
+}
@@ -1,31 +1,44 @@
 package torc
 
 import (
+	"context"
+	"fmt"
 	tt "github.com/anacrolix/torrent"
-	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+	"ttv/client"
 )
 
-type TorrentFileInfo struct {
-	Name string					`json:"Name"`
-	Size int64					`json:"Size"`
-	Ready bool					`json:"Ready"`
-	BytesWant int				`json:"BytesWant"`
-	BytesHave int				`json:"BytesHave"`
-}
+type TorrentFileInfo = client.TorrentFileInfo
+type SubtitleInfo = client.SubtitleInfo
 
 type TorrentFile struct {
 	file *tt.File
 	Tud *TorrentWithUserData
-	Preparing bool
+	Index int
+	// guards contentType, duration and durationLooked, handlers and prebuffering fill them
+	cacheLock sync.Mutex
+	contentType string
+	duration float64
+	// regions Duration read already and found nothing in, they aren't read again
+	durationLooked [2]bool
+	// videos have paired subtitles, subtitles have language
+	subtitles []*TorrentFile
+	language string
+	forced bool
+	// priority torrent was told about last time
+	priority string
+	job *prepareJob
 	BytesWant int
 	BytesHave int
-	ReadersOpen int
+	// atomic, TrackProgress asks for InPlay while streams open and close
+	ReadersOpen int32
 }
 
 func NewTorrentFile(tud *TorrentWithUserData, file *tt.File) *TorrentFile {
 	ps := int(tud.torrent.Info().PieceLength)
 	rc := TorrentFile {
-		Preparing: false,
 		BytesWant: ps*LOAD_FROM_START+ps*LOAD_FROM_END,
 		BytesHave: 0,
 		Tud: tud,
@@ -37,89 +50,148 @@ func NewTorrentFile(tud *TorrentWithUserData, file *tt.File) *TorrentFile {
 }
 
 func ( f *TorrentFile) Info() TorrentFileInfo {
+	want, have := f.prepared()
 	return TorrentFileInfo {
 		Name: f.file.DisplayPath(),
 		Size: f.file.Length(),
-		Ready: f.Ready(),
-		BytesWant: f.BytesWant,
-		BytesHave: f.BytesHave,
+		Ready: have >= want,
+		BytesWant: want,
+		BytesHave: have,
+		Priority: f.Priority(),
+		Subtitles: f.SubtitlesInfo(),
+		Prepare: f.PrepareInfo(),
+		Watch: f.WatchState(),
+	}
+}
+
+// ContentType is by extension, first piece is sniffed if extension tells nothing and piece is here already
+func (f *TorrentFile) ContentType() string {
+	f.cacheLock.Lock()
+	defer f.cacheLock.Unlock()
+	if f.contentType != "" {
+		return f.contentType
 	}
+	if ct := mimeByExtension(f.file.DisplayPath()); ct != "" {
+		f.contentType = ct
+		return ct
+	}
+	buf := f.readComplete(0, SNIFF_SIZE)
+	if buf == nil {
+		return "application/octet-stream"
+	}
+	f.contentType = sniffMime(buf)
+	log.Debug("%s sniffed as %s", f.file.DisplayPath(), f.contentType)
+	return f.contentType
+}
+
+// ETag doesn't change, file data is fixed by infohash
+func (f *TorrentFile) ETag() string {
+	return fmt.Sprintf(`"%s-%d"`, f.Tud.torrent.InfoHash().HexString(), f.Index)
+}
+
+// LastModified is when torrent was added, creation date of torrent if it has no such tag
+func (f *TorrentFile) LastModified() time.Time {
+	if added := f.Tud.Tags.getTime("added", time.Time{}); !added.IsZero() {
+		return added
+	}
+	if mi := f.Tud.torrent.Metainfo(); mi.CreationDate > 0 {
+		return time.Unix(mi.CreationDate, 0)
+	}
+	return time.Time{}
 }
 
 func (f *TorrentFile) OpenFileReader() (reader tt.Reader) {
 	f.Tud.Resume("OpenFileReader")
-	f.ReadersOpen += 1
+	n := atomic.AddInt32(&f.ReadersOpen, 1)
 	reader = f.file.NewReader()
-	cs := f.Tud.torrent.Info().PieceLength
-	reader.SetReadahead(cs*20)
+	reader.SetReadahead(f.readahead())
 	reader.SetResponsive()
-	log.Info("open file reader %s, now active: %d",f.file.DisplayPath(), f.ReadersOpen )
+	log.Info("open file reader %s, now active: %d",f.file.DisplayPath(), n )
 	return
 }
 
 func (f *TorrentFile) CloseFileReader(reader tt.Reader)  {
-	f.ReadersOpen -= 1
+	n := atomic.AddInt32(&f.ReadersOpen, -1)
 	_ = reader.Close()
-	log.Info("close file reader %s, now active: %d",f.file.DisplayPath(), f.ReadersOpen)
+	log.Info("close file reader %s, now active: %d",f.file.DisplayPath(), n)
+}
+
+// readRange downloads range piece by piece, so BytesHave shows progress
+func (f *TorrentFile) readRange(ctx context.Context, rdr tt.Reader, r byteRange) error {
+	pl := f.Tud.torrent.Info().PieceLength
+	for off := r.Off; off < r.Off+r.Len; off += pl {
+		n := pl
+		if off+n > r.Off+r.Len {
+			n = r.Off + r.Len - off
+		}
+		data, err := readAt(ctx, rdr, off, n)
+		prepareLock.Lock()
+		f.BytesHave += len(data)
+		prepareLock.Unlock()
+		if err != nil {
+			return newError("failed to read %v at %d: %v", f.file.Path(), off, err)
+		}
+		if int64(len(data)) < n {
+			return newError("%v ends at %d, %d bytes short", f.file.Path(), off+int64(len(data)), n-int64(len(data)))
+		}
+	}
+	return nil
+}
+
+// prepared is BytesWant and BytesHave, prepare jobs and prefetch change them under prepareLock
+func (f *TorrentFile) prepared() (want int, have int) {
+	prepareLock.Lock()
+	defer prepareLock.Unlock()
+	return f.BytesWant, f.BytesHave
 }
 
 func (f *TorrentFile) Ready() bool {
-	return f.BytesHave >= f.BytesWant
+	want, have := f.prepared()
+	return have >= want
 }
 
-func (f *TorrentFile) PrepareForPlay() {
-	if f.Preparing {
-		return
-	}
+// PrepareForPlay downloads what player reads first, error if some of it couldn't be read
+func (f *TorrentFile) PrepareForPlay(ctx context.Context) error {
 	if f.Ready() {
-		return
+		return nil
 	}
-
 	tu := f.Tud
-	f.Preparing = true
 	tu.Resume("prepare for play")
-	cs := int64(tu.torrent.Info().PieceLength*LOAD_FROM_END)
+	f.prioritizeSubtitles()
 	rdr := f.OpenFileReader()
-	defer func() {
-		f.Preparing = false
-		f.CloseFileReader(rdr)
-	}()
-
-	buf := make([]byte, cs)
-	log.Debug("reading from end %v ", cs)
-	if _,err := rdr.Seek(-cs, io.SeekEnd); err != nil {
-		log.Warn("failed to seek to io.SeekEnd: %v. ignore error", err)
-	}
-	for of := int64(0); of < cs; {
-		n, err := rdr.Read(buf)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Error("failed to read %v - %v", f.file.Path(), err)
+	defer f.CloseFileReader(rdr)
+
+	// head first, it tells container and where its index is, then index and seconds from start.
+	// probing isn't counted, index and start are read again from complete pieces
+	var probeErr error
+	read := func(off int64, n int64) []byte {
+		data, err := readAt(ctx, rdr, off, n)
+		if err != nil && probeErr == nil {
+			probeErr = err
 		}
-		of += int64(n)
-		f.BytesHave += n
-		log.Debug("end: read/left: %v/%v", of, cs-of)
+		return data
 	}
-	cs = tu.torrent.Info().PieceLength*LOAD_FROM_START
-	if _, err := rdr.Seek(0, io.SeekStart); err != nil {
-		log.Warn("failed to seek to io.SeekStart: %v. ignore error", err)
+	head := read(0, PREBUFFER_PROBE)
+	index := f.containerIndex(head, read)
+	if probeErr != nil {
+		return newError("failed to read head of %s: %v", f.file.DisplayPath(), probeErr)
 	}
-	log.Debug("reading from start %v ", cs)
-	for of := int64(0); of < cs; {
-		n, err := rdr.Read(buf)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Error("failed to read %v - %v", f.file.Path(), err)
+	start := f.prebufferStart()
+	want := start
+	for _, r := range index {
+		want += r.Len
+	}
+	prepareLock.Lock()
+	f.BytesHave = 0
+	f.BytesWant = int(want)
+	prepareLock.Unlock()
+	log.Debug("prebuffer %s: %d bytes from start, index %v", f.file.DisplayPath(), start, index)
+	for _, r := range append(index, byteRange{0, start}) {
+		if err := f.readRange(ctx, rdr, r); err != nil {
+			return err
 		}
-		of += int64(n)
-		f.BytesHave += n
-		log.Debug("start: read/left: %v/%v", of, cs-of)
 	}
-	f.BytesHave = f.BytesWant
+	return nil
 }
 
 
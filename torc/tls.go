@@ -0,0 +1,180 @@
+package torc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// self signed certificate lifetime
+const TLS_SELF_SIGNED_TTL = 5 * 365 * 24 * time.Hour
+
+// how often certificate files are checked for changes
+const TLS_RELOAD_CHECK = 10 * time.Second
+
+// certReloader serves certificate from files and reloads it when they change
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+
+	sync.Mutex
+}
+
+func NewCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) lastModified() time.Time {
+	var rc time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(rc) {
+			rc = fi.ModTime()
+		}
+	}
+	return rc
+}
+
+func (cr *certReloader) load() error {
+	mt := cr.lastModified()
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return newError("failed to load certificate %s, %s: %v", cr.certFile, cr.keyFile, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		log.Info("certificate %s loaded: %v, expires %s", cr.certFile, cert.Leaf.DNSNames, cert.Leaf.NotAfter.Format(time.RFC822))
+	}
+	cr.cert = &cert
+	cr.modTime = mt
+	return nil
+}
+
+// GetCertificate is for tls.Config, old certificate is kept if new one fails to load
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.Lock()
+	defer cr.Unlock()
+	if time.Since(cr.checked) > TLS_RELOAD_CHECK {
+		cr.checked = time.Now()
+		if cr.lastModified().After(cr.modTime) {
+			if err := cr.load(); err != nil {
+				log.Error("%v, keep using old one", err)
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+// GenerateSelfSigned writes ECDSA certificate and key for this host
+func GenerateSelfSigned(certFile string, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return newError("failed to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return newError("failed to generate serial: %v", err)
+	}
+	now := time.Now()
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"ttv"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(TLS_SELF_SIGNED_TTL),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return newError("failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return newError("failed to marshal key: %v", err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+			return newError("failed to create dir for %s: %v", f, err)
+		}
+	}
+	if err := writePem(keyFile, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	if err := writePem(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	log.Info("self signed certificate for %v written to %s", hosts, certFile)
+	return nil
+}
+
+func writePem(file string, kind string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return newError("failed to create %s: %v", file, err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: kind, Bytes: der}); err != nil {
+		return newError("failed to write %s: %v", file, err)
+	}
+	return nil
+}
+
+// tlsHosts are names self signed certificate is valid for
+func tlsHosts(listenAddr string) []string {
+	rc := []string{"localhost"}
+	if h, err := os.Hostname(); err == nil && h != "localhost" {
+		rc = append([]string{h}, rc...)
+	}
+	rc = append(rc, "127.0.0.1", "::1")
+	if ip := net.ParseIP(listenAddr); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		rc = append(rc, listenAddr)
+	}
+	return rc
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// newTlsConfig uses configured certificate or generates self signed one on first run
+func newTlsConfig(certFile string, keyFile string, listenAddr string) (*tls.Config, error) {
+	if !fileExists(certFile) && !fileExists(keyFile) {
+		log.Warn("no certificate %s, generating self signed one", certFile)
+		if err := GenerateSelfSigned(certFile, keyFile, tlsHosts(listenAddr)); err != nil {
+			return nil, err
+		}
+	}
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}, nil
+}
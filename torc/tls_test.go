@@ -0,0 +1,117 @@
+package torc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveTls serves ok over tls with config, returns https url of it
+func serveTls(t *testing.T, config *tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go srv.Serve(tls.NewListener(l, config))
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + l.Addr().String()
+}
+
+// tlsGet gets url trusting only certificate in certFile, each call does new handshake
+func tlsGet(t *testing.T, url string, certFile string) error {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		t.Fatalf("no certificate in %s", certFile)
+	}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, DisableKeepAlives: true}}
+	resp, err := c.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "ok" {
+		t.Errorf("got %q", body)
+	}
+	return nil
+}
+
+func TestTlsSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls", "cert.pem"), filepath.Join(dir, "tls", "key.pem")
+	config, err := newTlsConfig(certFile, keyFile, "0.0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(keyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key file: %v, %v", fi, err)
+	}
+	if err := tlsGet(t, serveTls(t, config), certFile); err != nil {
+		t.Errorf("get with generated certificate: %v", err)
+	}
+}
+
+func TestTlsReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := GenerateSelfSigned(certFile, keyFile, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := serveTls(t, &tls.Config{GetCertificate: cr.GetCertificate})
+	oldCert := filepath.Join(dir, "old.pem")
+	data, err := ioutil.ReadFile(certFile)
+	if err == nil {
+		err = ioutil.WriteFile(oldCert, data, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsGet(t, url, oldCert); err != nil {
+		t.Fatalf("get with first certificate: %v", err)
+	}
+
+	// new files are picked up on next check, mtime is moved so it's newer on any fs
+	if err := GenerateSelfSigned(certFile, keyFile, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	cr.Lock()
+	cr.checked = time.Time{}
+	cr.Unlock()
+	if err := tlsGet(t, url, certFile); err != nil {
+		t.Errorf("get with reloaded certificate: %v", err)
+	}
+	if err := tlsGet(t, url, oldCert); err == nil {
+		t.Errorf("old certificate is still served")
+	}
+
+	// broken key keeps certificate which works
+	if err := ioutil.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	cr.Lock()
+	cr.checked = time.Time{}
+	cr.Unlock()
+	if err := tlsGet(t, url, certFile); err != nil {
+		t.Errorf("get after failed reload: %v", err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -40,7 +41,11 @@ type TorrentClient struct {
 	ExternalPort    int
 	ExternalAddr    string
 	KodiCategory    string
-	Trackers        [][]string
+	// seconds of playback PrepareForPlay downloads from start of file
+	PrebufferSeconds int
+	// bytes/sec torrents let back by arbiter share while something plays, 0 is no limit
+	ArbiterRate int
+	Trackers         [][]string
 	//
 	torrents []*TorrentWithUserData
 	//
@@ -60,6 +65,9 @@ func NewTorrentClient(logger *logger.Log) *TorrentClient {
 		if torClient.KodiCategory = GetEnv("TC_KODI_CATEGORY", ""); torClient.KodiCategory == "" {
 			panic(log.Error("TC_KODI_CATEGORY is not defined"))
 		}
+		LoadFileRules(GetEnv("TC_RULESFILE", "rules.yaml"))
+		torClient.PrebufferSeconds, _ = strconv.Atoi(GetEnv("TC_PREBUFFER_SECONDS", strconv.Itoa(PREBUFFER_SECONDS)))
+		torClient.ArbiterRate, _ = strconv.Atoi(GetEnv("TC_ARBITER_RATE", strconv.Itoa(ARBITER_RATE)))
 		torClient.ExternalAddr = getExternalIP()
 		torClient.ExternalPort = getExternalPort(torClient.PortForwardFile)
 		torClient.torrents = make([]*TorrentWithUserData, 0)
@@ -172,6 +180,7 @@ func (c *TorrentClient) fileWatcher() {
 						tu.SetTags(tags)
 						tu.SyncTags()
 						tu.Tags.Validate("TorrentFileCreated force validate")
+						Emit(EvTagsChanged, tu, "", tu.Tags.Copy())
 						log.Trace("%s tags are:\n%s", tu.Name, tu.Tags.String())
 					}
 				}
@@ -202,6 +211,7 @@ func (c *TorrentClient) fileWatcher() {
 func (c *TorrentClient) Start() {
 	log.Info("starting client on %v:%v", torClient.cfg.ListenHost, torClient.cfg.ListenPort)
 	go monitorExternalAddrPort()
+	go arbiter.run(c)
 
 	go func() {
 		log.Info("watiting on Initial scan to be done")
@@ -267,7 +277,16 @@ func (c *TorrentClient) AddTorrentFromFile(cat *tCategory, filename string, full
 	}
 	filename = strings.TrimSuffix(filename, ".torrent")
 	filename = strings.TrimSuffix(filename, ".magnet")
-	if tud, err = c.AddTorrentFromData(cat.name, filename, info, &Tags{}); err != nil {
+	// data of torrents created of nested paths or adopted stays where it is, storage is opened at their download tag
+	tags := &Tags{}
+	if tfile := path.Join(cat.fullpath, filename+".torrent.tags.yaml"); fileExists(tfile) {
+		if saved := ReadTagsFromFile(tfile); saved != nil {
+			if dir, ok := (*saved)["download"].(string); ok && dir != "" {
+				tags.Set("download", dir)
+			}
+		}
+	}
+	if tud, err = c.AddTorrentFromData(cat.name, filename, info, tags); err != nil {
 		return
 	}
 	tud.SyncTags()
@@ -334,6 +353,7 @@ func (c *TorrentClient) AddTorrentFromData(cat string, name string, info []byte,
 		err = newError(log.Error("failed to AddTorrent: %v", err))
 		return
 	}
+	Emit(EvAdded, tud, "", map[string]interface{}{"Category": pcat.name})
 	//if len(c.Trackers) > 5 {
 	//	tor.AddTrackers(c.Trackers)
 	//}
@@ -348,9 +368,13 @@ func (c *TorrentClient) AddTorrentFromData(cat string, name string, info []byte,
 			tor.AddTrackers(c.Trackers)
 		}
 	}
-	tud.Tags.SetIfNew("datapath", path.Join(pcat.download, tor.Name()))
+	tud.Tags.SetIfNew("datapath", path.Join(tud.Tags.getString("download", pcat.download), tor.Name()))
 	tud.torrent = tor
 	tud.InfoReady = true
+	Emit(EvMetadataResolved, tud, "", map[string]interface{}{
+		"Size":       tor.Length(),
+		"FilesCount": len(tor.Files()),
+	})
 	tud.Pause("just added, waiting on SyncFiles")
 	tud.SyncFiles()
 	log.Info("%s added to client", tud.Name)
@@ -362,16 +386,32 @@ func (c *TorrentClient) LoadMetaInfoFromMagnet(uri string, name string) (mi []by
 	return c.ml.LoadMagnet(uri)
 }
 
+// AddTorrentFromMagnet blocks till metainfo is resolved by MagnetLoader
+func (c *TorrentClient) AddTorrentFromMagnet(cat string, name string, uri string, tags *Tags) (tud *TorrentWithUserData, err error) {
+	m, err := metainfo.ParseMagnetURI(uri)
+	if err != nil {
+		err = newError(log.Error("failed to parse magnet %s: %v", uri, err))
+		return
+	}
+	if tud, _ = c.GetTorrent(m.InfoHash.HexString()); tud != nil {
+		err = newError("%s already added", tud.Name)
+		return
+	}
+	data, err := c.LoadMetaInfoFromMagnet(uri, name)
+	if err != nil {
+		return
+	}
+	tags.SetIfNew("magnet", uri)
+	return c.AddTorrentFromData(cat, name, data, tags)
+}
+
 func (c *TorrentClient) GetTorrents() []*TorrentWithUserData {
 	return c.torrents
 }
 
+// PauseNotInPlay holds downloads which don't play, arbiter lets them back when streams have enough
 func (c *TorrentClient) PauseNotInPlay() {
-	for _, t := range c.torrents {
-		if !(t.InPlay() || t.Completed() || t.ForceDownload) {
-			t.Pause("paused because some torrents about to be playing")
-		}
-	}
+	arbiter.Begin(c)
 }
 
 func (c *TorrentClient) ActivePlays() (count int) {
@@ -395,6 +435,32 @@ func (c *TorrentClient) RemoveTorrent(torrentId interface{}) {
 	}
 }
 
+// DropTorrent marks torrent for removal and processes it right away. returns false if torrent
+// can't be removed now (in play or still seeding), it will be removed by one of next ProcessTags.
+// force doesn't wait for seed_until
+func (c *TorrentClient) DropTorrent(tu *TorrentWithUserData, reason string, dropData bool, force bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	drop_data := "no"
+	if dropData {
+		drop_data = "yes"
+	}
+	if force {
+		tu.Drop(reason, drop_data, true)
+	} else {
+		tu.Drop(reason, drop_data)
+	}
+	if dropData {
+		tu.Tags.Set("drop_data", "yes")
+	}
+	// first pass pauses torrent, second one removes it
+	for i := 0; i < 2 && !tu.Dead; i++ {
+		tu.ProcessTags()
+	}
+	return tu.Dead
+}
+
 func (c *TorrentClient) ProcessTags() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
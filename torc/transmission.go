@@ -0,0 +1,433 @@
+package torc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// what Sonarr and friends see, the same version peers see
+const TR_VERSION = "2.95 (ttv)"
+const TR_RPC_VERSION = 15
+const TR_SESSION_HEADER = "X-Transmission-Session-Id"
+
+// transmission file priorities, low is -1
+var trPriorities = map[string]int{PRIORITY_SKIP: 0, PRIORITY_NORMAL: 0, PRIORITY_HIGH: 1}
+
+// transmission torrent statuses
+const (
+	trStopped      = 0
+	trCheckWait    = 1
+	trCheck        = 2
+	trDownloadWait = 3
+	trDownload     = 4
+	trSeedWait     = 5
+	trSeed         = 6
+)
+
+type trRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       interface{}     `json:"tag,omitempty"`
+}
+
+type trResponse struct {
+	Result    string      `json:"result"`
+	Arguments interface{} `json:"arguments"`
+	Tag       interface{} `json:"tag,omitempty"`
+}
+
+// trArguments has arguments of every supported method
+type trArguments struct {
+	Ids             interface{} `json:"ids"`
+	Fields          []string    `json:"fields"`
+	Filename        string      `json:"filename"`
+	Metainfo        string      `json:"metainfo"`
+	DownloadDir     string      `json:"download-dir"`
+	Paused          bool        `json:"paused"`
+	DeleteLocalData bool        `json:"delete-local-data"`
+}
+
+// trIds keeps torrent ids stable while process lives, transmission clients keep them between calls
+type trIds struct {
+	next   int
+	byHash map[string]int
+
+	sync.Mutex
+}
+
+var (
+	trSessionId = randomHex(24)
+	trIdMap     = trIds{byHash: map[string]int{}}
+	trStarted   = time.Now()
+)
+
+func (ids *trIds) get(hash string) int {
+	ids.Lock()
+	defer ids.Unlock()
+	if id, ok := ids.byHash[hash]; ok {
+		return id
+	}
+	ids.next += 1
+	ids.byHash[hash] = ids.next
+	return ids.next
+}
+
+func _TransmissionRpc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(TR_SESSION_HEADER, trSessionId)
+	if r.Header.Get(TR_SESSION_HEADER) != trSessionId {
+		w.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("<h1>409: Conflict</h1><p>Your request had an invalid session-id header.</p><p><code>" +
+			TR_SESSION_HEADER + ": " + trSessionId + "</code></p>"))
+		return
+	}
+	if r.Method != "POST" {
+		httpError(w, http.StatusMethodNotAllowed, "rpc requests are POST only")
+		return
+	}
+	req := trRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "failed to decode json: %v", err)
+		return
+	}
+	args := trArguments{}
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			writeJson(w, http.StatusOK, trResponse{Result: "bad arguments: " + err.Error(), Tag: req.Tag})
+			return
+		}
+	}
+	log.Debug("transmission rpc %s %s", req.Method, string(req.Arguments))
+
+	var rc interface{}
+	var err error
+	switch req.Method {
+	case "session-get":
+		rc = trSessionGet()
+	case "session-stats":
+		rc = trSessionStats()
+	case "torrent-get":
+		rc, err = trTorrentGet(args)
+	case "torrent-add", "torrent-start", "torrent-start-now", "torrent-stop", "torrent-remove":
+		if !hasScope(r, ScopeAdmin) {
+			err = newError("%s needs %s scope", req.Method, ScopeAdmin)
+			break
+		}
+		switch req.Method {
+		case "torrent-add":
+			rc, err = trTorrentAdd(args)
+		case "torrent-remove":
+			rc, err = trTorrentRemove(args)
+		default:
+			rc, err = trTorrentStartStop(args, req.Method != "torrent-stop")
+		}
+	default:
+		err = newError("method name not recognized")
+	}
+	resp := trResponse{Result: "success", Arguments: rc, Tag: req.Tag}
+	if err != nil {
+		log.Warn("transmission rpc %s failed: %v", req.Method, err)
+		resp.Result = err.Error()
+		resp.Arguments = map[string]interface{}{}
+	}
+	writeJson(w, http.StatusOK, resp)
+}
+
+func trSessionGet() map[string]interface{} {
+	dir := ""
+	var free int64 = -1
+	if cat, ok := GetCategory(tc.KodiCategory); ok {
+		dir = cat.download
+		free = diskFree(dir)
+	}
+	return map[string]interface{}{
+		"version":                    TR_VERSION,
+		"rpc-version":                TR_RPC_VERSION,
+		"rpc-version-minimum":        1,
+		"session-id":                 trSessionId,
+		"download-dir":               dir,
+		"download-dir-free-space":    free,
+		"peer-port":                  tc.ExternalPort,
+		"port-forwarding-enabled":    false,
+		"dht-enabled":                true,
+		"pex-enabled":                true,
+		"encryption":                 "preferred",
+		"speed-limit-down-enabled":   false,
+		"speed-limit-up-enabled":     false,
+		"alt-speed-enabled":          false,
+		"seedRatioLimited":           false,
+		"seedRatioLimit":             0,
+		"idle-seeding-limit-enabled": false,
+		"download-queue-enabled":     false,
+		"seed-queue-enabled":         false,
+		"start-added-torrents":       true,
+	}
+}
+
+func trSessionStats() map[string]interface{} {
+	active, paused, count := 0, 0, 0
+	down, up := 0, 0
+	var downloaded, uploaded int64
+	for _, tu := range tc.GetTorrents() {
+		if tu == nil || !tu.InfoReady || tu.Dead {
+			continue
+		}
+		count += 1
+		if tu.Paused {
+			paused += 1
+		} else {
+			active += 1
+		}
+		info := tu.TorrentInfo()
+		down += info.DownloadRate
+		up += tu.UploadRate()
+		downloaded += info.BytesDownloaded
+		uploaded += info.BytesUploaded
+	}
+	stats := map[string]interface{}{
+		"uploadedBytes":   uploaded,
+		"downloadedBytes": downloaded,
+		"filesAdded":      count,
+		"sessionCount":    1,
+		"secondsActive":   int(time.Since(trStarted).Seconds()),
+	}
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       count,
+		"downloadSpeed":      down,
+		"uploadSpeed":        up,
+		"cumulative-stats":   stats,
+		"current-stats":      stats,
+	}
+}
+
+// trTorrents finds torrents by ids argument: number, hash, list of them or "recently-active", nil means all
+func trTorrents(ids interface{}) []*TorrentWithUserData {
+	all := false
+	list := make([]interface{}, 0)
+	switch v := ids.(type) {
+	case nil:
+		all = true
+	case []interface{}:
+		list = v
+	case string:
+		all = v == "recently-active"
+		list = append(list, v)
+	default:
+		list = append(list, v)
+	}
+	rc := make([]*TorrentWithUserData, 0)
+	for _, tu := range tc.GetTorrents() {
+		if tu == nil || !tu.InfoReady || tu.Dead {
+			continue
+		}
+		hash := tu.Tags.getString("infohash", "")
+		if all {
+			rc = append(rc, tu)
+			continue
+		}
+		for _, id := range list {
+			match := false
+			switch v := id.(type) {
+			case float64:
+				match = int(v) == trIdMap.get(hash)
+			case string:
+				match = strings.EqualFold(v, hash)
+			}
+			if match {
+				rc = append(rc, tu)
+				break
+			}
+		}
+	}
+	return rc
+}
+
+func trStatus(tu *TorrentWithUserData) int {
+	switch {
+	case tu.UserPaused():
+		return trStopped
+	case tu.Completed() && tu.Paused:
+		return trStopped
+	case tu.Completed():
+		return trSeed
+	case tu.Paused:
+		// paused by ttv itself, resumes on its own
+		return trDownloadWait
+	}
+	return trDownload
+}
+
+func trTorrent(tu *TorrentWithUserData) map[string]interface{} {
+	t := tu.torrent
+	mi := t.Metainfo()
+	info := tu.TorrentInfo()
+	hash := tu.Tags.getString("infohash", "")
+	wanted, _ := tu.wantedBytes()
+	left := tu.BytesLeft()
+	// of wanted bytes like sizeWhenDone, arrs import when it's 1
+	percentDone := 0.0
+	if wanted > 0 {
+		percentDone = float64(wanted-left) / float64(wanted)
+	} else if tu.InfoReady {
+		percentDone = 1.0
+	}
+	eta := -1
+	if left > 0 && info.DownloadRate > 0 && !tu.Paused {
+		eta = int(left / int64(info.DownloadRate))
+	}
+	ratio := -1.0
+	if info.BytesDownloaded > 0 {
+		ratio = float64(info.BytesUploaded) / float64(info.BytesDownloaded)
+	}
+	doneDate := int64(0)
+	if tu.Tags.getString("completed", "") != "" {
+		doneDate = tu.Tags.getTime("completed", time.Time{}).Unix()
+	}
+	files := make([]map[string]interface{}, 0)
+	fileStats := make([]map[string]interface{}, 0)
+	for _, f := range tu.Files() {
+		done := f.file.BytesCompleted()
+		files = append(files, map[string]interface{}{"name": f.file.Path(), "length": f.file.Length(), "bytesCompleted": done})
+		fileStats = append(fileStats, map[string]interface{}{"bytesCompleted": done, "wanted": f.Wanted(), "priority": trPriorities[f.Priority()]})
+	}
+	trackers := make([]map[string]interface{}, 0)
+	for i, tr := range torrentTrackers(tu) {
+		trackers = append(trackers, map[string]interface{}{"id": i, "tier": tr.Tier, "announce": tr.Url})
+	}
+	errString := ""
+	if reason := tu.Tags.getString("want_drop", ""); reason != "" {
+		errString = "about to be removed: " + reason
+	}
+	return map[string]interface{}{
+		"id":                 trIdMap.get(hash),
+		"hashString":         hash,
+		"name":               info.Name,
+		"status":             trStatus(tu),
+		"totalSize":          info.Size,
+		"sizeWhenDone":       wanted,
+		"leftUntilDone":      left,
+		"haveValid":          t.BytesCompleted(),
+		"desiredAvailable":   left,
+		"percentDone":        percentDone,
+		"isFinished":         info.Completed,
+		"isStalled":          !tu.Paused && !info.Completed && info.Seeders == 0,
+		"downloadDir":        tu.Tags.getString("download", ""),
+		"rateDownload":       info.DownloadRate,
+		"rateUpload":         tu.UploadRate(),
+		"downloadedEver":     info.BytesDownloaded,
+		"uploadedEver":       info.BytesUploaded,
+		"uploadRatio":        ratio,
+		"eta":                eta,
+		"error":              0,
+		"errorString":        errString,
+		"addedDate":          tu.Tags.getTime("added", time.Time{}).Unix(),
+		"doneDate":           doneDate,
+		"activityDate":       time.Now().Unix(),
+		"peersConnected":     info.Seeders + info.Leechers,
+		"peersSendingToUs":   info.Seeders,
+		"peersGettingFromUs": info.Leechers,
+		"seedRatioLimit":     0,
+		"seedRatioMode":      2,
+		"queuePosition":      0,
+		"isPrivate":          tu.Tags.getString("private", "no") == "yes",
+		"magnetLink":         mi.Magnet(t.Name(), t.InfoHash()).String(),
+		"pieceCount":         t.NumPieces(),
+		"pieceSize":          t.Info().PieceLength,
+		"files":              files,
+		"fileStats":          fileStats,
+		"trackers":           trackers,
+	}
+}
+
+func trTorrentGet(args trArguments) (interface{}, error) {
+	if len(args.Fields) == 0 {
+		return nil, newError("no fields given")
+	}
+	list := make([]map[string]interface{}, 0)
+	for _, tu := range trTorrents(args.Ids) {
+		all := trTorrent(tu)
+		rc := map[string]interface{}{}
+		for _, f := range args.Fields {
+			if v, ok := all[f]; ok {
+				rc[f] = v
+			}
+		}
+		list = append(list, rc)
+	}
+	rc := map[string]interface{}{"torrents": list}
+	if s, ok := args.Ids.(string); ok && s == "recently-active" {
+		rc["removed"] = []int{}
+	}
+	return rc, nil
+}
+
+// trTorrentAdd takes url, magnet or base64 .torrent, download-dir picks category
+func trTorrentAdd(args trArguments) (interface{}, error) {
+	req := AddTorrentRequest{Paused: args.Paused}
+	if args.DownloadDir != "" {
+		cat, ok := FindCategoryByDir(args.DownloadDir)
+		if !ok {
+			return nil, newError("no category for download-dir %s", args.DownloadDir)
+		}
+		req.Category = cat.name
+	}
+	var data []byte
+	switch {
+	case args.Metainfo != "":
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(args.Metainfo); err != nil {
+			return nil, newError("bad metainfo: %v", err)
+		}
+	case strings.HasPrefix(args.Filename, "magnet:"):
+		req.Magnet = args.Filename
+	case strings.HasPrefix(args.Filename, "http://") || strings.HasPrefix(args.Filename, "https://"):
+		req.Url = args.Filename
+	default:
+		return nil, newError("filename must be magnet or url, or metainfo given")
+	}
+	added, status, err := addTorrent(req, data, "transmission")
+	if status == http.StatusConflict {
+		return map[string]interface{}{"torrent-duplicate": trAdded(added)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"torrent-added": trAdded(added)}, nil
+}
+
+func trAdded(rc AddTorrentResponse) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         trIdMap.get(rc.InfoHash),
+		"name":       rc.Name,
+		"hashString": rc.InfoHash,
+	}
+}
+
+func trTorrentStartStop(args trArguments, start bool) (interface{}, error) {
+	for _, tu := range trTorrents(args.Ids) {
+		if start {
+			tu.UserResume("resumed via transmission rpc")
+		} else {
+			tu.UserPause("paused via transmission rpc")
+		}
+		tu.SaveTags()
+	}
+	return map[string]interface{}{}, nil
+}
+
+func trTorrentRemove(args trArguments) (interface{}, error) {
+	if args.Ids == nil {
+		return nil, newError("ids are required")
+	}
+	for _, tu := range trTorrents(args.Ids) {
+		// torrents in play are removed by ProcessTags later
+		tc.DropTorrent(tu, "removed via transmission rpc", args.DeleteLocalData, false)
+	}
+	return map[string]interface{}{}, nil
+}
@@ -0,0 +1,39 @@
+package torc
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTrTorrentPartialData(t *testing.T) {
+	cat, _ := GetCategory(TEST_CATEGORY)
+	// files fill whole pieces, e01 is complete without e02
+	data := makeTorrent(t, cat.download, "Tr Show", map[string]int{"e01.mkv": 32 << 10, "e02.mkv": 32 << 10})
+	defer os.RemoveAll(path.Join(cat.download, "Tr Show"))
+	os.Remove(path.Join(cat.download, "Tr Show", "e02.mkv"))
+	tu, err := tc.AddTorrentFromData(TEST_CATEGORY, "Tr Show", data, &Tags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.RemoveTorrent(tu.Name)
+	tu.torrent.VerifyData()
+
+	tr := trTorrent(tu)
+	if tr["percentDone"] != 0.5 || tr["leftUntilDone"] != int64(32<<10) || tr["sizeWhenDone"] != int64(64<<10) {
+		t.Errorf("percentDone %v, leftUntilDone %v, sizeWhenDone %v", tr["percentDone"], tr["leftUntilDone"], tr["sizeWhenDone"])
+	}
+	if tr["isFinished"] != false {
+		t.Errorf("isFinished %v with e02 missing", tr["isFinished"])
+	}
+
+	// skipped file isn't waited for, arrs see it done
+	tu.SetFilePriority(tu.GetFile("Tr Show/e02.mkv").Index, PRIORITY_SKIP)
+	tr = trTorrent(tu)
+	if tr["percentDone"] != 1.0 || tr["leftUntilDone"] != int64(0) || tr["sizeWhenDone"] != int64(32<<10) {
+		t.Errorf("skipped e02: percentDone %v, leftUntilDone %v, sizeWhenDone %v", tr["percentDone"], tr["leftUntilDone"], tr["sizeWhenDone"])
+	}
+	if tr["isFinished"] != true {
+		t.Errorf("isFinished %v with skipped file missing", tr["isFinished"])
+	}
+}
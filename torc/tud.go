@@ -9,7 +9,10 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+	"ttv/client"
 )
 
 const LOAD_FROM_START = 10
@@ -52,6 +55,15 @@ type TorrentWithUserData struct {
 	ignore_yml_write   time.Time
 	onstart_downloaded int64
 	onstart_uploaded   int64
+	//
+	ul_lock        sync.Mutex
+	ul_rate        int
+	ul_sampled     time.Time
+	ul_sampled_len int64
+	// parsed PRIORITIES_TAG and category, refreshPriorities keeps them
+	prio_lock     sync.Mutex
+	prio          map[int]string
+	prio_category string
 }
 
 func NewTorrentWithUserData(tags *Tags) *TorrentWithUserData {
@@ -68,8 +80,16 @@ func (tu *TorrentWithUserData) AddTags(tags *Tags) {
 	if tags == nil {
 		return
 	}
+	added := Tags{}
 	for k, v := range *tags {
-		tu.Tags.SetIfNew(k, v)
+		if _, ok := (*tu.Tags)[k]; !ok {
+			tu.Tags.Set(k, v)
+			added[k] = v
+		}
+	}
+	if len(added) > 0 {
+		tu.refreshPriorities()
+		Emit(EvTagsChanged, tu, "", added)
 	}
 }
 
@@ -81,6 +101,7 @@ func (tu *TorrentWithUserData) SetTags(tags *Tags) {
 	for k, v := range *tags {
 		tu.Tags.Set(k, v)
 	}
+	tu.refreshPriorities()
 }
 
 func (tu *TorrentWithUserData) SaveTorrent() {
@@ -128,6 +149,7 @@ func (tu *TorrentWithUserData) SyncTags() {
 		return
 	}
 	tu.Tags = tags
+	tu.refreshPriorities()
 	if tu.Tags.getString("paused", "no") == "yes" {
 		tu.Pause(tu.Tags.getString("pause_reason", "paused in reloaded tags"))
 	} else {
@@ -167,26 +189,13 @@ func (tu *TorrentWithUserData) SyncFiles() {
 	tu.files = make([]*TorrentFile, len(tu.torrent.Files()))
 	for i, v := range tu.torrent.Files() {
 		f := NewTorrentFile(tu, v)
+		f.Index = i
 		tu.files[i] = f
 	}
+	tu.pairSubtitles()
 }
 
-type TorrentInfo struct {
-	Name            string            `json:"Name"`
-	Size            int64             `json:"Size"`
-	FilesCount      int               `json:"FilesCount"`
-	Files           []TorrentFileInfo `json:"Files"`
-	Seeders         int               `json:"Seeders"`
-	Leechers        int               `json:"Leechers"`
-	Completed       bool              `json:"Completed"`
-	Completion      int               `json:"Completion"`
-	BytesDownloaded int64             `json:"BytesDownloaded"`
-	BytesUploaded   int64             `json:"BytesUploaded"`
-	Paused          bool              `json:"Paused"`
-	OpenPlays       int               `json:"OpenPlays"`
-	Tags            Tags              `json:"Tags"`
-	DownloadRate    int               `json:"DownloadRate"`
-}
+type TorrentInfo = client.TorrentInfo
 
 func (tu *TorrentWithUserData) TorrentInfo() (info TorrentInfo) {
 	t := tu.torrent
@@ -205,7 +214,7 @@ func (tu *TorrentWithUserData) TorrentInfo() (info TorrentInfo) {
 		Files:           files,
 		Seeders:         st.ConnectedSeeders,
 		Leechers:        st.ActivePeers,
-		Completed:       t.BytesMissing() <= 0,
+		Completed:       tu.Completed(),
 		BytesDownloaded: st.BytesReadUsefulData.Int64(),
 		BytesUploaded:   st.BytesWrittenData.Int64(),
 		Paused:          tu.Paused,
@@ -217,6 +226,28 @@ func (tu *TorrentWithUserData) TorrentInfo() (info TorrentInfo) {
 	return
 }
 
+// UploadRate is bytes/sec since previous call, calls closer than second apart get previous value
+func (tu *TorrentWithUserData) UploadRate() int {
+	if tu.torrent == nil {
+		return 0
+	}
+	tu.ul_lock.Lock()
+	defer tu.ul_lock.Unlock()
+	now := time.Now()
+	tdelta := now.Sub(tu.ul_sampled).Seconds()
+	if tdelta < 1 {
+		return tu.ul_rate
+	}
+	st := tu.torrent.Stats()
+	uploaded := st.BytesWrittenData.Int64()
+	if !tu.ul_sampled.IsZero() {
+		tu.ul_rate = int(float64(uploaded-tu.ul_sampled_len) / tdelta)
+	}
+	tu.ul_sampled = now
+	tu.ul_sampled_len = uploaded
+	return tu.ul_rate
+}
+
 func (tu *TorrentWithUserData) Files() []*TorrentFile {
 	if !tu.InfoReady {
 		return make([]*TorrentFile, 0)
@@ -266,6 +297,7 @@ func (tu *TorrentWithUserData) Pause(reason string) {
 	// tu.torrent.DisallowDataDownload()
 	tu.SetMaxConnections(1)
 	tu.Paused = true
+	Emit(EvStateChanged, tu, "", map[string]interface{}{"Paused": true, "Reason": reason})
 }
 
 func (tu *TorrentWithUserData) Resume(reason string) {
@@ -279,25 +311,58 @@ func (tu *TorrentWithUserData) Resume(reason string) {
 		tu.Tags.Set("resume_reason", reason)
 	}
 	tu.torrent.AllowDataDownload()
-	tu.torrent.DownloadAll()
+	tu.applyPriorities()
 	tu.unpaused = time.Now()
 	tu.unpaused_downloaded = tu.torrent.BytesCompleted()
 	tu.Paused = false
+	Emit(EvStateChanged, tu, "", map[string]interface{}{"Paused": false, "Reason": reason})
+}
+
+// UserPause pauses torrent on user request, ProcessTags keeps it paused even when completed
+func (tu *TorrentWithUserData) UserPause(reason string) {
+	tu.Tags.Set("user_paused", "yes")
+	tu.Pause(reason)
+}
+
+func (tu *TorrentWithUserData) UserResume(reason string) {
+	tu.Tags.Remove("user_paused")
+	tu.Resume(reason)
+}
+
+func (tu *TorrentWithUserData) UserPaused() bool {
+	return tu.Tags.getString("user_paused", "no") == "yes"
 }
 
+// Completed is true when all files which are not skipped are downloaded
 func (tu *TorrentWithUserData) Completed() bool {
-	return tu.torrent.BytesMissing() <= 0
+	if !tu.InfoReady {
+		return tu.torrent.BytesMissing() <= 0
+	}
+	length, completed := tu.wantedBytes()
+	return completed >= length
 }
 
+// Completion is of files which are not skipped, 100 if all of them are
 func (tu *TorrentWithUserData) Completion() (percents int) {
 	if tu.InfoReady {
-		bm := float64(tu.torrent.BytesCompleted())
-		tl := float64(tu.torrent.Length())
-		percents = int((bm / tl) * 100.0)
+		length, completed := tu.wantedBytes()
+		if length == 0 {
+			return 100
+		}
+		percents = int((float64(completed) / float64(length)) * 100.0)
 	}
 	return
 }
 
+// BytesLeft is what is missing of files which are not skipped
+func (tu *TorrentWithUserData) BytesLeft() int64 {
+	if !tu.InfoReady {
+		return tu.torrent.BytesMissing()
+	}
+	length, completed := tu.wantedBytes()
+	return length - completed
+}
+
 func (tu *TorrentWithUserData) TrackProgress() {
 	if tu.Completed() {
 		log.Trace("%s is completed, no SubscribePieceStateChanges", tu.Name)
@@ -330,6 +395,12 @@ func (tu *TorrentWithUserData) TrackProgress() {
 				}
 				tu.Tags.Set("max_rate", max_rate)
 				tu.Tags.Set("max_seeders", max_seeders)
+				Emit(EvPieceProgress, tu, "", map[string]interface{}{
+					"Piece":        v.Index,
+					"Completion":   info.Completion,
+					"DownloadRate": tu.dl_rate,
+					"Seeders":      info.Seeders,
+				})
 			}
 			if !completed && tu.Completed() {
 				added, _ := time.Parse(time.RFC822, tu.Tags.getString("added", time.Now().Format(time.RFC822)))
@@ -338,6 +409,7 @@ func (tu *TorrentWithUserData) TrackProgress() {
 				tu.Tags.SetIfNew("total_time", total_time)
 				tu.Tags.SetIfNew("last_rate", tu.dl_rate)
 				log.Info("DownloadCompleted for %s, last rate: %d B/s, took: %v sec", tu.Name, tu.dl_rate, total_time)
+				Emit(EvCompleted, tu, "", map[string]interface{}{"TotalTime": total_time, "LastRate": tu.dl_rate})
 				s.Close()
 			}
 		}
@@ -346,7 +418,7 @@ func (tu *TorrentWithUserData) TrackProgress() {
 
 func (tu *TorrentWithUserData) ActiveReaders() (count int) {
 	for _, f := range tu.Files() {
-		count += f.ReadersOpen
+		count += int(atomic.LoadInt32(&f.ReadersOpen))
 	}
 	return
 }
@@ -417,16 +489,19 @@ func (tu *TorrentWithUserData) HandleDelete() bool {
 	_ = os.Remove(tu.Tags.getString("tags_fullpath", "/tmp/should_not_exists"))
 	log.Info("torrent %s (data: %v) removed from client", tu.Name, drop_data)
 	tu.Dead = true
+	Emit(EvDropped, tu, "", map[string]interface{}{"Reason": reason, "DataRemoved": drop_data == "yes"})
 	return true
 
 }
 
+// Drop marks torrent to be removed by ProcessTags. tag rules only note delete_data, data goes
+// away when drop_data is set, "no" takes back drop_data asked for before
 func (tu *TorrentWithUserData) Drop(reason string, drop_data string, force ...bool) {
 	tu.Tags.Set("want_drop", reason)
 	if drop_data == "yes" {
 		tu.Tags.Set("delete_data", "yes")
-	} else if drop_data == "" {
-		drop_data = tu.Tags.getString("drop_data", "no")
+	} else if drop_data == "no" {
+		tu.Tags.Remove("drop_data")
 	}
 	if len(force) > 0 {
 		tu.Tags.Set("force_delete", "yes")
@@ -458,16 +533,26 @@ func (tu *TorrentWithUserData) ProcessTags() {
 				tu.Pause("")
 			} else {
 				tu.Resume("")
+				// file_priorities tag may have been changed
+				tu.applyPriorities()
 			}
 		}
 	}()
 
 	log.Trace("ProcessTags: %s", tu.Name)
+	// tags could be changed by api or in file
+	tu.refreshPriorities()
 	if tu.Completed() {
 		tu.Tags.Set("completed", "yes")
 	} else {
 		tu.Tags.Set("completed", "no")
 	}
+	watched := tu.Watched()
+	if watched {
+		tu.Tags.Set("watched", "yes")
+	} else {
+		tu.Tags.Set("watched", "no")
+	}
 	//
 	// populate some info
 	info := tu.TorrentInfo()
@@ -501,6 +586,11 @@ func (tu *TorrentWithUserData) ProcessTags() {
 	if tu.Tags.getString("save_to_library", "") == "yes" {
 		tu.Drop("moving to library", "no")
 	}
+	// drop_watched - remove data once all media files were watched, the tag asks for it
+	if watched && tu.Tags.getString("drop_watched", "") == "yes" {
+		tu.Drop("drop_watched tag found, all watched", "yes")
+		tu.Tags.Set("drop_data", "yes")
+	}
 	// expire watch_later after 3 days
 	if tu.Tags.getString("watch_later", "") == "yes" {
 		tu.Tags.SetIfNew("watch_later_expiration", time.Now().Format(time.RFC822))
@@ -546,7 +636,7 @@ func (tu *TorrentWithUserData) ProcessTags() {
 		maxConn = 200
 	}
 
-	if completed {
+	if completed && !tu.UserPaused() {
 		tu.Resume("torrent completed, ok to upload")
 	}
 
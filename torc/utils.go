@@ -11,6 +11,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -90,10 +91,9 @@ func getExternalPort(port_file string) int {
 }
 
 func newError(format string, v ...interface{}) error {
-	return errors.Errorf(format, v)
+	return errors.Errorf(format, v...)
 }
 
-//
 type Tags map[string]interface{}
 type mapOfStrings map[string]string
 
@@ -163,6 +163,15 @@ func (t Tags) SetIfNew(name string, value interface{}) {
 	}
 }
 
+// Copy is for events, subscribers encode it later while tags go on changing
+func (t Tags) Copy() Tags {
+	rc := make(Tags, len(t))
+	for k, v := range t {
+		rc[k] = v
+	}
+	return rc
+}
+
 func (t Tags) Remove(name string) {
 	if _, ok := t[name]; ok {
 		delete(t, name)
@@ -209,6 +218,20 @@ func ReadTagsFromFile(pathname string) (tags *Tags) {
 	return &rc
 }
 
+// diskFree is free space available to us on filesystem with dir, -1 if unknown
+func diskFree(dir string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
+
+// safeFileName makes user supplied torrent name usable as file name inside category dir
+func safeFileName(name string) string {
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(strings.TrimLeft(name, "."))
+}
+
 func IsValidTorrentFile(fullpathname string, checkExistsFile bool) bool {
 	if checkExistsFile {
 		if stat, err := os.Stat(fullpathname); err != nil || stat.IsDir() {